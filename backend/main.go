@@ -3,16 +3,21 @@ package main
 
 import (
 	"context"
-	"errors"
+	"fmt"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
+	"voip-client-backend/pkg/baresip"
+	"voip-client-backend/pkg/callrequest"
 	"voip-client-backend/pkg/config"
 	"voip-client-backend/pkg/fsm"
+	"voip-client-backend/pkg/homeassistant"
 	"voip-client-backend/pkg/httpserver"
 	"voip-client-backend/pkg/logger"
+	"voip-client-backend/pkg/mqtt"
+	"voip-client-backend/pkg/stdin"
 	"voip-client-backend/pkg/tts"
 
 	"github.com/f18m/go-baresip/pkg/gobaresip"
@@ -22,6 +27,10 @@ import (
 
 const logPrefix = "main"
 
+// timeoutTickerInterval is the resolution of all the timeouts handled by the FSM, e.g. the
+// max duration of each call, which can be overridden per-request, and the escalation delays
+const timeoutTickerInterval = 1 * time.Second
+
 func main() {
 	logger := logger.NewCustomLogger("backend")
 	logger.Info("VOIP client backend starting")
@@ -31,59 +40,128 @@ func main() {
 	if err != nil {
 		logger.Fatalf("config loading error: %s", err)
 	}
+	for _, contact := range cfg.Contacts {
+		if _, err := contact.GetTTSOptions(); err != nil {
+			logger.Fatalf("config error in 'contacts': %s", err)
+		}
+	}
 
-	// Allocate Baresip instance with options
-	baresipConn, err := gobaresip.New(
+	// Allocate the connection to Baresip, which creates a new Baresip instance with these options
+	// every time baresip gets restarted
+	baresipConn := baresip.NewConnection(logger,
 		gobaresip.UseExternalBaresip(), // s6-overlay is running baresip in the background
 		gobaresip.SetLogger(logger),
 		gobaresip.SetPingInterval(1*time.Hour),
 	)
-	if err != nil {
-		logger.Fatalf("baresip init error: %s", err)
-	}
 
-	// Run Baresip Serve() method in its own goroutine
+	// Run the connection in its own goroutine
 	baresipCtx, baresipCancel := context.WithCancel(context.Background())
 	go func() {
-		err := baresipConn.Serve(baresipCtx)
-		if err != nil {
-			if errors.Is(err, gobaresip.ErrNoCtrlConn) {
-				logger.Fatal("Cannot find the 'baresip' control socket... check the s6 'baresip' service init logs")
-			} else {
-				logger.Fatalf("baresip exit error: %s", err)
-			}
+		if err := baresipConn.Run(baresipCtx); err != nil {
+			logger.Fatalf("baresip init error: %s", err)
 		}
 	}()
 
 	// PUB-SUB channel used from FSM to publish its state changes to...whoever is interested
 	broadcaster := broadcast.NewBroadcaster(100)
 
+	// Init the TTS service and its cache of audio files
+	ttsCache := tts.NewCache(logger, cfg.GetTTSCacheDir(), cfg.GetTTSCacheMaxSize(), cfg.GetTTSCacheMaxAge())
+	if err := ttsCache.Load(); err != nil {
+		logger.Warnf("error loading the TTS cache: %s", err)
+	}
+	ttsService := tts.NewTTSService(logger, cfg.TTSEngine.Platform, ttsCache)
+	if len(cfg.TTSEngine.Prewarm) > 0 {
+		go ttsService.PrewarmAtStartup(cfg.TTSEngine.Prewarm)
+	}
+
+	// Build the requests coming from all the input adapters and hand them to the FSM goroutine
+	dispatcher := callrequest.NewDispatcher(logger, cfg)
+
 	// Run the input HTTP server, which can process HTTP API requests coming from HomeAssistant.
 	var inputServer httpserver.HttpServer
 	if cfg.HttpRESTServer.Synchronous {
-		inputServer = httpserver.NewServer(logger, broadcaster, cfg.Contacts)
+		inputServer = httpserver.NewServer(logger, broadcaster, dispatcher, ttsService)
 	} else {
-		inputServer = httpserver.NewServer(logger, nil, cfg.Contacts)
+		inputServer = httpserver.NewServer(logger, nil, dispatcher, ttsService)
 	}
 	go func() {
 		inputServer.ListenAndServe()
 	}()
 
-	// Init the TTS service
-	ttsService := tts.NewTTSService(logger, cfg.TTSEngine.Platform)
+	// Read the commands written by HomeAssistant on the addon stdin, for compatibility with the dss_voip addon
+	stdinReader := stdin.NewReader(logger, os.Stdin, dispatcher)
+	go stdinReader.Run()
+
+	// Init the client used to push data into HomeAssistant
+	haClient := homeassistant.NewClient(logger)
+
+	// Run the MQTT publisher, which exposes the addon as a device in HomeAssistant
+	mqttCtx, mqttCancel := context.WithCancel(context.Background())
+	if cfg.MQTT.Enabled {
+		broker, err := getMQTTBroker(cfg, haClient)
+		if err != nil {
+			logger.Warnf("MQTT broker not available, MQTT discovery disabled: %s", err)
+		} else {
+			mqttPublisher := mqtt.NewPublisher(logger, broadcaster, dispatcher, cfg, broker)
+			go mqttPublisher.Run(mqttCtx)
+		}
+	}
 
 	// Process
-	// - BARESIP connected event: TCP socket connected
+	// - BARESIP connected events: TCP socket connected or disconnected (e.g. baresip restarted)
 	// - BARESIP events: unsolicited messages from baresip, e.g. incoming calls, registrations, etc.
-	// - INPUT HTTP requests: messages coming from HomeAssistant via the HTTP server
+	// - INPUT HTTP requests: messages coming from HomeAssistant via the HTTP server, the addon stdin
+	//   or the HomeAssistant entities exposed via MQTT
+	// - STATUS HTTP requests: read-only requests for a snapshot of the FSM state
+	// - HANGUP requests: requests to close the calls in progress
+	// - TTS results: audio files prepared by the TTS workers for the calls waiting for them
 	// - TICKER events: periodic events to check the status of the calls and the Baresip client
 	// using a simple Finite State Machine (FSM) -- all business logic is implemented in the FSM
 	cChan := baresipConn.GetConnectedChan()
 	eChan := baresipConn.GetEventChan()
-	iChan := inputServer.GetInputChannel()
-	fsmInstance := fsm.NewVoipClientFSM(logger, baresipConn, ttsService, broadcaster, cfg.GetVoiceCallMaxDuration())
+	iChan := dispatcher.GetInputChannel()
+	sChan := dispatcher.GetStatusChannel()
+	hChan := dispatcher.GetHangupChannel()
+	callQueue := fsm.NewCallRequestQueue(logger, cfg.GetCallQueueMaxDepth(), cfg.GetCallQueueMaxAge(), cfg.GetCallQueueFile())
+	incomingCallPolicy, err := fsm.NewIncomingCallPolicy(cfg.IncomingCalls.Rules, cfg.IncomingCalls.DefaultAction)
+	if err != nil {
+		logger.Fatalf("config error in 'incoming_calls': %s", err)
+	}
+	dtmfMenus, err := fsm.NewDTMFMenus(cfg.DTMFMenus)
+	if err != nil {
+		logger.Fatalf("config error in 'dtmf_menus': %s", err)
+	}
+	longMessagePolicy, err := fsm.ParseLongMessagePolicy(cfg.GetVoiceCallLongMessage())
+	if err != nil {
+		logger.Fatalf("config error in 'voice_calls': %s", err)
+	}
+
+	// Run the TTS workers, which prepare the audio files of the calls without blocking the FSM
+	ttsWorkers := fsm.NewTTSWorkerPool(logger, ttsService, cfg.GetTTSWorkers())
+	ttsCtx, ttsCancel := context.WithCancel(context.Background())
+	go ttsWorkers.Run(ttsCtx)
+	tChan := ttsWorkers.GetResultChannel()
+
+	fsmInstance := fsm.NewVoipClientFSM(logger, baresipConn, ttsWorkers, callQueue, incomingCallPolicy, dtmfMenus, haClient, broadcaster,
+		cfg.GetVoipProviders(), cfg.GetVoipFailover(), cfg.GetVoiceCallMaxDuration(), longMessagePolicy, cfg.GetVoiceCallMaxConcurrentCalls())
+	fsmInstance.SetRegistrationPolicy(fsm.RegistrationPolicy{
+		Timeout:       cfg.GetRegistrationTimeout(),
+		Interval:      cfg.GetRegistrationInterval(),
+		RetryDelay:    cfg.GetRegistrationRetryDelay(),
+		RetryMaxDelay: cfg.GetRegistrationRetryMaxDelay(),
+		NotifyAfter:   cfg.GetRegistrationNotifyAfter(),
+	})
+	if cfg.VoiceCalls.DialFirst {
+		holdToneFile, fallbackFile, err := getDialFirstAudioFiles(ttsService, cfg)
+		if err != nil {
+			logger.Warnf("dial-first mode disabled, its audio files are not available: %s", err)
+		} else {
+			fsmInstance.EnableDialFirst(holdToneFile, fallbackFile)
+		}
+	}
 	statsTicker := time.NewTicker(cfg.GetStatsInterval())
-	timeoutTicker := time.NewTicker(cfg.GetVoiceCallMaxDuration() / 10)
+	timeoutTicker := time.NewTicker(timeoutTickerInterval)
 
 	// Run the FSM in its own goroutine
 
@@ -95,17 +173,34 @@ func main() {
 					continue
 				}
 				if c.Connected {
-					_ = fsmInstance.InitializeUserAgent(cfg.VoipProvider.Account, cfg.VoipProvider.Password)
+					_ = fsmInstance.InitializeUserAgents()
+				} else {
+					// the User Agents will be created again on reconnection
+					_ = fsmInstance.OnBaresipDisconnected()
 				}
 
 			case i, ok := <-iChan:
 				if !ok {
 					continue
 				}
-				_ = fsmInstance.OnNewOutgoingCallRequest(fsm.NewCallRequest{
-					CalledNumber: i.CalledNumber,
-					MessageTTS:   i.MessageTTS,
-				})
+				receipt, err := fsmInstance.OnNewOutgoingCallRequest(i.Request)
+				i.ReplyCh <- callrequest.DialReply{Receipt: receipt, Err: err}
+
+			case s, ok := <-sChan:
+				if !ok {
+					continue
+				}
+				s.ReplyCh <- callrequest.StatusReply{FSM: fsmInstance.GetStatus(), Baresip: baresipConn.GetStats()}
+
+			case h, ok := <-hChan:
+				if !ok {
+					continue
+				}
+				numCancelled, err := fsmInstance.OnHangupRequest(h.CallID, h.RequestID)
+				h.ReplyCh <- callrequest.HangupReply{NumCancelled: numCancelled, Err: err}
+
+			case r := <-tChan:
+				_ = fsmInstance.OnTTSCompleted(r)
 
 			case e, ok := <-eChan:
 				if !ok {
@@ -118,6 +213,9 @@ func main() {
 				case gobaresip.UA_EVENT_REGISTER_FAIL:
 					_ = fsmInstance.OnRegisterFail(e)
 
+				case gobaresip.UA_EVENT_CALL_INCOMING:
+					_ = fsmInstance.OnCallIncoming(e)
+
 				case gobaresip.UA_EVENT_CALL_OUTGOING:
 					_ = fsmInstance.OnCallOutgoing(e)
 
@@ -130,6 +228,9 @@ func main() {
 				case gobaresip.UA_EVENT_END_OF_FILE:
 					_ = fsmInstance.OnEndOfFile(e)
 
+				case gobaresip.UA_EVENT_CALL_DTMF_START:
+					_ = fsmInstance.OnDTMF(e)
+
 				default:
 					logger.InfoPkgf(logPrefix, "Ignoring event type %s", e.Type)
 				}
@@ -138,6 +239,10 @@ func main() {
 				// Publish baresip stats to the logger
 				stats := baresipConn.GetStats()
 				logger.InfoPkgf(logPrefix, "Baresip client stats: %+v", stats)
+				// Save the last use times of the cached audio files, which are updated only in memory
+				if err := ttsCache.Flush(); err != nil {
+					logger.Warnf("error saving the TTS cache index: %s", err)
+				}
 
 			case <-timeoutTicker.C:
 				// Let the FSM check if there are any calls that have been established for too long
@@ -158,6 +263,49 @@ func main() {
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 
 	<-done
+	mqttCancel()
+	ttsCancel()
 	baresipCancel()
+	if err := ttsCache.Flush(); err != nil {
+		logger.Warnf("error saving the TTS cache index: %s", err)
+	}
 	logger.Info("VOIP client backend exiting gracefully")
 }
+
+// getDialFirstAudioFiles prepares the hold tone and the fallback audio file played in dial-first mode
+func getDialFirstAudioFiles(ttsService *tts.TTSService, cfg *config.AddonOptions) (string, string, error) {
+	holdToneFile, err := ttsService.GetHoldToneFile()
+	if err != nil {
+		return "", "", err
+	}
+	fallbackFile, err := ttsService.GetFallbackFile(cfg.VoiceCalls.FallbackAudioFile)
+	if err != nil {
+		return "", "", fmt.Errorf("error preparing the fallback audio file: %w", err)
+	}
+	return holdToneFile, fallbackFile, nil
+}
+
+// getMQTTBroker returns the MQTT broker configured by the user or, if none, the one
+// provided by the Supervisor (e.g. the Mosquitto addon)
+func getMQTTBroker(cfg *config.AddonOptions, haClient *homeassistant.Client) (mqtt.BrokerConfig, error) {
+	if cfg.MQTT.Broker != "" {
+		return mqtt.BrokerConfig{
+			Address:  cfg.MQTT.Broker,
+			Username: cfg.MQTT.Username,
+			Password: cfg.MQTT.Password,
+		}, nil
+	}
+
+	service, err := haClient.GetMQTTService()
+	if err != nil {
+		return mqtt.BrokerConfig{}, err
+	}
+	if service.SSL {
+		return mqtt.BrokerConfig{}, fmt.Errorf("the MQTT service provided by the Supervisor requires SSL, which is not supported")
+	}
+	return mqtt.BrokerConfig{
+		Address:  fmt.Sprintf("%s:%d", service.Host, service.Port),
+		Username: service.Username,
+		Password: service.Password,
+	}, nil
+}
@@ -0,0 +1,263 @@
+// Package audio inspects the audio files to play during the calls and converts them into the only
+// format supported by the baresip "aufile" module: WAV, mono, 8kHz, signed 16bit PCM.
+// Everything is implemented in Go, without any external tool like ffmpeg.
+package audio
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// TargetSampleRate is the sample rate of the WAV files produced by [Convert]
+const TargetSampleRate = 8000
+
+// Format is the container format of an audio file
+type Format string
+
+const (
+	FormatWAV     Format = "wav"
+	FormatMP3     Format = "mp3"
+	FormatOGG     Format = "ogg"
+	FormatFLAC    Format = "flac"
+	FormatUnknown Format = "unknown"
+)
+
+var ErrUnsupportedFormat = errors.New("unsupported audio format")
+
+// pcmData holds decoded audio: interleaved samples in the range [-1, 1]
+type pcmData struct {
+	samples    []float32
+	channels   int
+	sampleRate int
+}
+
+// DetectFormat guesses the format of an audio file from its first bytes
+func DetectFormat(header []byte) Format {
+	switch {
+	case len(header) >= 12 && string(header[0:4]) == "RIFF" && string(header[8:12]) == "WAVE":
+		return FormatWAV
+	case bytes.HasPrefix(header, []byte("OggS")):
+		return FormatOGG
+	case bytes.HasPrefix(header, []byte("fLaC")):
+		return FormatFLAC
+	case bytes.HasPrefix(header, []byte("ID3")):
+		return FormatMP3
+	case len(header) >= 2 && header[0] == 0xFF && header[1]&0xE0 == 0xE0:
+		// MPEG audio frame sync
+		return FormatMP3
+	default:
+		return FormatUnknown
+	}
+}
+
+// NeedsConversion returns true if the given file cannot be played by baresip as it is
+func NeedsConversion(path string) (bool, error) {
+	f, err := os.Open(filepath.Clean(path))
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = f.Close() }()
+
+	h, err := ParseWAVHeader(bufio.NewReader(f))
+	if errors.Is(err, ErrInvalidWAV) {
+		// not a WAV file at all
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	return !h.IsBaresipCompatible(), nil
+}
+
+// Duration returns the duration of the audio stored in the given WAV file
+func Duration(path string) (time.Duration, error) {
+	f, err := os.Open(filepath.Clean(path))
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = f.Close() }()
+
+	h, err := ParseWAVHeader(bufio.NewReader(f))
+	if err != nil {
+		return 0, err
+	}
+
+	// some encoders write a wrong data size when streaming: trust the file size instead
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if available := info.Size() - h.DataOffset; h.DataSize == 0 || h.DataSize > available {
+		h.DataSize = available
+	}
+	return h.Duration(), nil
+}
+
+// streamingDataSize is written in the data chunk header by some encoders which do not know the
+// final size of the data when they start writing the file
+const streamingDataSize = 0xFFFFFFFF
+
+// Validate checks that the given file is a complete WAV file that baresip can play as it is
+func Validate(path string) error {
+	f, err := os.Open(filepath.Clean(path))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	h, err := ParseWAVHeader(bufio.NewReader(f))
+	if err != nil {
+		return err
+	}
+	if !h.IsBaresipCompatible() {
+		return fmt.Errorf("%w: format %#x, %d channels at %dHz, %d bits per sample", ErrInvalidWAV,
+			h.FormatTag, h.Channels, h.SampleRate, h.BitsPerSample)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	available := info.Size() - h.DataOffset
+	if available <= 0 {
+		return fmt.Errorf("%w: no audio samples", ErrInvalidWAV)
+	}
+	if h.DataSize != 0 && h.DataSize != streamingDataSize && h.DataSize > available {
+		return fmt.Errorf("%w: truncated file with %d bytes of samples out of %d", ErrInvalidWAV, available, h.DataSize)
+	}
+	return nil
+}
+
+// Convert decodes the audio file at inPath (WAV, MP3, OGG Vorbis or FLAC), downmixes it to mono,
+// resamples it to [TargetSampleRate] and writes the result to outPath as a 16bit PCM WAV file
+func Convert(inPath, outPath string) error {
+	in, err := os.Open(filepath.Clean(inPath))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = in.Close() }()
+
+	r := bufio.NewReader(in)
+	header, _ := r.Peek(12)
+	format := DetectFormat(header)
+
+	var pcm *pcmData
+	switch format {
+	case FormatWAV:
+		pcm, err = decodeWAV(r)
+	case FormatMP3:
+		pcm, err = decodeMP3(r)
+	case FormatOGG:
+		pcm, err = decodeOGG(r)
+	case FormatFLAC:
+		pcm, err = decodeFLAC(r)
+	default:
+		return fmt.Errorf("%w: %s", ErrUnsupportedFormat, inPath)
+	}
+	if err != nil {
+		return fmt.Errorf("error decoding %s file: %w", format, err)
+	}
+
+	mono := downmix(pcm.samples, pcm.channels)
+	mono = resample(mono, pcm.sampleRate, TargetSampleRate)
+
+	out, err := os.Create(filepath.Clean(outPath))
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(out)
+	err = writeWAV(w, toInt16(mono), TargetSampleRate)
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// WriteSilence writes a WAV file, playable by baresip, containing the given duration of silence
+func WriteSilence(path string, d time.Duration) error {
+	return WriteTones(path, []Tone{{Duration: d}})
+}
+
+// toneAmplitude is the amplitude of the tones written by [WriteTones], in the range [0, 1]
+const toneAmplitude = 0.5
+
+// Tone is a segment of the audio written by [WriteTones]: a sine wave at the given frequency,
+// in Hz, or silence if the frequency is zero
+type Tone struct {
+	Frequency float64
+	Duration  time.Duration
+}
+
+// WriteTones writes a WAV file, playable by baresip, containing the given sequence of tones
+func WriteTones(path string, tones []Tone) error {
+	var samples []int16
+	for _, tone := range tones {
+		n := int64(tone.Duration) * TargetSampleRate / int64(time.Second)
+		for i := range n {
+			v := toneAmplitude * math.Sin(2*math.Pi*tone.Frequency*float64(i)/TargetSampleRate)
+			samples = append(samples, int16(math.Round(v*math.MaxInt16)))
+		}
+	}
+
+	out, err := os.Create(filepath.Clean(path))
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(out)
+	err = writeWAV(w, samples, TargetSampleRate)
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// downmix averages the channels of the given interleaved samples
+func downmix(samples []float32, channels int) []float32 {
+	if channels <= 1 {
+		return samples
+	}
+	mono := make([]float32, len(samples)/channels)
+	for i := range mono {
+		var sum float32
+		for c := range channels {
+			sum += samples[i*channels+c]
+		}
+		mono[i] = sum / float32(channels)
+	}
+	return mono
+}
+
+// toInt16 converts samples in the range [-1, 1] to signed 16bit samples, clipping them if needed
+func toInt16(samples []float32) []int16 {
+	out := make([]int16, len(samples))
+	for i, s := range samples {
+		v := math.Round(float64(s) * math.MaxInt16)
+		out[i] = int16(max(math.MinInt16, min(math.MaxInt16, v)))
+	}
+	return out
+}
+
+// readAllSamples is a helper for decoders producing signed 16bit little endian samples
+func readAllSamples(r io.Reader) ([]float32, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	samples := make([]float32, len(data)/2)
+	for i := range samples {
+		samples[i] = float32(int16(uint16(data[2*i])|uint16(data[2*i+1])<<8)) / (1 << 15)
+	}
+	return samples, nil
+}
@@ -0,0 +1,279 @@
+package audio
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// sineWave returns interleaved 16bit samples of a sine wave at the given frequency, identical on all channels
+func sineWave(freq float64, sampleRate, channels int, duration time.Duration) []int16 {
+	n := int(duration.Seconds() * float64(sampleRate))
+	samples := make([]int16, 0, n*channels)
+	for i := range n {
+		v := int16(math.Round(0.5 * math.MaxInt16 * math.Sin(2*math.Pi*freq*float64(i)/float64(sampleRate))))
+		for range channels {
+			samples = append(samples, v)
+		}
+	}
+	return samples
+}
+
+// buildWAV returns a 16bit PCM WAV file; an extra chunk is added before the data chunk, as many
+// encoders do
+func buildWAV(samples []int16, sampleRate, channels int) []byte {
+	var b bytes.Buffer
+	dataSize := len(samples) * 2
+	list := []byte("LIST\x04\x00\x00\x00INFO")
+	b.WriteString("RIFF")
+	_ = binary.Write(&b, binary.LittleEndian, uint32(4+24+len(list)+8+dataSize))
+	b.WriteString("WAVEfmt ")
+	for _, v := range []any{
+		uint32(16), uint16(wavFormatPCM), uint16(channels), uint32(sampleRate),
+		uint32(sampleRate * channels * 2), uint16(channels * 2), uint16(16),
+	} {
+		_ = binary.Write(&b, binary.LittleEndian, v)
+	}
+	b.Write(list)
+	b.WriteString("data")
+	_ = binary.Write(&b, binary.LittleEndian, uint32(dataSize))
+	_ = binary.Write(&b, binary.LittleEndian, samples)
+	return b.Bytes()
+}
+
+func writeTempFile(t *testing.T, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// readConverted checks that the given file can be played by baresip and returns its samples
+func readConverted(t *testing.T, path string) (WAVHeader, []int16) {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = f.Close() }()
+	r := bufio.NewReader(f)
+	h, err := ParseWAVHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h.IsBaresipCompatible() {
+		t.Fatalf("converted file is not compatible with baresip: %+v", h)
+	}
+	samples := make([]int16, h.DataSize/2)
+	if err := binary.Read(r, binary.LittleEndian, samples); err != nil {
+		t.Fatal(err)
+	}
+	return h, samples
+}
+
+// zeroCrossingRate returns the number of sign changes per second
+func zeroCrossingRate(samples []int16, sampleRate int) float64 {
+	n := 0
+	for i := 1; i < len(samples); i++ {
+		if (samples[i-1] < 0) != (samples[i] < 0) {
+			n++
+		}
+	}
+	return float64(n) * float64(sampleRate) / float64(len(samples))
+}
+
+func rms(samples []int16) float64 {
+	var sum float64
+	for _, s := range samples {
+		sum += float64(s) * float64(s)
+	}
+	return math.Sqrt(sum/float64(len(samples))) / math.MaxInt16
+}
+
+func TestDetectFormat(t *testing.T) {
+	tests := []struct {
+		header string
+		want   Format
+	}{
+		{"RIFF\x24\x00\x00\x00WAVEfmt ", FormatWAV},
+		{"RIFF\x24\x00\x00\x00AVI LIST", FormatUnknown},
+		{"ID3\x04\x00\x00\x00\x00\x00\x00", FormatMP3},
+		{"\xff\xfb\x90\x64\x00", FormatMP3},
+		{"OggS\x00\x02", FormatOGG},
+		{"fLaC\x00\x00\x00\x22", FormatFLAC},
+		{"<html>", FormatUnknown},
+		{"", FormatUnknown},
+	}
+	for _, tt := range tests {
+		if got := DetectFormat([]byte(tt.header)); got != tt.want {
+			t.Errorf("DetectFormat(%q) = %s, want %s", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestParseWAVHeader(t *testing.T) {
+	data := buildWAV(sineWave(440, 22050, 2, 2*time.Second), 22050, 2)
+	h, err := ParseWAVHeader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := WAVHeader{FormatTag: wavFormatPCM, Channels: 2, SampleRate: 22050, BitsPerSample: 16, DataOffset: 56, DataSize: 2 * 22050 * 4}
+	if h != want {
+		t.Errorf("got header %+v, want %+v", h, want)
+	}
+	if h.Duration() != 2*time.Second {
+		t.Errorf("duration is %s, want 2s", h.Duration())
+	}
+	if h.IsBaresipCompatible() {
+		t.Error("a stereo 22kHz file must not be compatible with baresip")
+	}
+
+	for _, bad := range []string{"", "RIFF\x00\x00\x00\x00WAVE", "RIFX\x00\x00\x00\x00WAVEfmt ", "<html><body>Not Found</body></html>"} {
+		if _, err := ParseWAVHeader(bytes.NewReader([]byte(bad))); err == nil {
+			t.Errorf("ParseWAVHeader(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestNeedsConversion(t *testing.T) {
+	compatible := writeTempFile(t, "ok.wav", buildWAV(sineWave(440, 8000, 1, time.Second), 8000, 1))
+	stereo := writeTempFile(t, "stereo.wav", buildWAV(sineWave(440, 8000, 2, time.Second), 8000, 2))
+	for path, want := range map[string]bool{compatible: false, stereo: true, "testdata/test.mp3": true} {
+		got, err := NeedsConversion(path)
+		if err != nil || got != want {
+			t.Errorf("NeedsConversion(%s) = %v, %v; want %v", path, got, err, want)
+		}
+	}
+}
+
+func TestDuration(t *testing.T) {
+	data := buildWAV(sineWave(440, 8000, 1, 3*time.Second), 8000, 1)
+	path := writeTempFile(t, "ok.wav", data)
+	if d, err := Duration(path); err != nil || d != 3*time.Second {
+		t.Errorf("Duration() = %s, %v; want 3s", d, err)
+	}
+
+	// streaming encoders may leave the data size to zero
+	binary.LittleEndian.PutUint32(data[52:56], 0)
+	streamed := writeTempFile(t, "streamed.wav", data)
+	if d, err := Duration(streamed); err != nil || d != 3*time.Second {
+		t.Errorf("Duration() of a streamed file = %s, %v; want 3s", d, err)
+	}
+
+	if _, err := Duration("testdata/test.mp3"); err == nil {
+		t.Error("Duration() of an MP3 file must fail")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := buildWAV(sineWave(440, 8000, 1, time.Second), 8000, 1)
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr bool
+	}{
+		{"valid", valid, false},
+		{"truncated", valid[:len(valid)/2], true},
+		{"no samples", valid[:56], true},
+		{"stereo", buildWAV(sineWave(440, 8000, 2, time.Second), 8000, 2), true},
+		{"error page", []byte("<html><body>Internal Server Error</body></html>"), true},
+	}
+	for _, tt := range tests {
+		path := writeTempFile(t, tt.name+".wav", tt.data)
+		if err := Validate(path); (err != nil) != tt.wantErr {
+			t.Errorf("Validate(%s) returned %v, want error: %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestWriteSilence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "silence.wav")
+	if err := WriteSilence(path, 1500*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	h, samples := readConverted(t, path)
+	if h.Duration() != 1500*time.Millisecond || rms(samples) != 0 {
+		t.Errorf("got %s of audio with RMS level %.3f, want 1.5s of silence", h.Duration(), rms(samples))
+	}
+}
+
+func TestWriteTones(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tones.wav")
+	if err := WriteTones(path, []Tone{{Frequency: 440, Duration: 500 * time.Millisecond}, {Duration: 500 * time.Millisecond}}); err != nil {
+		t.Fatal(err)
+	}
+	h, samples := readConverted(t, path)
+	if h.Duration() != time.Second {
+		t.Fatalf("got %s of audio, want 1s", h.Duration())
+	}
+	half := len(samples) / 2
+	if zcr := zeroCrossingRate(samples[:half], TargetSampleRate); zcr < 860 || zcr > 900 {
+		t.Errorf("zero crossing rate of the tone is %.0f, want about 880", zcr)
+	}
+	if rms(samples[half:]) != 0 {
+		t.Errorf("the second half is not silent")
+	}
+}
+
+func TestConvertWAV(t *testing.T) {
+	in := writeTempFile(t, "in.wav", buildWAV(sineWave(440, 44100, 2, time.Second), 44100, 2))
+	out := filepath.Join(t.TempDir(), "out.wav")
+	if err := Convert(in, out); err != nil {
+		t.Fatal(err)
+	}
+
+	h, samples := readConverted(t, out)
+	if d := h.Duration(); d < 990*time.Millisecond || d > time.Second {
+		t.Errorf("duration is %s, want 1s", d)
+	}
+	// a 440Hz sine wave crosses zero 880 times per second
+	if zcr := zeroCrossingRate(samples, TargetSampleRate); math.Abs(zcr-880) > 10 {
+		t.Errorf("zero crossing rate is %.1f, want 880", zcr)
+	}
+	if level := rms(samples); math.Abs(level-0.5/math.Sqrt2) > 0.02 {
+		t.Errorf("RMS level is %.3f, want %.3f", level, 0.5/math.Sqrt2)
+	}
+}
+
+func TestResampleRemovesAliases(t *testing.T) {
+	// a 6kHz tone cannot be represented at 8kHz: it must be filtered out, instead of
+	// becoming a 2kHz tone
+	in := writeTempFile(t, "in.wav", buildWAV(sineWave(6000, 44100, 1, time.Second), 44100, 1))
+	out := filepath.Join(t.TempDir(), "out.wav")
+	if err := Convert(in, out); err != nil {
+		t.Fatal(err)
+	}
+	_, samples := readConverted(t, out)
+	if level := rms(samples); level > 0.01 {
+		t.Errorf("RMS level is %.3f, the tone was not filtered out", level)
+	}
+}
+
+func TestConvertCompressedFormats(t *testing.T) {
+	for _, name := range []string{"test.mp3", "test.ogg", "test.flac"} {
+		t.Run(name, func(t *testing.T) {
+			out := filepath.Join(t.TempDir(), "out.wav")
+			if err := Convert(filepath.Join("testdata", name), out); err != nil {
+				t.Fatal(err)
+			}
+			h, samples := readConverted(t, out)
+			if h.Duration() < 500*time.Millisecond || rms(samples) == 0 {
+				t.Errorf("converted file has duration %s and RMS level %.3f", h.Duration(), rms(samples))
+			}
+		})
+	}
+}
+
+func TestConvertUnsupported(t *testing.T) {
+	in := writeTempFile(t, "in.html", []byte("<html><body>Not Found</body></html>"))
+	if err := Convert(in, filepath.Join(t.TempDir(), "out.wav")); err == nil {
+		t.Error("conversion of an HTML file succeeded")
+	}
+}
@@ -0,0 +1,59 @@
+package audio
+
+import (
+	"errors"
+	"io"
+
+	"github.com/hajimehoshi/go-mp3"
+	"github.com/jfreymuth/oggvorbis"
+	"github.com/mewkiz/flac"
+)
+
+// decodeMP3 decodes an MP3 file; the decoder always produces 16bit stereo samples
+func decodeMP3(r io.Reader) (*pcmData, error) {
+	d, err := mp3.NewDecoder(r)
+	if err != nil {
+		return nil, err
+	}
+	samples, err := readAllSamples(d)
+	if err != nil {
+		return nil, err
+	}
+	return &pcmData{samples: samples, channels: 2, sampleRate: d.SampleRate()}, nil
+}
+
+// decodeOGG decodes an OGG Vorbis file
+func decodeOGG(r io.Reader) (*pcmData, error) {
+	samples, format, err := oggvorbis.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return &pcmData{samples: samples, channels: format.Channels, sampleRate: format.SampleRate}, nil
+}
+
+// decodeFLAC decodes a FLAC file; the samples are scaled according to the bit depth of the stream
+func decodeFLAC(r io.Reader) (*pcmData, error) {
+	stream, err := flac.New(r)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = stream.Close() }()
+
+	scale := float32(int64(1) << (stream.Info.BitsPerSample - 1))
+	var samples []float32
+	for {
+		frame, err := stream.ParseNext()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		// interleave the channels, which the decoder returns in separate subframes
+		for i := range int(frame.BlockSize) {
+			for _, subframe := range frame.Subframes {
+				samples = append(samples, float32(subframe.Samples[i])/scale)
+			}
+		}
+	}
+	return &pcmData{samples: samples, channels: int(stream.Info.NChannels), sampleRate: int(stream.Info.SampleRate)}, nil
+}
@@ -0,0 +1,54 @@
+package audio
+
+import "math"
+
+// resampleZeroCrossings is the number of zero crossings of the sinc function, on each side,
+// used by the resampling filter: more zero crossings mean a sharper filter but more CPU usage
+const resampleZeroCrossings = 16
+
+// resample converts mono samples from inRate to outRate using a windowed-sinc interpolation,
+// whose cutoff frequency removes the frequencies which cannot be represented at the lower rate
+func resample(in []float32, inRate, outRate int) []float32 {
+	if inRate == outRate || len(in) == 0 {
+		return in
+	}
+
+	ratio := float64(inRate) / float64(outRate)
+	// cutoff frequency, in cycles per input sample, slightly below the lower Nyquist frequency
+	cutoff := 0.5 * math.Min(1, 1/ratio) * 0.95
+	halfWidth := int(math.Ceil(resampleZeroCrossings / (2 * cutoff)))
+
+	out := make([]float32, int(float64(len(in))/ratio))
+	for i := range out {
+		t := float64(i) * ratio
+		center := int(t)
+		var sum, weights float64
+		for j := max(0, center-halfWidth+1); j <= min(len(in)-1, center+halfWidth); j++ {
+			x := t - float64(j)
+			w := sinc(2*cutoff*x) * hannWindow(x/float64(halfWidth))
+			sum += w * float64(in[j])
+			weights += w
+		}
+		if weights != 0 {
+			// normalize, so that the gain of the filter is exactly 1 also at the boundaries
+			sum /= weights
+		}
+		out[i] = float32(sum)
+	}
+	return out
+}
+
+func sinc(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	return math.Sin(math.Pi*x) / (math.Pi * x)
+}
+
+// hannWindow returns the Hann window for x in [-1, 1], zero outside
+func hannWindow(x float64) float64 {
+	if x <= -1 || x >= 1 {
+		return 0
+	}
+	return 0.5 * (1 + math.Cos(math.Pi*x))
+}
@@ -0,0 +1,190 @@
+package audio
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// WAV format tags, see https://learn.microsoft.com/en-us/windows/win32/api/mmreg/ns-mmreg-waveformatex
+const (
+	wavFormatPCM        = 0x0001
+	wavFormatIEEEFloat  = 0x0003
+	wavFormatExtensible = 0xFFFE
+)
+
+const wavHeaderSize = 44
+
+var ErrInvalidWAV = errors.New("invalid WAV file")
+
+// WAVHeader contains the information found in the "fmt " chunk of a WAV file, together with
+// the position and size of its "data" chunk
+type WAVHeader struct {
+	// FormatTag is the format of the samples: PCM or IEEE float; for WAVE_FORMAT_EXTENSIBLE
+	// files, it's the format found in the sub-format GUID
+	FormatTag     uint16
+	Channels      int
+	SampleRate    int
+	BitsPerSample int
+	// DataOffset and DataSize locate the samples inside the file
+	DataOffset int64
+	DataSize   int64
+}
+
+// Duration returns the duration of the audio stored in the WAV file
+func (h WAVHeader) Duration() time.Duration {
+	bytesPerSecond := int64(h.SampleRate) * int64(h.Channels) * int64(h.BitsPerSample/8)
+	if bytesPerSecond == 0 {
+		return 0
+	}
+	return time.Duration(h.DataSize * int64(time.Second) / bytesPerSecond)
+}
+
+// IsBaresipCompatible returns true if the WAV file can be played by the baresip "aufile" module
+// as it is: mono, 8kHz, signed 16bit PCM
+func (h WAVHeader) IsBaresipCompatible() bool {
+	return h.FormatTag == wavFormatPCM && h.Channels == 1 && h.SampleRate == TargetSampleRate && h.BitsPerSample == 16
+}
+
+// ParseWAVHeader reads the chunks of a WAV file until the "data" chunk is found; on success
+// the reader is positioned at the beginning of the samples
+func ParseWAVHeader(r io.Reader) (WAVHeader, error) {
+	var riff [12]byte
+	if _, err := io.ReadFull(r, riff[:]); err != nil {
+		return WAVHeader{}, fmt.Errorf("%w: %w", ErrInvalidWAV, err)
+	}
+	if string(riff[0:4]) != "RIFF" || string(riff[8:12]) != "WAVE" {
+		return WAVHeader{}, fmt.Errorf("%w: missing RIFF/WAVE signature", ErrInvalidWAV)
+	}
+
+	var h WAVHeader
+	offset := int64(len(riff))
+	foundFmt := false
+	for {
+		var chunk [8]byte
+		if _, err := io.ReadFull(r, chunk[:]); err != nil {
+			return WAVHeader{}, fmt.Errorf("%w: no data chunk found: %w", ErrInvalidWAV, err)
+		}
+		offset += int64(len(chunk))
+		id := string(chunk[0:4])
+		size := int64(binary.LittleEndian.Uint32(chunk[4:8]))
+
+		switch id {
+		case "fmt ":
+			if size < 16 || size > 1024 {
+				return WAVHeader{}, fmt.Errorf("%w: bad fmt chunk size %d", ErrInvalidWAV, size)
+			}
+			body := make([]byte, size+size%2) // chunks are word-aligned
+			if _, err := io.ReadFull(r, body); err != nil {
+				return WAVHeader{}, fmt.Errorf("%w: %w", ErrInvalidWAV, err)
+			}
+			offset += int64(len(body))
+			h.FormatTag = binary.LittleEndian.Uint16(body[0:2])
+			h.Channels = int(binary.LittleEndian.Uint16(body[2:4]))
+			h.SampleRate = int(binary.LittleEndian.Uint32(body[4:8]))
+			h.BitsPerSample = int(binary.LittleEndian.Uint16(body[14:16]))
+			if h.FormatTag == wavFormatExtensible && size >= 40 {
+				// the first 2 bytes of the sub-format GUID are the actual format tag
+				h.FormatTag = binary.LittleEndian.Uint16(body[24:26])
+			}
+			foundFmt = true
+
+		case "data":
+			if !foundFmt {
+				return WAVHeader{}, fmt.Errorf("%w: data chunk found before fmt chunk", ErrInvalidWAV)
+			}
+			if h.Channels == 0 || h.SampleRate == 0 {
+				return WAVHeader{}, fmt.Errorf("%w: %d channels at %dHz", ErrInvalidWAV, h.Channels, h.SampleRate)
+			}
+			h.DataOffset = offset
+			h.DataSize = size
+			return h, nil
+
+		default:
+			// skip any other chunk, e.g. "LIST" or "fact"
+			if _, err := io.CopyN(io.Discard, r, size+size%2); err != nil {
+				return WAVHeader{}, fmt.Errorf("%w: %w", ErrInvalidWAV, err)
+			}
+			offset += size + size%2
+		}
+	}
+}
+
+// decodeWAV reads a WAV file with PCM (8, 16, 24 or 32 bits) or IEEE float (32 or 64 bits) samples
+func decodeWAV(r io.Reader) (*pcmData, error) {
+	h, err := ParseWAVHeader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var decodeSample func(b []byte) float32
+	switch {
+	case h.FormatTag == wavFormatPCM && h.BitsPerSample == 8:
+		// 8bit samples are unsigned
+		decodeSample = func(b []byte) float32 { return (float32(b[0]) - 128) / 128 }
+	case h.FormatTag == wavFormatPCM && h.BitsPerSample == 16:
+		decodeSample = func(b []byte) float32 { return float32(int16(binary.LittleEndian.Uint16(b))) / (1 << 15) }
+	case h.FormatTag == wavFormatPCM && h.BitsPerSample == 24:
+		decodeSample = func(b []byte) float32 {
+			v := int32(b[0])<<8 | int32(b[1])<<16 | int32(b[2])<<24
+			return float32(v) / (1 << 31)
+		}
+	case h.FormatTag == wavFormatPCM && h.BitsPerSample == 32:
+		decodeSample = func(b []byte) float32 { return float32(int32(binary.LittleEndian.Uint32(b))) / (1 << 31) }
+	case h.FormatTag == wavFormatIEEEFloat && h.BitsPerSample == 32:
+		decodeSample = func(b []byte) float32 { return math.Float32frombits(binary.LittleEndian.Uint32(b)) }
+	case h.FormatTag == wavFormatIEEEFloat && h.BitsPerSample == 64:
+		decodeSample = func(b []byte) float32 { return float32(math.Float64frombits(binary.LittleEndian.Uint64(b))) }
+	default:
+		return nil, fmt.Errorf("%w: unsupported format %#x with %d bits per sample", ErrInvalidWAV, h.FormatTag, h.BitsPerSample)
+	}
+
+	// some encoders write a wrong data size when streaming: read till the end of the file
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > h.DataSize && h.DataSize > 0 {
+		data = data[:h.DataSize]
+	}
+
+	bytesPerSample := h.BitsPerSample / 8
+	samples := make([]float32, len(data)/bytesPerSample)
+	for i := range samples {
+		samples[i] = decodeSample(data[i*bytesPerSample:])
+	}
+	return &pcmData{samples: samples, channels: h.Channels, sampleRate: h.SampleRate}, nil
+}
+
+// writeWAV writes the given mono samples as a signed 16bit PCM WAV file
+func writeWAV(w io.Writer, samples []int16, sampleRate int) error {
+	dataSize := uint32(len(samples) * 2) //nolint:gosec // audio messages are far below 4GB
+
+	header := make([]byte, wavHeaderSize)
+	copy(header[0:4], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:8], wavHeaderSize-8+dataSize)
+	copy(header[8:12], "WAVE")
+	copy(header[12:16], "fmt ")
+	binary.LittleEndian.PutUint32(header[16:20], 16)
+	binary.LittleEndian.PutUint16(header[20:22], wavFormatPCM)
+	binary.LittleEndian.PutUint16(header[22:24], 1)                    // mono
+	binary.LittleEndian.PutUint32(header[24:28], uint32(sampleRate))   //nolint:gosec
+	binary.LittleEndian.PutUint32(header[28:32], uint32(sampleRate*2)) //nolint:gosec
+	binary.LittleEndian.PutUint16(header[32:34], 2)                    // block align
+	binary.LittleEndian.PutUint16(header[34:36], 16)                   // bits per sample
+	copy(header[36:40], "data")
+	binary.LittleEndian.PutUint32(header[40:44], dataSize)
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	data := make([]byte, len(samples)*2)
+	for i, s := range samples {
+		binary.LittleEndian.PutUint16(data[i*2:], uint16(s)) //nolint:gosec
+	}
+	_, err := w.Write(data)
+	return err
+}
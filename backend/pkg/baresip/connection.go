@@ -0,0 +1,234 @@
+// Package baresip keeps the addon connected to the baresip control socket, reconnecting every
+// time baresip gets restarted (e.g. by s6-overlay), so that the rest of the addon can keep using
+// a single handle and a single set of channels across reconnections.
+package baresip
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"voip-client-backend/pkg/logger"
+
+	"github.com/f18m/go-baresip/pkg/gobaresip"
+)
+
+const logPrefix = "baresip"
+
+const (
+	minReconnectDelay = 1 * time.Second
+	maxReconnectDelay = 30 * time.Second
+)
+
+// Connection runs a [gobaresip.Baresip] instance and replaces it with a new one every time the
+// control socket gets disconnected.
+// Each connection is notified on [Connection.GetConnectedChan] with Connected set to true, and
+// each disconnection with Connected set to false, always after all the events received from the
+// lost connection have been delivered on [Connection.GetEventChan].
+// The baresip commands can be invoked from any goroutine and fail while disconnected.
+// Connection implements the BaresipHandle interface of the fsm package.
+type Connection struct {
+	logger  *logger.CustomLogger
+	options []func(*gobaresip.Baresip) error
+
+	// the instance connected, or trying to connect, to baresip; nil till [Connection.Run] is invoked
+	mu      sync.Mutex
+	current *gobaresip.Baresip
+
+	connectedChan chan gobaresip.ConnectedMsg
+	eventChan     chan gobaresip.EventMsg
+}
+
+// NewConnection returns a [Connection] creating each [gobaresip.Baresip] instance with the given options
+func NewConnection(logger *logger.CustomLogger, options ...func(*gobaresip.Baresip) error) *Connection {
+	return &Connection{
+		logger:        logger,
+		options:       options,
+		connectedChan: make(chan gobaresip.ConnectedMsg),
+		eventChan:     make(chan gobaresip.EventMsg),
+	}
+}
+
+// GetConnectedChan returns the channel notifying connections and disconnections
+func (c *Connection) GetConnectedChan() <-chan gobaresip.ConnectedMsg {
+	return c.connectedChan
+}
+
+// GetEventChan returns the channel of the events received from baresip
+func (c *Connection) GetEventChan() <-chan gobaresip.EventMsg {
+	return c.eventChan
+}
+
+// Run connects to baresip and reconnects, with an increasing delay, every time the connection is
+// lost or cannot be established. It blocks until the given context is cancelled.
+// An error is returned only if the [gobaresip.Baresip] instance cannot be created.
+func (c *Connection) Run(ctx context.Context) error {
+	delay := minReconnectDelay
+	for {
+		b, err := gobaresip.New(c.options...)
+		if err != nil {
+			return err
+		}
+		c.setCurrent(b)
+
+		// forward the events till the instance stops serving
+		stop := make(chan struct{})
+		connected := make(chan bool, 1)
+		go func() {
+			connected <- c.forward(ctx, b, stop)
+		}()
+		err = b.Serve(ctx)
+		close(stop)
+		wasConnected := <-connected
+
+		if ctx.Err() != nil {
+			return nil
+		}
+		if wasConnected {
+			c.logger.WarnPkgf(logPrefix, "Lost connection to the baresip control socket: %s", err)
+			if !send(ctx, c.connectedChan, gobaresip.ConnectedMsg{Connected: false}) {
+				return nil
+			}
+			delay = minReconnectDelay
+		} else if errors.Is(err, gobaresip.ErrNoCtrlConn) {
+			c.logger.WarnPkgf(logPrefix, "Cannot find the 'baresip' control socket... check the s6 'baresip' service logs. Retrying in %s", delay)
+		} else {
+			c.logger.WarnPkgf(logPrefix, "Cannot connect to baresip: %s. Retrying in %s", err, delay)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(delay):
+		}
+		if !wasConnected {
+			delay = min(2*delay, maxReconnectDelay)
+		}
+	}
+}
+
+// forward delivers the messages of the given instance on the channels of the [Connection],
+// till the stop channel gets closed, and returns true if the instance got connected.
+// Once stopped, the events still buffered by the instance are delivered before returning.
+func (c *Connection) forward(ctx context.Context, b *gobaresip.Baresip, stop <-chan struct{}) bool {
+	connected := false
+	events := b.GetEventChan()
+	for {
+		select {
+		case msg := <-b.GetConnectedChan():
+			connected = true
+			if !send(ctx, c.connectedChan, msg) {
+				return connected
+			}
+		case e, ok := <-events:
+			if !ok {
+				// the instance closes its channels only after having been connected
+				return connected
+			}
+			if !send(ctx, c.eventChan, e) {
+				return connected
+			}
+		case <-stop:
+			select {
+			case msg := <-b.GetConnectedChan():
+				connected = true
+				if !send(ctx, c.connectedChan, msg) {
+					return connected
+				}
+			default:
+			}
+			for {
+				select {
+				case e, ok := <-events:
+					if !ok || !send(ctx, c.eventChan, e) {
+						return connected
+					}
+				default:
+					return connected
+				}
+			}
+		}
+	}
+}
+
+func send[T any](ctx context.Context, ch chan<- T, msg T) bool {
+	select {
+	case ch <- msg:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (c *Connection) setCurrent(b *gobaresip.Baresip) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.current = b
+}
+
+func (c *Connection) getCurrent() (*gobaresip.Baresip, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.current == nil {
+		return nil, gobaresip.ErrNoCtrlConn
+	}
+	return c.current, nil
+}
+
+// GetStats returns the statistics of the current connection; they restart from zero on every reconnection
+func (c *Connection) GetStats() gobaresip.BareSipClientStats {
+	b, err := c.getCurrent()
+	if err != nil {
+		return gobaresip.BareSipClientStats{}
+	}
+	return b.GetStats()
+}
+
+func (c *Connection) CmdTxWithAck(cmd gobaresip.CommandMsg) (gobaresip.ResponseMsg, error) {
+	b, err := c.getCurrent()
+	if err != nil {
+		return gobaresip.ResponseMsg{}, err
+	}
+	return b.CmdTxWithAck(cmd)
+}
+
+func (c *Connection) CmdDial(calledsipURI string) (gobaresip.ResponseMsg, error) {
+	b, err := c.getCurrent()
+	if err != nil {
+		return gobaresip.ResponseMsg{}, err
+	}
+	return b.CmdDial(calledsipURI)
+}
+
+func (c *Connection) CmdHangupID(callID string) (gobaresip.ResponseMsg, error) {
+	b, err := c.getCurrent()
+	if err != nil {
+		return gobaresip.ResponseMsg{}, err
+	}
+	return b.CmdHangupID(callID)
+}
+
+func (c *Connection) CmdAccept() (gobaresip.ResponseMsg, error) {
+	b, err := c.getCurrent()
+	if err != nil {
+		return gobaresip.ResponseMsg{}, err
+	}
+	return b.CmdAccept()
+}
+
+func (c *Connection) CmdAusrc(driver, device string) (gobaresip.ResponseMsg, error) {
+	b, err := c.getCurrent()
+	if err != nil {
+		return gobaresip.ResponseMsg{}, err
+	}
+	return b.CmdAusrc(driver, device)
+}
+
+func (c *Connection) CmdUafind(sipURI string) (gobaresip.ResponseMsg, error) {
+	b, err := c.getCurrent()
+	if err != nil {
+		return gobaresip.ResponseMsg{}, err
+	}
+	return b.CmdUafind(sipURI)
+}
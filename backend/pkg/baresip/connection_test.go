@@ -0,0 +1,70 @@
+package baresip
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"voip-client-backend/pkg/logger"
+
+	"github.com/f18m/go-baresip/pkg/gobaresip"
+)
+
+func TestConnectionReconnects(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ln.Close() }()
+
+	c := NewConnection(logger.NewCustomLogger("test"),
+		gobaresip.UseExternalBaresip(),
+		gobaresip.SetCtrlTCPAddr(ln.Addr().String()),
+		gobaresip.SetPingInterval(time.Hour),
+	)
+	go func() { _ = c.Run(t.Context()) }()
+
+	waitConnected := func(want bool) {
+		t.Helper()
+		select {
+		case msg := <-c.GetConnectedChan():
+			if msg.Connected != want {
+				t.Fatalf("got connected %v, want %v", msg.Connected, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no connected message %v received", want)
+		}
+	}
+
+	// the first baresip instance sends an event, then gets restarted
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitConnected(true)
+	event := `{"event":true,"type":"REGISTER_OK","accountaor":"sip:user@example.com"}`
+	if _, err := fmt.Fprintf(conn, "%d:%s,", len(event), event); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+
+	// the event must be delivered before the disconnection
+	select {
+	case e := <-c.GetEventChan():
+		if e.AccountAOR != "sip:user@example.com" {
+			t.Errorf("got event %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("event not delivered")
+	}
+	waitConnected(false)
+
+	// the new baresip instance gets connected as well
+	conn, err = ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+	waitConnected(true)
+}
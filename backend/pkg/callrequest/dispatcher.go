@@ -0,0 +1,179 @@
+// Package callrequest validates the call requests coming from the input adapters (the HTTP server,
+// the addon stdin, the MQTT entities) and hands them to the FSM goroutine, together with the hangup
+// and status requests
+package callrequest
+
+import (
+	"errors"
+	"time"
+
+	"voip-client-backend/pkg/config"
+	"voip-client-backend/pkg/fsm"
+	"voip-client-backend/pkg/logger"
+	"voip-client-backend/pkg/tts"
+
+	"github.com/f18m/go-baresip/pkg/gobaresip"
+)
+
+const logPrefix = "callrequest"
+
+// fsmSubmitTimeout is how long a request waits for the FSM goroutine to take it
+const fsmSubmitTimeout = 5 * time.Second
+
+// ErrFSMBusy is returned when the FSM goroutine does not take a request within fsmSubmitTimeout
+var ErrFSMBusy = errors.New("the VOIP client is busy, retry later")
+
+// DialRequest is the call request built from a validated [DialPayload] and sent to the FSM,
+// together with the channel where the outcome of the submission must be reported back.
+type DialRequest struct {
+	Request fsm.NewCallRequest
+	ReplyCh chan DialReply
+}
+
+// DialReply is the answer to a [DialRequest]
+type DialReply struct {
+	Receipt fsm.CallRequestReceipt
+	Err     error
+}
+
+// HangupRequest asks the FSM goroutine to cancel the calls with the given baresip call ID or
+// the call requests with the given request ID; if both are empty, all calls in progress and
+// all queued call requests are cancelled.
+// The outcome must be sent back on ReplyCh.
+type HangupRequest struct {
+	CallID    string
+	RequestID string
+	ReplyCh   chan HangupReply
+}
+
+// HangupReply is the answer to a [HangupRequest]
+type HangupReply struct {
+	NumCancelled int
+	Err          error
+}
+
+// StatusRequest asks the FSM goroutine for a snapshot of the FSM and baresip connection state;
+// the snapshot must be sent back on ReplyCh.
+type StatusRequest struct {
+	ReplyCh chan StatusReply
+}
+
+// StatusReply is the answer to a [StatusRequest]; Err is set only when the FSM goroutine
+// could not be reached
+type StatusReply struct {
+	FSM     fsm.Status
+	Baresip gobaresip.BareSipClientStats
+	Err     error
+}
+
+// Dispatcher builds the call requests and sends them, as well as the hangup and status requests,
+// to the FSM goroutine; it is shared by all the input adapters
+type Dispatcher struct {
+	logger           *logger.CustomLogger
+	contactLookupMap map[string]fsm.CallContact // Maps contact names to their URIs and TTS options
+
+	// defaults for the escalation chains
+	escalationRetries    int
+	escalationRetryDelay time.Duration
+
+	dialCh   chan DialRequest
+	statusCh chan StatusRequest
+	hangupCh chan HangupRequest
+}
+
+func NewDispatcher(logger *logger.CustomLogger, cfg *config.AddonOptions) *Dispatcher {
+	d := &Dispatcher{
+		logger:               logger,
+		contactLookupMap:     make(map[string]fsm.CallContact),
+		escalationRetries:    cfg.GetEscalationRetries(),
+		escalationRetryDelay: cfg.GetEscalationRetryDelay(),
+		dialCh:               make(chan DialRequest),
+		statusCh:             make(chan StatusRequest),
+		hangupCh:             make(chan HangupRequest),
+	}
+
+	// convert slice to map:
+	for _, contact := range cfg.Contacts {
+		d.contactLookupMap[contact.Name] = fsm.CallContact{Name: contact.Name, URI: contact.URI, TTS: tts.ContactEngineOptions(contact)}
+		d.logger.InfoPkgf(logPrefix, "Contact %s added with URI %s", contact.Name, contact.URI)
+	}
+
+	return d
+}
+
+// SubmitCallRequest hands the given call request to the FSM goroutine and returns whether the FSM
+// accepted, queued or rejected it; if the FSM goroutine does not take the request within
+// fsmSubmitTimeout, [ErrFSMBusy] is returned
+func (d *Dispatcher) SubmitCallRequest(request fsm.NewCallRequest) DialReply {
+	req := DialRequest{
+		Request: request,
+		ReplyCh: make(chan DialReply, 1),
+	}
+	timer := time.NewTimer(fsmSubmitTimeout)
+	defer timer.Stop()
+	select {
+	case d.dialCh <- req:
+	case <-timer.C:
+		return DialReply{Err: ErrFSMBusy}
+	}
+
+	// once taken, the FSM replies at once
+	return <-req.ReplyCh
+}
+
+// Hangup asks the FSM goroutine to cancel the calls and the call requests selected by the given IDs,
+// see [HangupRequest]; if the FSM goroutine does not take the request within fsmSubmitTimeout,
+// [ErrFSMBusy] is returned
+func (d *Dispatcher) Hangup(callID, requestID string) HangupReply {
+	req := HangupRequest{
+		CallID:    callID,
+		RequestID: requestID,
+		ReplyCh:   make(chan HangupReply, 1),
+	}
+	timer := time.NewTimer(fsmSubmitTimeout)
+	defer timer.Stop()
+	select {
+	case d.hangupCh <- req:
+	case <-timer.C:
+		return HangupReply{Err: ErrFSMBusy}
+	}
+
+	// once taken, the FSM replies at once
+	return <-req.ReplyCh
+}
+
+// GetStatus asks the FSM goroutine for a snapshot of its state; if the FSM goroutine does not take
+// the request within fsmSubmitTimeout, [ErrFSMBusy] is returned
+func (d *Dispatcher) GetStatus() StatusReply {
+	req := StatusRequest{
+		ReplyCh: make(chan StatusReply, 1),
+	}
+	timer := time.NewTimer(fsmSubmitTimeout)
+	defer timer.Stop()
+	select {
+	case d.statusCh <- req:
+	case <-timer.C:
+		return StatusReply{Err: ErrFSMBusy}
+	}
+
+	// once taken, the FSM replies at once
+	return <-req.ReplyCh
+}
+
+// GetInputChannel returns the channel where all call requests coming from the input adapters are sent
+// This is used by the FSM to read the requests and process them
+func (d *Dispatcher) GetInputChannel() chan DialRequest {
+	return d.dialCh
+}
+
+// GetStatusChannel returns the channel where all status requests coming from the input adapters are sent
+// This is used by the FSM goroutine to provide a snapshot of its state
+func (d *Dispatcher) GetStatusChannel() chan StatusRequest {
+	return d.statusCh
+}
+
+// GetHangupChannel returns the channel where all requests to cancel calls are sent
+// This is used by the FSM goroutine to hang up calls and remove queued call requests
+func (d *Dispatcher) GetHangupChannel() chan HangupRequest {
+	return d.hangupCh
+}
@@ -0,0 +1,240 @@
+package callrequest
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"voip-client-backend/pkg/fsm"
+	"voip-client-backend/pkg/tts"
+)
+
+// maxSilenceDuration limits the pauses that can be requested around the message
+const maxSilenceDuration = time.Minute
+
+var calledNumberRegex = regexp.MustCompile(`^sip:[^@]+@[^@]+\.[^@]+$`)
+
+// DialPayload is a call request as accepted by the HTTP dial endpoint, by the dial command read from stdin
+// and, limited to the contact and the message, by the MQTT entities
+type DialPayload struct {
+	CalledNumber  string `json:"called_number"`
+	CalledContact string `json:"called_contact"`
+	// CalledNumbers and CalledContacts allow to call several recipients in parallel
+	CalledNumbers  []string `json:"called_numbers"`
+	CalledContacts []string `json:"called_contacts"`
+	MessageTTS     string   `json:"message_tts"`
+	// AudioFile and AudioURL are alternatives to MessageTTS, to play a pre-recorded audio file
+	AudioFile string `json:"audio_file"`
+	AudioURL  string `json:"audio_url"`
+	// TTSPlatform, Language, Voice and Options select how MessageTTS is spoken; they override
+	// the ones configured for the contact, if any
+	TTSPlatform string             `json:"tts_platform"`
+	Language    string             `json:"language"`
+	Voice       string             `json:"voice"`
+	Options     map[string]any     `json:"options"`
+	DTMFMenu    string             `json:"dtmf_menu"`
+	Escalation  *EscalationPayload `json:"escalation"`
+	MaxDuration string             `json:"max_duration"`
+	// Repeat is the number of times the message is played; -1 means till the end of the call
+	Repeat        int    `json:"repeat"`
+	PauseBetween  string `json:"pause_between"`
+	LeadInSilence string `json:"lead_in_silence"`
+	// ExpiresIn is how long the request can wait in the call queue; empty means call_queue.max_age
+	ExpiresIn string `json:"expires_in"`
+	// Account is the name or AOR of the SIP account to dial from; empty means the default account
+	Account string `json:"account"`
+}
+
+// engineOptions returns the TTS options requested by the payload
+func (p *DialPayload) engineOptions() tts.EngineOptions {
+	return tts.EngineOptions{
+		Platform: p.TTSPlatform,
+		Language: p.Language,
+		Voice:    p.Voice,
+		Options:  p.Options,
+	}
+}
+
+// EscalationPayload asks to call the given contacts in turn, until one of them acknowledges
+// the call using the DTMF menu
+type EscalationPayload struct {
+	Contacts   []string `json:"contacts"`
+	Retries    *int     `json:"retries"`
+	RetryDelay string   `json:"retry_delay"`
+}
+
+// BuildCallRequest validates the given payload and converts it into a call request for the FSM;
+// contact names are resolved into their URIs.
+func (d *Dispatcher) BuildCallRequest(payload DialPayload) (fsm.NewCallRequest, error) {
+	multipleRecipients := len(payload.CalledNumbers) > 0 || len(payload.CalledContacts) > 0
+	if multipleRecipients {
+		if payload.CalledNumber != "" || payload.CalledContact != "" || payload.Escalation != nil {
+			return fsm.NewCallRequest{}, errors.New("called_numbers and called_contacts cannot be used together with called_number, called_contact or escalation")
+		}
+	} else if payload.Escalation != nil {
+		if payload.CalledNumber != "" || payload.CalledContact != "" {
+			return fsm.NewCallRequest{}, errors.New("called_number and called_contact cannot be used together with escalation")
+		}
+	} else if payload.CalledNumber == "" && payload.CalledContact == "" {
+		return fsm.NewCallRequest{}, errors.New("called_number or called_contact is required")
+	}
+	if payload.CalledNumber != "" && payload.CalledContact != "" {
+		return fsm.NewCallRequest{}, errors.New("only one between called_number and called_contact can be provided")
+	}
+	numAudioSources := 0
+	for _, source := range []string{payload.MessageTTS, payload.AudioFile, payload.AudioURL} {
+		if source != "" {
+			numAudioSources++
+		}
+	}
+	if numAudioSources != 1 {
+		return fsm.NewCallRequest{}, errors.New("exactly one between message_tts, audio_file and audio_url is required")
+	}
+	if payload.AudioFile != "" {
+		if err := tts.ValidateAudioFile(payload.AudioFile); err != nil {
+			return fsm.NewCallRequest{}, err
+		}
+	}
+	if payload.AudioURL != "" {
+		if err := tts.ValidateAudioURL(payload.AudioURL); err != nil {
+			return fsm.NewCallRequest{}, err
+		}
+	}
+
+	var contactTTS tts.EngineOptions
+	if payload.CalledNumber != "" {
+		if !calledNumberRegex.MatchString(payload.CalledNumber) {
+			return fsm.NewCallRequest{}, errors.New("called_number must be in the format sip:<number>@<domain>")
+		}
+	} else if payload.CalledContact != "" {
+		// Check if we know about this contact
+		contact, exists := d.contactLookupMap[payload.CalledContact]
+		if !exists {
+			return fsm.NewCallRequest{}, fmt.Errorf("unknown contact: %s", payload.CalledContact)
+		}
+
+		payload.CalledNumber = contact.URI // Use the contact URI as the CalledNumber
+		contactTTS = contact.TTS
+		d.logger.InfoPkgf(logPrefix, "Using contact URI %s for CalledContact %s", payload.CalledNumber, payload.CalledContact)
+	}
+
+	newCallRequest := fsm.NewCallRequest{
+		CalledNumber:  payload.CalledNumber,
+		CalledContact: payload.CalledContact,
+		MessageTTS:    payload.MessageTTS,
+		AudioFile:     payload.AudioFile,
+		AudioURL:      payload.AudioURL,
+		TTS:           payload.engineOptions().WithDefaults(contactTTS),
+		DTMFMenu:      payload.DTMFMenu,
+		Account:       payload.Account,
+	}
+	if multipleRecipients {
+		recipients, err := d.buildRecipients(payload.CalledNumbers, payload.CalledContacts)
+		if err != nil {
+			return fsm.NewCallRequest{}, err
+		}
+		if len(recipients) == 1 {
+			// no need to handle this as a group of calls
+			newCallRequest.CalledNumber = recipients[0].URI
+			newCallRequest.CalledContact = recipients[0].Name
+			newCallRequest.TTS = newCallRequest.TTS.WithDefaults(recipients[0].TTS)
+		} else {
+			newCallRequest.Recipients = recipients
+		}
+	}
+	if payload.MaxDuration != "" {
+		d, err := time.ParseDuration(payload.MaxDuration)
+		if err != nil || d <= 0 {
+			return fsm.NewCallRequest{}, fmt.Errorf("invalid max_duration: %s", payload.MaxDuration)
+		}
+		newCallRequest.MaxDuration = d
+	}
+	if payload.Repeat < -1 {
+		return fsm.NewCallRequest{}, fmt.Errorf("invalid repeat: %d (use -1 to repeat the message till the end of the call)", payload.Repeat)
+	}
+	newCallRequest.Repeat = payload.Repeat
+	if payload.PauseBetween != "" {
+		d, err := time.ParseDuration(payload.PauseBetween)
+		if err != nil || d < 0 || d > maxSilenceDuration {
+			return fsm.NewCallRequest{}, fmt.Errorf("invalid pause_between: %s (max %s)", payload.PauseBetween, maxSilenceDuration)
+		}
+		newCallRequest.PauseBetween = d
+	}
+	if payload.LeadInSilence != "" {
+		d, err := time.ParseDuration(payload.LeadInSilence)
+		if err != nil || d < 0 || d > maxSilenceDuration {
+			return fsm.NewCallRequest{}, fmt.Errorf("invalid lead_in_silence: %s (max %s)", payload.LeadInSilence, maxSilenceDuration)
+		}
+		newCallRequest.LeadInSilence = d
+	}
+	if payload.ExpiresIn != "" {
+		expiresIn, err := time.ParseDuration(payload.ExpiresIn)
+		if err != nil || expiresIn <= 0 {
+			return fsm.NewCallRequest{}, fmt.Errorf("invalid expires_in: %s", payload.ExpiresIn)
+		}
+		newCallRequest.ExpiresAt = time.Now().Add(expiresIn)
+	}
+	if payload.Escalation != nil {
+		chain, err := d.buildEscalationChain(payload.Escalation)
+		if err != nil {
+			return fsm.NewCallRequest{}, err
+		}
+		newCallRequest.Escalation = chain
+	}
+	return newCallRequest, nil
+}
+
+// buildRecipients validates the lists of numbers and contacts to call in parallel and resolves the contact names
+func (d *Dispatcher) buildRecipients(numbers, contacts []string) ([]fsm.CallContact, error) {
+	var recipients []fsm.CallContact
+	for _, number := range numbers {
+		if !calledNumberRegex.MatchString(number) {
+			return nil, fmt.Errorf("CalledNumbers must be in the format sip:<number>@<domain>, found: %s", number)
+		}
+		recipients = append(recipients, fsm.CallContact{URI: number})
+	}
+	for _, name := range contacts {
+		contact, exists := d.contactLookupMap[name]
+		if !exists {
+			return nil, fmt.Errorf("unknown contact: %s", name)
+		}
+		recipients = append(recipients, contact)
+	}
+	return recipients, nil
+}
+
+// buildEscalationChain validates the escalation payload and resolves the contact names
+func (d *Dispatcher) buildEscalationChain(p *EscalationPayload) (*fsm.EscalationChain, error) {
+	if len(p.Contacts) == 0 {
+		return nil, fmt.Errorf("escalation requires at least one contact")
+	}
+
+	chain := &fsm.EscalationChain{
+		Retries:    d.escalationRetries,
+		RetryDelay: d.escalationRetryDelay,
+	}
+	for _, name := range p.Contacts {
+		contact, exists := d.contactLookupMap[name]
+		if !exists {
+			return nil, fmt.Errorf("unknown contact in escalation: %s", name)
+		}
+		chain.Contacts = append(chain.Contacts, contact)
+	}
+
+	if p.Retries != nil {
+		if *p.Retries < 0 {
+			return nil, fmt.Errorf("escalation retries cannot be negative")
+		}
+		chain.Retries = *p.Retries
+	}
+	if p.RetryDelay != "" {
+		d, err := time.ParseDuration(p.RetryDelay)
+		if err != nil {
+			return nil, fmt.Errorf("invalid escalation retry_delay: %w", err)
+		}
+		chain.RetryDelay = d
+	}
+
+	return chain, nil
+}
@@ -2,28 +2,97 @@ package config
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
 	"os"
 	"time"
 )
 
+// AddonVoipProvider provides the SIP account used to register against a VOIP provider
+type AddonVoipProvider struct {
+	Name     string `json:"name"`
+	Account  string `json:"account"`
+	Password string `json:"password"` // #nosec G117 -- this maps Home Assistant add-on options; value is runtime-provided, not hardcoded
+}
+
 // AddonContact provides the contact information for a user
 type AddonContact struct {
 	Name string `json:"name"`
 	URI  string `json:"uri"`
+
+	// TTS engine, language and voice used for the messages sent to this contact; empty
+	// values use the defaults
+	TTSPlatform string `json:"tts_platform"`
+	Language    string `json:"language"`
+	Voice       string `json:"voice"`
+	// Options is a JSON object with further options for the TTS engine
+	Options string `json:"options"`
+}
+
+// GetTTSOptions parses the TTS engine options of the contact
+func (c *AddonContact) GetTTSOptions() (map[string]any, error) {
+	options := map[string]any{}
+	if c.Options == "" {
+		return options, nil
+	}
+
+	if err := json.Unmarshal([]byte(c.Options), &options); err != nil {
+		return nil, fmt.Errorf("invalid options for contact [%s], a JSON object is expected: %w", c.Name, err)
+	}
+	return options, nil
+}
+
+// AddonIncomingCallRule describes how to handle incoming calls whose caller URI
+// matches the given regular expression
+type AddonIncomingCallRule struct {
+	Caller     string `json:"caller"`
+	Action     string `json:"action"`
+	MessageTTS string `json:"message_tts"`
+	AudioFile  string `json:"audio_file"`
+}
+
+// AddonDTMFMenuOption describes what happens when the called party presses a DTMF digit
+type AddonDTMFMenuOption struct {
+	Digit    string `json:"digit"`
+	Action   string `json:"action"`
+	NextMenu string `json:"next_menu"`
+}
+
+// AddonDTMFMenu describes a node of a DTMF menu tree
+type AddonDTMFMenu struct {
+	Name      string                `json:"name"`
+	PromptTTS string                `json:"prompt_tts"`
+	Options   []AddonDTMFMenuOption `json:"options"`
 }
 
 // AddonOptions contains the configuration provided by the user to the Home Assistant addon
 // in the HomeAssistant YAML editor
 type AddonOptions struct {
-	VoipProvider struct {
-		Name     string `json:"name"`
-		Account  string `json:"account"`
-		Password string `json:"password"` // #nosec G117 -- this maps Home Assistant add-on options; value is runtime-provided, not hardcoded
-	} `json:"voip_provider"`
+	VoipProvider AddonVoipProvider `json:"voip_provider"`
+
+	// AdditionalVoipProviders are registered together with VoipProvider
+	AdditionalVoipProviders []AddonVoipProvider `json:"additional_voip_providers"`
+
+	// VoipFailover enables dialing from another registered account when the chosen one is not registered
+	VoipFailover *bool `json:"voip_failover"`
+
+	// Registration configures how the registration of the SIP accounts is supervised
+	Registration struct {
+		Timeout       string `json:"timeout"`
+		Interval      string `json:"interval"`
+		RetryDelay    string `json:"retry_delay"`
+		RetryMaxDelay string `json:"retry_max_delay"`
+		NotifyAfter   string `json:"notify_after"`
+	} `json:"registration"`
 
 	TTSEngine struct {
-		Platform string `json:"platform"`
+		Platform       string `json:"platform"`
+		CacheMaxSizeMB int    `json:"cache_max_size_mb"`
+		CacheMaxAge    string `json:"cache_max_age"`
+		// Prewarm lists the messages to convert into speech at startup
+		Prewarm []string `json:"prewarm"`
+		// Workers is the number of TTS conversions that can run in parallel
+		Workers int `json:"workers"`
 	} `json:"tts_engine"`
 
 	Contacts []AddonContact `json:"contacts"`
@@ -37,8 +106,44 @@ type AddonOptions struct {
 	} `json:"http_rest_server"`
 
 	VoiceCalls struct {
-		MaxDuration string `json:"max_duration"`
+		MaxDuration        string `json:"max_duration"`
+		LongMessage        string `json:"long_message"`
+		MaxConcurrentCalls int    `json:"max_concurrent_calls"`
+		// DialFirst makes the calls ring while the TTS engine is still running
+		DialFirst bool `json:"dial_first"`
+		// FallbackAudioFile is played, in dial-first mode, if the TTS engine fails
+		FallbackAudioFile string `json:"fallback_audio_file"`
 	} `json:"voice_calls"`
+
+	IncomingCalls struct {
+		DefaultAction string                  `json:"default_action"`
+		Rules         []AddonIncomingCallRule `json:"rules"`
+	} `json:"incoming_calls"`
+
+	DTMFMenus []AddonDTMFMenu `json:"dtmf_menus"`
+
+	Escalation struct {
+		Retries    int    `json:"retries"`
+		RetryDelay string `json:"retry_delay"`
+	} `json:"escalation"`
+
+	CallQueue struct {
+		MaxDepth int    `json:"max_depth"`
+		MaxAge   string `json:"max_age"`
+	} `json:"call_queue"`
+
+	MQTT struct {
+		Enabled bool `json:"enabled"`
+		// Broker is in the format host:port; if empty, the MQTT service provided by the Supervisor is used
+		Broker          string `json:"broker"`
+		Username        string `json:"username"`
+		Password        string `json:"password"` // #nosec G117 -- this maps Home Assistant add-on options; value is runtime-provided, not hardcoded
+		DiscoveryPrefix string `json:"discovery_prefix"`
+		TopicPrefix     string `json:"topic_prefix"`
+		// DialContact is the contact called by the button and notify entities
+		DialContact   string `json:"dial_contact"`
+		ButtonMessage string `json:"button_message"`
+	} `json:"mqtt"`
 }
 
 // readAddonOptions reads the OPTIONS of this Home Assistant addon
@@ -67,6 +172,67 @@ func ReadAddonOptions() (*AddonOptions, error) {
 	return &o, nil
 }
 
+// GetVoipProviders returns all the configured SIP accounts; the first one is the default one
+func (o *AddonOptions) GetVoipProviders() []AddonVoipProvider {
+	var providers []AddonVoipProvider
+	if o.VoipProvider.Account != "" {
+		providers = append(providers, o.VoipProvider)
+	}
+	for _, p := range o.AdditionalVoipProviders {
+		if p.Account != "" {
+			providers = append(providers, p)
+		}
+	}
+	return providers
+}
+
+func (o *AddonOptions) GetVoipFailover() bool {
+	if o.VoipFailover == nil {
+		return true // default value
+	}
+
+	return *o.VoipFailover
+}
+
+// parseDurationOrDefault parses a duration option, e.g. "30s" or "10m", returning the default
+// value if the option is empty or invalid; "0" is accepted and disables the related feature
+func parseDurationOrDefault(option string, defaultValue time.Duration) time.Duration {
+	if option == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(option)
+	if err != nil || d < 0 {
+		return defaultValue
+	}
+	return d
+}
+
+// GetRegistrationTimeout returns the max time to wait for the outcome of a registration
+func (o *AddonOptions) GetRegistrationTimeout() time.Duration {
+	return parseDurationOrDefault(o.Registration.Timeout, 30*time.Second)
+}
+
+// GetRegistrationInterval returns the registration interval requested to the registrar
+func (o *AddonOptions) GetRegistrationInterval() time.Duration {
+	return parseDurationOrDefault(o.Registration.Interval, 1*time.Hour)
+}
+
+// GetRegistrationRetryDelay returns the delay before the first retry of a failed registration
+func (o *AddonOptions) GetRegistrationRetryDelay() time.Duration {
+	return parseDurationOrDefault(o.Registration.RetryDelay, 10*time.Second)
+}
+
+// GetRegistrationRetryMaxDelay returns the max delay between two retries of a failed registration
+func (o *AddonOptions) GetRegistrationRetryMaxDelay() time.Duration {
+	return parseDurationOrDefault(o.Registration.RetryMaxDelay, 10*time.Minute)
+}
+
+// GetRegistrationNotifyAfter returns how long a registration can keep failing before a
+// persistent notification is raised in Home Assistant
+func (o *AddonOptions) GetRegistrationNotifyAfter() time.Duration {
+	return parseDurationOrDefault(o.Registration.NotifyAfter, 15*time.Minute)
+}
+
 func (o *AddonOptions) GetStatsInterval() time.Duration {
 	if o.Stats.Interval == "" {
 		return 1 * time.Hour // default value
@@ -81,6 +247,41 @@ func (o *AddonOptions) GetStatsInterval() time.Duration {
 	return d
 }
 
+func (o *AddonOptions) GetTTSCacheDir() string {
+	return defaultTTSCacheDir
+}
+
+// GetTTSCacheMaxSize returns the max size of the TTS cache, in bytes
+func (o *AddonOptions) GetTTSCacheMaxSize() int64 {
+	if o.TTSEngine.CacheMaxSizeMB <= 0 {
+		return 100 << 20 // default value
+	}
+
+	return int64(o.TTSEngine.CacheMaxSizeMB) << 20
+}
+
+// GetTTSWorkers returns the number of TTS conversions that can run in parallel
+func (o *AddonOptions) GetTTSWorkers() int {
+	if o.TTSEngine.Workers <= 0 {
+		return 2 // default value
+	}
+	return o.TTSEngine.Workers
+}
+
+func (o *AddonOptions) GetTTSCacheMaxAge() time.Duration {
+	if o.TTSEngine.CacheMaxAge == "" {
+		return 30 * 24 * time.Hour // default value
+	}
+
+	// parse the interval string, e.g. "48h", "720h", etc.
+	d, err := time.ParseDuration(o.TTSEngine.CacheMaxAge)
+	if err != nil {
+		return 30 * 24 * time.Hour // default value
+	}
+
+	return d
+}
+
 func (o *AddonOptions) GetVoiceCallMaxDuration() time.Duration {
 	if o.VoiceCalls.MaxDuration == "" {
 		return 5 * time.Minute // default value
@@ -94,3 +295,92 @@ func (o *AddonOptions) GetVoiceCallMaxDuration() time.Duration {
 
 	return d
 }
+
+func (o *AddonOptions) GetVoiceCallLongMessage() string {
+	if o.VoiceCalls.LongMessage == "" {
+		return "split" // default value
+	}
+
+	return o.VoiceCalls.LongMessage
+}
+
+func (o *AddonOptions) GetVoiceCallMaxConcurrentCalls() int {
+	if o.VoiceCalls.MaxConcurrentCalls <= 0 {
+		return 1 // default value
+	}
+
+	return o.VoiceCalls.MaxConcurrentCalls
+}
+
+func (o *AddonOptions) GetCallQueueMaxDepth() int {
+	if o.CallQueue.MaxDepth <= 0 {
+		return 5 // default value
+	}
+
+	return o.CallQueue.MaxDepth
+}
+
+func (o *AddonOptions) GetCallQueueMaxAge() time.Duration {
+	if o.CallQueue.MaxAge == "" {
+		return 5 * time.Minute // default value
+	}
+
+	// parse the interval string, e.g. "10s", "1m", etc.
+	d, err := time.ParseDuration(o.CallQueue.MaxAge)
+	if err != nil {
+		return 5 * time.Minute // default value
+	}
+
+	return d
+}
+
+// GetCallQueueFile returns the path of the file used to persist queued call requests
+func (o *AddonOptions) GetCallQueueFile() string {
+	return defaultCallQueueFile
+}
+
+func (o *AddonOptions) GetEscalationRetries() int {
+	if o.Escalation.Retries < 0 {
+		return 0
+	}
+
+	return o.Escalation.Retries
+}
+
+func (o *AddonOptions) GetEscalationRetryDelay() time.Duration {
+	if o.Escalation.RetryDelay == "" {
+		return 30 * time.Second // default value
+	}
+
+	// parse the interval string, e.g. "10s", "1m", etc.
+	d, err := time.ParseDuration(o.Escalation.RetryDelay)
+	if err != nil {
+		return 30 * time.Second // default value
+	}
+
+	return d
+}
+
+func (o *AddonOptions) GetMQTTDiscoveryPrefix() string {
+	if o.MQTT.DiscoveryPrefix == "" {
+		return "homeassistant" // default value
+	}
+
+	return o.MQTT.DiscoveryPrefix
+}
+
+func (o *AddonOptions) GetMQTTTopicPrefix() string {
+	if o.MQTT.TopicPrefix == "" {
+		return "voip_client" // default value
+	}
+
+	return o.MQTT.TopicPrefix
+}
+
+func (o *AddonOptions) GetMQTTButtonMessage() string {
+	if o.MQTT.ButtonMessage == "" {
+		return "This is a test call from Home Assistant" // default value
+	}
+
+	return o.MQTT.ButtonMessage
+}
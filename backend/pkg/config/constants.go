@@ -2,3 +2,9 @@ package config
 
 // the home assistant addon options is fixed and cannot be changed actually:
 var defaultHomeAssistantOptionsFile = "/data/options.json"
+
+// the /data folder is persistent across addon restarts and updates
+var defaultCallQueueFile = "/data/call-queue.json"
+
+// the /share folder is also accessible by the user, to inspect the audio files produced by the TTS engine
+var defaultTTSCacheDir = "/share/voip-client"
@@ -0,0 +1,101 @@
+package fsm
+
+import (
+	"fmt"
+	"time"
+
+	"voip-client-backend/pkg/config"
+)
+
+// sipAccount tracks the registration state of one of the SIP accounts (User Agents) added to baresip
+type sipAccount struct {
+	name     string
+	uri      string // as provided in the configuration, e.g. "<sip:user@example.com;transport=tcp>"
+	password string
+
+	registered bool
+	// time of the last successful or failed registration
+	lastChange time.Time
+
+	// state of the registration supervisor, see [RegistrationPolicy]
+	uaCreated    bool      // the User Agent has been added to baresip
+	attemptTime  time.Time // start of the registration attempt waiting for its outcome, if any
+	nextAttempt  time.Time // time of the next retry, if any is scheduled
+	numFailures  int       // consecutive failures, driving the retry backoff
+	lastError    string    // reason of the last failure
+	registeredAt time.Time // time of the last successful registration (or refresh)
+	failingSince time.Time // time of the first failure since the account was last registered
+	notified     bool      // a persistent notification about the failures has been raised
+}
+
+func (a *sipAccount) String() string {
+	if a.name != "" {
+		return fmt.Sprintf("%s (%s)", a.name, sipAOR(a.uri))
+	}
+	return sipAOR(a.uri)
+}
+
+// matches returns true if the given account name or AOR refers to this account
+func (a *sipAccount) matches(nameOrAOR string) bool {
+	return (a.name != "" && a.name == nameOrAOR) || normalizeSIPURI(a.uri) == normalizeSIPURI(nameOrAOR)
+}
+
+func newSIPAccounts(providers []config.AddonVoipProvider) []*sipAccount {
+	accounts := make([]*sipAccount, 0, len(providers))
+	for _, p := range providers {
+		accounts = append(accounts, &sipAccount{
+			name:     p.Name,
+			uri:      p.Account,
+			password: p.Password,
+		})
+	}
+	return accounts
+}
+
+// findAccount returns the account with the given name or AOR, or nil if not found
+func (fsm *VoipClientFSM) findAccount(nameOrAOR string) *sipAccount {
+	for _, a := range fsm.accounts {
+		if a.matches(nameOrAOR) {
+			return a
+		}
+	}
+	return nil
+}
+
+// numRegisteredAccounts returns how many accounts are currently registered
+func (fsm *VoipClientFSM) numRegisteredAccounts() int {
+	n := 0
+	for _, a := range fsm.accounts {
+		if a.registered {
+			n++
+		}
+	}
+	return n
+}
+
+// chooseAccount returns the account to use to dial the given request: the requested one
+// (or the default one), or the first registered account if failover is enabled and the
+// requested account is not registered. Nil is returned if no suitable account is available.
+func (fsm *VoipClientFSM) chooseAccount(req *NewCallRequest) *sipAccount {
+	var chosen *sipAccount
+	if req.Account != "" {
+		chosen = fsm.findAccount(req.Account)
+	} else if len(fsm.accounts) > 0 {
+		chosen = fsm.accounts[0]
+	}
+	if chosen != nil && chosen.registered {
+		return chosen
+	}
+	if !fsm.accountFailover {
+		return nil
+	}
+
+	for _, a := range fsm.accounts {
+		if a.registered {
+			fsm.logger.WarnPkgf(fsm.getLogPrefix(), "Account [%s] is not registered, failing over to account [%s] for request [%s]",
+				chosen, a, req.ID)
+			return a
+		}
+	}
+	return nil
+}
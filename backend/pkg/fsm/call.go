@@ -0,0 +1,326 @@
+package fsm
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"voip-client-backend/pkg/metrics"
+
+	"github.com/f18m/go-baresip/pkg/gobaresip"
+)
+
+// activeCall holds the state of a single call handled by the [VoipClientFSM].
+// Its state is one of WaitingTTS, WaitForCallEstablishment, WaitForCallCompletion, IncomingRinging, IncomingAnswered.
+type activeCall struct {
+	// the request that originated this call; nil for incoming calls
+	request *NewCallRequest
+
+	// baresip call ID; for outgoing calls it's empty until the CALL_OUTGOING event is received
+	id      string
+	peerURI string
+	// display name of the caller, for incoming calls
+	peerDisplayName string
+	state           FSMState
+	// the account used to dial an outgoing call
+	account *sipAccount
+
+	// the job of the TTS workers preparing the audio files, while in the WaitingTTS state or,
+	// in dial-first mode, while audioPending is set
+	ttsJobID      uint64
+	audioPending  bool
+	audioFallback bool // the message could not be prepared and the fallback file is played instead
+	audioFile     string
+	// audioFiles are all the audio files of the call acquired from the TTS cache, see [TTSResult]
+	audioFiles    []string
+	audioDuration time.Duration
+	maxDuration   time.Duration
+	// talkDuration, when set, replaces maxDuration once the call has been established
+	talkDuration time.Duration
+	startTime    time.Time // reset when the call gets established, used for the timeout
+	abortTime    time.Time
+
+	tracker callTracker
+
+	// playback state variables
+	leadInFile      string // silence played before the message, if any
+	pauseFile       string // silence played between the repetitions of the message, if any
+	playingSilence  bool
+	playingHoldTone bool
+	playbacks       int // number of times the message has been played till its end
+
+	// DTMF menu state variables
+	menuNode          *DTMFMenuNode
+	menuPromptFiles   map[string]string // audio files for all menu prompts, indexed by menu name
+	playingMenuPrompt bool
+	collectedDigits   string
+	acknowledged      bool
+}
+
+// String returns a short description of the call, for logging
+func (c *activeCall) String() string {
+	if c.request != nil {
+		return fmt.Sprintf("call [%s] request [%s]", c.id, c.request.ID)
+	}
+	return fmt.Sprintf("call [%s]", c.id)
+}
+
+// matches returns true if the call has the given baresip call ID or was originated by the given
+// request, group or escalation chain; empty IDs match any call
+func (c *activeCall) matches(callID, requestID string) bool {
+	if callID != "" && c.id != callID {
+		return false
+	}
+	if requestID == "" {
+		return true
+	}
+	return c.request != nil && c.request.matchesID(requestID)
+}
+
+// sipAOR strips angle brackets and URI parameters, e.g. "<sip:bob@example.com;transport=tcp>"
+// becomes "sip:bob@example.com"
+func sipAOR(uri string) string {
+	uri = strings.TrimSpace(uri)
+	uri = strings.TrimPrefix(uri, "<")
+	uri = strings.TrimSuffix(uri, ">")
+	uri, _, _ = strings.Cut(uri, ";")
+	return uri
+}
+
+// normalizeSIPURI returns a form of the given URI suitable for comparisons
+func normalizeSIPURI(uri string) string {
+	return strings.ToLower(sipAOR(uri))
+}
+
+func (fsm *VoipClientFSM) getCallLogPrefix(call *activeCall) string {
+	return fmt.Sprintf("fsm [%s] [%s]", fsm.currentState.String(), call.String())
+}
+
+// numActiveCalls returns the number of calls in progress, including the ones just dialed and
+// the ones waiting for their audio files
+func (fsm *VoipClientFSM) numActiveCalls() int {
+	return len(fsm.calls) + len(fsm.pendingDials) + len(fsm.preparingCalls)
+}
+
+// canStartCall returns true if the FSM can start a new call now
+func (fsm *VoipClientFSM) canStartCall() bool {
+	return (fsm.currentState == WaitingInputs || fsm.currentState == CallsInProgress) &&
+		fsm.numActiveCalls() < fsm.maxConcurrentCalls
+}
+
+// freeCallSlots returns how many calls can be started now, taking into account the requests
+// already waiting in the queue, which are served first
+func (fsm *VoipClientFSM) freeCallSlots() int {
+	if !fsm.canStartCall() {
+		return 0
+	}
+	return max(0, fsm.maxConcurrentCalls-fsm.numActiveCalls()-fsm.callQueue.Len())
+}
+
+// findCall returns the call an event refers to, or nil if the event is about an unknown call
+func (fsm *VoipClientFSM) findCall(event gobaresip.EventMsg) *activeCall {
+	if event.ID == "" {
+		return nil
+	}
+	return fsm.calls[event.ID]
+}
+
+// bindPendingDial binds the baresip call ID of a CALL_OUTGOING event to one of the calls that
+// were dialed but whose call ID is not known yet, and returns such call.
+// The oldest pending dial towards the same peer is preferred, otherwise the oldest one is used.
+func (fsm *VoipClientFSM) bindPendingDial(event gobaresip.EventMsg) *activeCall {
+	if event.ID == "" || len(fsm.pendingDials) == 0 {
+		return nil
+	}
+
+	idx := 0
+	for i, call := range fsm.pendingDials {
+		if normalizeSIPURI(call.request.CalledNumber) == normalizeSIPURI(event.PeerURI) {
+			idx = i
+			break
+		}
+	}
+	call := fsm.pendingDials[idx]
+	fsm.pendingDials = append(fsm.pendingDials[:idx], fsm.pendingDials[idx+1:]...)
+	call.id = event.ID
+	call.peerURI = event.PeerURI
+	fsm.calls[call.id] = call
+	return call
+}
+
+// removeCall forgets about the given call
+func (fsm *VoipClientFSM) removeCall(call *activeCall) {
+	if call.id != "" {
+		delete(fsm.calls, call.id)
+	}
+	if fsm.audioSourceCall == call {
+		fsm.audioSourceCall = nil
+	}
+	fsm.pendingDials = slices.DeleteFunc(fsm.pendingDials, func(c *activeCall) bool { return c == call })
+	fsm.preparingCalls = slices.DeleteFunc(fsm.preparingCalls, func(c *activeCall) bool { return c == call })
+}
+
+// allCalls returns a snapshot of all calls in progress
+func (fsm *VoipClientFSM) allCalls() []*activeCall {
+	result := make([]*activeCall, 0, fsm.numActiveCalls())
+	result = append(result, fsm.preparingCalls...)
+	result = append(result, fsm.pendingDials...)
+	for _, call := range fsm.calls {
+		result = append(result, call)
+	}
+	return result
+}
+
+// callTransitionTo changes the state of a single call
+func (fsm *VoipClientFSM) callTransitionTo(call *activeCall, state FSMState) {
+	fsm.logger.InfoPkgf(fsm.getCallLogPrefix(call), "Transitioning call from state %s to %s",
+		call.state.String(), state.String())
+	call.state = state
+
+	change := StateChange{
+		State: state,
+	}
+	if call.request != nil {
+		change.RequestID = call.request.ID
+	}
+	fsm.stateChangesPubCh.Submit(change)
+}
+
+// selectCall makes the given call the "current" one inside baresip, which is required by
+// commands that do not accept a call ID, like "ausrc" and "accept"
+func (fsm *VoipClientFSM) selectCall(call *activeCall) {
+	if call.id == "" {
+		return
+	}
+	// NOTE: even with a single call in fsm.calls, baresip might have made current another call,
+	//       e.g. a call just dialed or an ignored incoming call, so always select the call explicitly
+	_, err := fsm.baresipHandle.CmdTxWithAck(gobaresip.CommandMsg{
+		Command: "callfind",
+		Params:  call.id,
+	})
+	if err != nil {
+		fsm.logger.InfoPkgf(fsm.getCallLogPrefix(call), "Error selecting the call: %s", err)
+	}
+}
+
+// playAudioFile replaces the audio source of the given call with the given WAV file
+func (fsm *VoipClientFSM) playAudioFile(call *activeCall, path string) error {
+	fsm.selectCall(call)
+	_, err := fsm.baresipHandle.CmdAusrc("aufile", path)
+	if err != nil {
+		fsm.logger.InfoPkgf(fsm.getCallLogPrefix(call), "Error setting audio source to the file [%s]: %s", path, err)
+		return err
+	}
+	// END_OF_FILE events do not carry the call ID: remember which call is playing the file
+	fsm.audioSourceCall = call
+	return nil
+}
+
+// startPlayback starts playing the lead-in silence, if any, or directly the message of the call
+func (fsm *VoipClientFSM) startPlayback(call *activeCall) error {
+	if call.leadInFile != "" {
+		call.playingSilence = true
+		return fsm.playAudioFile(call, call.leadInFile)
+	}
+	return fsm.playAudioFile(call, call.audioFile)
+}
+
+// repeatMessage starts playing again the message of the call, after the pause if any; it returns
+// false if the message has already been played the requested number of times
+func (fsm *VoipClientFSM) repeatMessage(call *activeCall) bool {
+	repeat := 1
+	if call.request != nil {
+		repeat = call.request.repetitions()
+	}
+	if repeat > 0 && call.playbacks >= repeat {
+		return false
+	}
+
+	fsm.logger.InfoPkgf(fsm.getCallLogPrefix(call), "The message has been played %d times, playing it again", call.playbacks)
+	if call.pauseFile != "" {
+		call.playingSilence = true
+		_ = fsm.playAudioFile(call, call.pauseFile)
+	} else {
+		_ = fsm.playAudioFile(call, call.audioFile)
+	}
+	return true
+}
+
+// hangupCall asks baresip to close the given call; the call will be completed once the
+// CALL_CLOSED event is received, or when the timeout expires
+func (fsm *VoipClientFSM) hangupCall(call *activeCall) {
+	if call.id == "" {
+		// the call ID is not known yet... the timeout will take care of this call
+		return
+	}
+	_, err := fsm.baresipHandle.CmdHangupID(call.id)
+	if err != nil {
+		fsm.logger.InfoPkgf(fsm.getCallLogPrefix(call), "Error hanging up the call: %s", err)
+	}
+}
+
+// completeCall removes the given call from the FSM and publishes its result
+func (fsm *VoipClientFSM) completeCall(call *activeCall) {
+	fsm.removeCall(call)
+	fsm.updateGlobalState()
+	// the audio files can now be evicted from the cache
+	fsm.ttsWorkers.release(call.audioFiles)
+	call.audioFiles = nil
+
+	if call.request != nil {
+		result := fsm.buildCallResult(call)
+		metrics.CallsCompleted.WithLabelValues(string(result.Outcome), strconv.Itoa(result.SIPCode)).Inc()
+		eventType := haEventCallFinished
+		if result.Outcome != OutcomeAnswered {
+			eventType = haEventCallFailed
+		}
+		fsm.fireCallEvent(eventType, call, map[string]any{
+			"outcome":       string(result.Outcome),
+			"sip_code":      result.SIPCode,
+			"sip_reason":    result.SIPReason,
+			"talk_time_sec": result.TalkTimeSec,
+			"acknowledged":  result.Acknowledged,
+		})
+		fsm.stateChangesPubCh.Submit(StateChange{
+			State:     fsm.currentState,
+			RequestID: call.request.ID,
+			Result:    result,
+		})
+		fsm.onRequestCompleted(*call.request, *result)
+	} else if call.state == IncomingAnswered {
+		fsm.fireCallEvent(haEventCallFinished, call, map[string]any{
+			"outcome":       string(OutcomeAnswered),
+			"talk_time_sec": call.tracker.talkTime().Seconds(),
+		})
+	}
+
+	// a slot for a new call is now available
+	fsm.serveQueuedRequests()
+}
+
+// buildCallResult returns the result of the given call
+func (fsm *VoipClientFSM) buildCallResult(call *activeCall) *CallResult {
+	result := &CallResult{
+		RequestID:        call.request.ID,
+		CallID:           call.id,
+		CalledNumber:     call.request.CalledNumber,
+		CalledContact:    call.request.CalledContact,
+		Outcome:          call.tracker.finalOutcome(),
+		SIPCode:          call.tracker.sipCode,
+		SIPReason:        call.tracker.sipReason,
+		RingTimeSec:      call.tracker.ringTime().Seconds(),
+		TalkTimeSec:      call.tracker.talkTime().Seconds(),
+		AudioCompleted:   call.tracker.audioCompleted,
+		AudioDurationSec: call.audioDuration.Seconds(),
+		AudioFallback:    call.audioFallback,
+		DTMFDigits:       call.collectedDigits,
+		Acknowledged:     call.acknowledged,
+	}
+	if call.account != nil {
+		result.Account = sipAOR(call.account.uri)
+	}
+	fsm.logger.InfoPkgf(fsm.getCallLogPrefix(call), "Call request completed with outcome [%s]: %+v", result.Outcome, *result)
+	return result
+}
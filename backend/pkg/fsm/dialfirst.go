@@ -0,0 +1,52 @@
+package fsm
+
+// EnableDialFirst makes the FSM dial the outgoing calls at once, while the TTS workers prepare their
+// audio files, to cut the time before the phone rings: if the call gets established before the audio
+// is ready, the hold tone is played; if the audio cannot be prepared, the fallback file is played.
+// Both files must be ready to be played.
+func (fsm *VoipClientFSM) EnableDialFirst(holdToneFile, fallbackFile string) {
+	fsm.logger.InfoPkgf(fsm.getLogPrefix(), "Dial-first mode enabled: hold tone [%s], fallback audio file [%s]", holdToneFile, fallbackFile)
+	fsm.dialFirst = true
+	fsm.holdToneFile = holdToneFile
+	fsm.fallbackFile = fallbackFile
+}
+
+// onDialFirstAudioReady handles the result of the TTS job of a call dialed in dial-first mode,
+// which may be ringing or already established
+func (fsm *VoipClientFSM) onDialFirstAudioReady(call *activeCall, result TTSResult) {
+	call.audioPending = false
+
+	if result.Err != nil {
+		fsm.logger.WarnPkgf(fsm.getCallLogPrefix(call), "Error preparing the audio to play: %s. Playing the fallback audio file instead.", result.Err)
+		call.audioFile = fsm.fallbackFile
+		call.audioFallback = true
+		// the prompts of the DTMF menu may be missing as well: the fallback file replaces them,
+		// so that the called party can still acknowledge the call, see playMenuPrompt
+		call.menuPromptFiles = nil
+	} else {
+		call.audioFile = result.AudioFile
+		call.menuPromptFiles = result.MenuPromptFiles
+		call.leadInFile = result.LeadInFile
+		call.pauseFile = result.PauseFile
+
+		if !fsm.checkAudioDuration(call) {
+			// too late to avoid dialing: just hang up
+			call.tracker.outcome = OutcomeMessageTooLong
+			call.playingHoldTone = false
+			fsm.hangupCall(call)
+			return
+		}
+	}
+
+	if call.state != WaitForCallCompletion {
+		// the message will be played once the call gets established
+		return
+	}
+
+	fsm.logger.InfoPkgf(fsm.getCallLogPrefix(call), "The audio file is ready, stopping the hold tone")
+	call.playingHoldTone = false
+	if call.talkDuration > call.maxDuration {
+		call.maxDuration = call.talkDuration
+	}
+	_ = fsm.startPlayback(call)
+}
@@ -0,0 +1,145 @@
+package fsm
+
+import (
+	"fmt"
+
+	"voip-client-backend/pkg/config"
+)
+
+// DTMFAction is what the [VoipClientFSM] does when a DTMF digit is received
+type DTMFAction string
+
+const (
+	// DTMFAcknowledge marks the call as acknowledged by the called party and hangs up
+	DTMFAcknowledge DTMFAction = "ack"
+	// DTMFRepeat plays again the call message and then the menu prompt
+	DTMFRepeat DTMFAction = "repeat"
+	// DTMFMenu moves to another menu node and plays its prompt
+	DTMFMenu DTMFAction = "menu"
+	// DTMFHangup hangs up the call
+	DTMFHangup DTMFAction = "hangup"
+)
+
+// DTMFMenuOption associates an action to a DTMF digit
+type DTMFMenuOption struct {
+	Action DTMFAction
+	// only for DTMFMenu: the name of the menu to move to
+	NextMenu string
+}
+
+// DTMFMenuNode is a node of a DTMF menu tree
+type DTMFMenuNode struct {
+	Name      string
+	PromptTTS string
+	Options   map[string]DTMFMenuOption // indexed by DTMF digit
+}
+
+// DTMFMenus is the set of all DTMF menu nodes, indexed by name.
+// A call request can reference any node as the root of its menu.
+type DTMFMenus struct {
+	nodes map[string]*DTMFMenuNode
+}
+
+func isValidDTMFDigit(d string) bool {
+	if len(d) != 1 {
+		return false
+	}
+	c := d[0]
+	return (c >= '0' && c <= '9') || c == '*' || c == '#' || (c >= 'A' && c <= 'D')
+}
+
+// NewDTMFMenus validates the DTMF menus from the addon configuration.
+func NewDTMFMenus(menus []config.AddonDTMFMenu) (*DTMFMenus, error) {
+	m := &DTMFMenus{
+		nodes: make(map[string]*DTMFMenuNode),
+	}
+
+	for _, menu := range menus {
+		if menu.Name == "" {
+			return nil, fmt.Errorf("DTMF menus must have a non-empty name")
+		}
+		if _, exists := m.nodes[menu.Name]; exists {
+			return nil, fmt.Errorf("duplicated DTMF menu name [%s]", menu.Name)
+		}
+		if menu.PromptTTS == "" {
+			return nil, fmt.Errorf("DTMF menu [%s]: 'prompt_tts' is required", menu.Name)
+		}
+
+		node := &DTMFMenuNode{
+			Name:      menu.Name,
+			PromptTTS: menu.PromptTTS,
+			Options:   make(map[string]DTMFMenuOption),
+		}
+		for _, opt := range menu.Options {
+			if !isValidDTMFDigit(opt.Digit) {
+				return nil, fmt.Errorf("DTMF menu [%s]: invalid digit [%s]", menu.Name, opt.Digit)
+			}
+			action := DTMFAction(opt.Action)
+			switch action {
+			case DTMFAcknowledge, DTMFRepeat, DTMFMenu, DTMFHangup:
+			default:
+				return nil, fmt.Errorf("DTMF menu [%s]: invalid action [%s] for digit [%s]: valid values are 'ack', 'repeat', 'menu' and 'hangup'",
+					menu.Name, opt.Action, opt.Digit)
+			}
+			node.Options[opt.Digit] = DTMFMenuOption{
+				Action:   action,
+				NextMenu: opt.NextMenu,
+			}
+		}
+		m.nodes[menu.Name] = node
+	}
+
+	// check that all references between nodes are valid
+	for _, node := range m.nodes {
+		for digit, opt := range node.Options {
+			if opt.Action != DTMFMenu {
+				continue
+			}
+			if _, exists := m.nodes[opt.NextMenu]; !exists {
+				return nil, fmt.Errorf("DTMF menu [%s]: digit [%s] refers to unknown menu [%s]", node.Name, digit, opt.NextMenu)
+			}
+		}
+	}
+
+	return m, nil
+}
+
+// Get returns the menu node with the given name, or nil if it does not exist
+func (m *DTMFMenus) Get(name string) *DTMFMenuNode {
+	return m.nodes[name]
+}
+
+// Subtree returns the given node and all nodes reachable from it
+func (m *DTMFMenus) Subtree(name string) []*DTMFMenuNode {
+	var result []*DTMFMenuNode
+	visited := make(map[string]bool)
+	toVisit := []string{name}
+	for len(toVisit) > 0 {
+		n := toVisit[0]
+		toVisit = toVisit[1:]
+		node := m.nodes[n]
+		if node == nil || visited[n] {
+			continue
+		}
+		visited[n] = true
+		result = append(result, node)
+		for _, opt := range node.Options {
+			if opt.Action == DTMFMenu {
+				toVisit = append(toVisit, opt.NextMenu)
+			}
+		}
+	}
+	return result
+}
+
+// HasAction returns true if the given action is reachable from the given menu node
+func (m *DTMFMenus) HasAction(name string, action DTMFAction) bool {
+	for _, node := range m.Subtree(name) {
+		for _, opt := range node.Options {
+			if opt.Action == action {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -2,4 +2,14 @@ package fsm
 
 import "errors"
 
-var ErrInvalidState = errors.New("invalid state")
+var (
+	ErrInvalidState      = errors.New("invalid state")
+	ErrQueueFull         = errors.New("call request queue is full")
+	ErrUnknownDTMFMenu   = errors.New("unknown DTMF menu")
+	ErrInvalidEscalation = errors.New("invalid escalation chain")
+	ErrUnknownAccount    = errors.New("unknown SIP account")
+	ErrNoAccounts        = errors.New("no SIP account configured")
+	ErrNoMatchingCall    = errors.New("no matching call or call request")
+	ErrNotConnected      = errors.New("baresip is not connected")
+	ErrNotRegistered     = errors.New("no SIP account is registered")
+)
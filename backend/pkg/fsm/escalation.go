@@ -0,0 +1,168 @@
+package fsm
+
+import (
+	"fmt"
+	"time"
+)
+
+// EscalationChain describes an ordered list of contacts to call in turn, until one of them
+// acknowledges the call using the "ack" action of the DTMF menu of the call request.
+type EscalationChain struct {
+	Contacts []CallContact `json:"contacts"`
+	// Retries is the number of additional rounds over the whole contact list
+	Retries int `json:"retries"`
+	// RetryDelay is the delay between the end of an attempt and the start of the next one
+	RetryDelay time.Duration `json:"retry_delay"`
+}
+
+// escalationState tracks the progress of an [EscalationChain]
+type escalationState struct {
+	// the original request, holding the EscalationChain
+	request NewCallRequest
+	// number of calls placed so far
+	attempts int
+	// when the next call should be placed; zero if a call is queued or in progress
+	nextAttemptAt time.Time
+}
+
+func (e *escalationState) maxAttempts() int {
+	return len(e.request.Escalation.Contacts) * (e.request.Escalation.Retries + 1)
+}
+
+// nextStep returns the call request for the next contact of the chain
+func (e *escalationState) nextStep() NewCallRequest {
+	contact := e.request.Escalation.Contacts[e.attempts%len(e.request.Escalation.Contacts)]
+	return NewCallRequest{
+		ID:            fmt.Sprintf("%s-%d", e.request.ID, e.attempts+1),
+		CalledNumber:  contact.URI,
+		CalledContact: contact.Name,
+		MessageTTS:    e.request.MessageTTS,
+		AudioFile:     e.request.AudioFile,
+		AudioURL:      e.request.AudioURL,
+		TTS:           e.request.TTS.WithDefaults(contact.TTS),
+		DTMFMenu:      e.request.DTMFMenu,
+		Account:       e.request.Account,
+		MaxDuration:   e.request.MaxDuration,
+		Repeat:        e.request.Repeat,
+		PauseBetween:  e.request.PauseBetween,
+		LeadInSilence: e.request.LeadInSilence,
+		CreatedAt:     time.Now(),
+		ExpiresAt:     e.request.ExpiresAt,
+		EscalationID:  e.request.ID,
+	}
+}
+
+// startEscalation validates a request carrying an [EscalationChain] and queues the call
+// to the first contact of the chain
+func (fsm *VoipClientFSM) startEscalation(newRequest NewCallRequest) (CallRequestReceipt, error) {
+	if len(newRequest.Escalation.Contacts) == 0 {
+		fsm.logger.WarnPkgf(fsm.getLogPrefix(), "Cannot accept escalation request [%s]: empty contact list", newRequest.ID)
+		return CallRequestReceipt{}, ErrInvalidEscalation
+	}
+	if newRequest.DTMFMenu == "" || !fsm.dtmfMenus.HasAction(newRequest.DTMFMenu, DTMFAcknowledge) {
+		fsm.logger.WarnPkgf(fsm.getLogPrefix(), "Cannot accept escalation request [%s]: a DTMF menu with an 'ack' option is required", newRequest.ID)
+		return CallRequestReceipt{}, ErrInvalidEscalation
+	}
+
+	e := &escalationState{request: newRequest}
+	step := e.nextStep()
+	_, err := fsm.callQueue.Push(step)
+	if err != nil {
+		fsm.logger.WarnPkgf(fsm.getLogPrefix(), "Cannot accept escalation request [%s]: %s", newRequest.ID, err)
+		return CallRequestReceipt{}, err
+	}
+	e.attempts++
+	fsm.escalations[newRequest.ID] = e
+
+	fsm.logger.InfoPkgf(fsm.getLogPrefix(), "Started escalation [%s] over %d contacts, with %d retries",
+		newRequest.ID, len(newRequest.Escalation.Contacts), newRequest.Escalation.Retries)
+
+	fsm.serveQueuedRequests()
+	return CallRequestReceipt{RequestID: newRequest.ID, QueuePosition: fsm.callQueue.Position(step.ID)}, nil
+}
+
+// onEscalationStepCompleted is invoked when a call belonging to an escalation chain is over
+func (fsm *VoipClientFSM) onEscalationStepCompleted(step NewCallRequest, result CallResult) {
+	e := fsm.escalations[step.EscalationID]
+	if e == nil {
+		// this happens e.g. for steps loaded from the persisted queue after a restart
+		return
+	}
+
+	if result.Acknowledged {
+		fsm.finishEscalation(e, step.CalledContact, result)
+		return
+	}
+	if result.Outcome == OutcomeCancelled || e.attempts >= e.maxAttempts() {
+		fsm.finishEscalation(e, "", result)
+		return
+	}
+
+	e.nextAttemptAt = time.Now().Add(e.request.Escalation.RetryDelay)
+	fsm.logger.InfoPkgf(fsm.getLogPrefix(), "Escalation [%s]: contact [%s] did not acknowledge, next attempt (%d/%d) in %s",
+		e.request.ID, step.CalledContact, e.attempts+1, e.maxAttempts(), e.request.Escalation.RetryDelay.String())
+}
+
+// runDueEscalations queues the next call of all escalation chains whose retry delay expired
+func (fsm *VoipClientFSM) runDueEscalations() {
+	for _, e := range fsm.escalations {
+		if e.nextAttemptAt.IsZero() || time.Now().Before(e.nextAttemptAt) {
+			continue
+		}
+
+		_, err := fsm.callQueue.Push(e.nextStep())
+		if err != nil {
+			// try again at next tick
+			fsm.logger.WarnPkgf(fsm.getLogPrefix(), "Escalation [%s]: cannot queue next attempt: %s", e.request.ID, err)
+			continue
+		}
+		e.attempts++
+		e.nextAttemptAt = time.Time{}
+	}
+
+	fsm.serveQueuedRequests()
+}
+
+// cancelEscalations stops the escalation chains with the given ID (all chains if the ID is empty)
+// which are waiting for their next attempt, and returns how many were stopped; chains with a call
+// queued or in progress are stopped when such call gets cancelled
+func (fsm *VoipClientFSM) cancelEscalations(id string) int {
+	n := 0
+	for _, e := range fsm.escalations {
+		if e.nextAttemptAt.IsZero() || (id != "" && e.request.ID != id) {
+			continue
+		}
+		fsm.finishEscalation(e, "", CallResult{Outcome: OutcomeCancelled})
+		n++
+	}
+	return n
+}
+
+// finishEscalation reports the final outcome of an escalation chain; the result of the chain
+// is the result of its last call
+func (fsm *VoipClientFSM) finishEscalation(e *escalationState, acknowledgedBy string, lastResult CallResult) {
+	delete(fsm.escalations, e.request.ID)
+
+	if acknowledgedBy != "" {
+		fsm.logger.InfoPkgf(fsm.getLogPrefix(), "Escalation [%s] acknowledged by [%s] after %d attempts", e.request.ID, acknowledgedBy, e.attempts)
+	} else if lastResult.Outcome == OutcomeCancelled {
+		fsm.logger.InfoPkgf(fsm.getLogPrefix(), "Escalation [%s] cancelled after %d attempts", e.request.ID, e.attempts)
+	} else {
+		fsm.logger.WarnPkgf(fsm.getLogPrefix(), "Escalation [%s] completed: nobody acknowledged after %d attempts", e.request.ID, e.attempts)
+	}
+
+	result := lastResult
+	result.RequestID = e.request.ID
+	result.AcknowledgedBy = acknowledgedBy
+	fsm.stateChangesPubCh.Submit(StateChange{
+		State:     fsm.currentState,
+		RequestID: e.request.ID,
+		Result:    &result,
+	})
+	fsm.haClient.FireEventAsync("voip_client_escalation_finished", map[string]any{
+		"request_id":      e.request.ID,
+		"acknowledged":    acknowledgedBy != "",
+		"acknowledged_by": acknowledgedBy,
+		"attempts":        e.attempts,
+	})
+}
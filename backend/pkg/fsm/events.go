@@ -0,0 +1,42 @@
+package fsm
+
+import "time"
+
+// Types of the events fired on the Home Assistant event bus during the lifecycle of a call
+const (
+	haEventCallStarted  = "voip_client_call_started"
+	haEventCallAnswered = "voip_client_call_answered"
+	haEventCallFinished = "voip_client_call_finished"
+	haEventCallFailed   = "voip_client_call_failed"
+	haEventCallIncoming = "voip_client_call_incoming"
+	haEventCallDTMF     = "voip_client_dtmf"
+)
+
+// fireCallEvent fires on the Home Assistant event bus an event about the given call;
+// all events carry the same set of fields describing the call, plus the given extra fields
+func (fsm *VoipClientFSM) fireCallEvent(eventType string, call *activeCall, extra map[string]any) {
+	data := map[string]any{
+		"call_id":   call.id,
+		"peer_uri":  call.peerURI,
+		"timestamp": time.Now().Format(time.RFC3339),
+	}
+	if call.request != nil {
+		data["direction"] = "outgoing"
+		data["request_id"] = call.request.ID
+		data["contact"] = call.request.CalledContact
+		if call.peerURI == "" {
+			data["peer_uri"] = call.request.CalledNumber
+		}
+	} else {
+		data["direction"] = "incoming"
+		data["contact"] = call.peerDisplayName
+	}
+	if call.account != nil {
+		data["account"] = sipAOR(call.account.uri)
+	}
+	for k, v := range extra {
+		data[k] = v
+	}
+
+	fsm.haClient.FireEventAsync(eventType, data)
+}
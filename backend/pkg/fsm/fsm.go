@@ -1,10 +1,16 @@
 package fsm
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"time"
 
+	"voip-client-backend/pkg/audio"
+	"voip-client-backend/pkg/config"
+	"voip-client-backend/pkg/homeassistant"
 	"voip-client-backend/pkg/logger"
+	"voip-client-backend/pkg/metrics"
 	"voip-client-backend/pkg/tts"
 
 	"github.com/dustin/go-broadcast"
@@ -19,8 +25,12 @@ const (
 	Uninitialized FSMState = iota + 1
 	WaitingUserAgentRegistration
 	WaitingInputs
+	CallsInProgress
 	WaitForCallEstablishment
 	WaitForCallCompletion
+	IncomingRinging
+	IncomingAnswered
+	WaitingTTS
 )
 
 func (s FSMState) String() string {
@@ -31,53 +41,249 @@ func (s FSMState) String() string {
 		return "WaitingUserAgentRegistration"
 	case WaitingInputs:
 		return "WaitingInputs"
+	case CallsInProgress:
+		return "CallsInProgress"
 	case WaitForCallEstablishment:
 		return "WaitForCallEstablishment"
 	case WaitForCallCompletion:
 		return "WaitForCallCompletion"
+	case IncomingRinging:
+		return "IncomingRinging"
+	case IncomingAnswered:
+		return "IncomingAnswered"
+	case WaitingTTS:
+		return "WaitingTTS"
 	default:
 		return fmt.Sprintf("Unknown FSMState(%d)", s)
 	}
 }
 
+// CallContact is a party that can be called, e.g. one of the contacts of the addon configuration
+type CallContact struct {
+	Name string `json:"name"`
+	URI  string `json:"uri"`
+	// TTS holds the TTS options configured for the contact
+	TTS tts.EngineOptions `json:"tts,omitzero"`
+}
+
 // NewCallRequest is the type to use to request a [VoipClientFSM] to start a new call.
+// ID and CreatedAt are filled by the FSM when the request is received.
+// If Recipients or Escalation are set, CalledNumber is ignored and the recipients or the
+// contacts of the escalation chain are called instead.
 type NewCallRequest struct {
-	CalledNumber string
-	MessageTTS   string
+	ID            string        `json:"id"`
+	CalledNumber  string        `json:"called_number"`
+	CalledContact string        `json:"called_contact,omitempty"`
+	Recipients    []CallContact `json:"recipients,omitempty"`
+	MessageTTS    string        `json:"message_tts,omitempty"`
+	// AudioFile and AudioURL are alternatives to MessageTTS, to play a pre-recorded audio file
+	AudioFile string `json:"audio_file,omitempty"`
+	AudioURL  string `json:"audio_url,omitempty"`
+	// TTS selects the TTS engine, language and voice used for MessageTTS
+	TTS        tts.EngineOptions `json:"tts,omitzero"`
+	DTMFMenu   string            `json:"dtmf_menu,omitempty"`
+	Escalation *EscalationChain  `json:"escalation,omitempty"`
+	// Account is the name or AOR of the SIP account to dial from; empty means the default account
+	Account string `json:"account,omitempty"`
+	// MaxDuration overrides the default max duration of the call, if non-zero
+	MaxDuration time.Duration `json:"max_duration,omitempty"`
+	// Repeat is the number of times the message is played; zero means once and a negative
+	// value means till the end of the call
+	Repeat int `json:"repeat,omitempty"`
+	// PauseBetween is the silence played between two repetitions of the message
+	PauseBetween time.Duration `json:"pause_between,omitempty"`
+	// LeadInSilence is the silence played before the message, once the call gets established
+	LeadInSilence time.Duration `json:"lead_in_silence,omitempty"`
+	CreatedAt     time.Time     `json:"created_at"`
+	// ExpiresAt is the time after which the request, if still queued, is discarded;
+	// if zero, the max age of the call queue applies
+	ExpiresAt time.Time `json:"expires_at,omitzero"`
+
+	// EscalationID is set only on the calls generated by an escalation chain, and
+	// contains the ID of the request holding the chain
+	EscalationID string `json:"escalation_id,omitempty"`
+	// GroupID is set only on the calls generated by a request with multiple recipients, and
+	// contains the ID of such request
+	GroupID string `json:"group_id,omitempty"`
+}
+
+// audioRequest returns the description of the audio to play during the call
+func (r *NewCallRequest) audioRequest() tts.AudioRequest {
+	return tts.AudioRequest{
+		Message: r.MessageTTS,
+		File:    r.AudioFile,
+		URL:     r.AudioURL,
+		Engine:  r.TTS,
+	}
+}
+
+// repetitions returns the number of times the message must be played, or a negative value if
+// the message must be played till the end of the call
+func (r *NewCallRequest) repetitions() int {
+	if r.Repeat == 0 {
+		return 1
+	}
+	return r.Repeat
+}
+
+// matchesID returns true if the request has the given ID or was generated by the group or
+// escalation chain with the given ID; an empty ID matches any request
+func (r *NewCallRequest) matchesID(id string) bool {
+	return id == "" || r.ID == id || r.GroupID == id || r.EscalationID == id
+}
+
+// CallRequestReceipt is returned by [VoipClientFSM.OnNewOutgoingCallRequest] to describe
+// how a new call request has been handled.
+type CallRequestReceipt struct {
+	RequestID string
+	// QueuePosition is 0 if the call has been started immediately, otherwise it's the
+	// 1-based position of the request inside the call queue
+	QueuePosition int
+}
+
+// StateChange is the message published by the [VoipClientFSM] on its broadcaster every time
+// the FSM or one of its calls changes state, or a call request gets completed or discarded.
+type StateChange struct {
+	// State is either the state of the FSM or, when RequestID is set, the state of the call
+	// associated with the request
+	State FSMState
+	// RequestID is the ID of the call request associated with this change, if any
+	RequestID string
+	// Result is non-nil when the request identified by RequestID has been fully processed
+	// (either successfully or not) and no further state changes will be published for it
+	Result *CallResult
+	// IncomingCall is non-nil when an incoming call has just been received; State is then the
+	// state of the FSM
+	IncomingCall *IncomingCall
+}
+
+// IncomingCall describes an incoming call and how it has been handled
+type IncomingCall struct {
+	CallID      string             `json:"call_id"`
+	PeerURI     string             `json:"peer_uri"`
+	DisplayName string             `json:"display_name"`
+	Account     string             `json:"account"`
+	Action      IncomingCallAction `json:"action"`
+	Time        time.Time          `json:"timestamp"`
+}
+
+// BaresipHandle is the subset of the [gobaresip.Baresip] commands used by the [VoipClientFSM]
+type BaresipHandle interface {
+	CmdTxWithAck(cmd gobaresip.CommandMsg) (gobaresip.ResponseMsg, error)
+	CmdDial(calledsipURI string) (gobaresip.ResponseMsg, error)
+	CmdHangupID(callID string) (gobaresip.ResponseMsg, error)
+	CmdAccept() (gobaresip.ResponseMsg, error)
+	CmdAusrc(driver, device string) (gobaresip.ResponseMsg, error)
+	CmdUafind(sipURI string) (gobaresip.ResponseMsg, error)
 }
 
 /*
 VoipClientFSM is the Finite State Machine (FSM) that keeps track of the current state of the VoIP client.
 Note that this type is not thread-safe, so all its methods must be invoked from a single goroutine.
 
-Visit https://www.mermaidchart.com/play and paste the following code to visualize the state machine:
+The FSM has a global state, tracking the registration of the SIP User Agents and whether any call is
+in progress, and keeps a per-call state for each call, indexed by the baresip call ID.
+Up to maxConcurrentCalls calls can be in progress at the same time.
+
+One SIP User Agent is created for each configured account and the registration state of each account
+is tracked separately: the FSM waits for registration only until the first account is registered.
+Each call request can choose the account to dial from; if that account is not registered, the call
+is dialed from the first registered account, unless failover is disabled.
+
+Visit https://www.mermaidchart.com/play and paste the following code to visualize the global state machine:
 
 	flowchart TD
 
 		Uninitialized("**Uninitialized**")
 		WaitingUserAgentRegistration("**WaitingUserAgentRegistration**<br>Add SIP UA to Baresip, which starts registration/auth")
 		WaitingInputs("**WaitingInputs**<br>Waiting for new call requests from HA")
-		WaitForCallEstablishment("**WaitForCallEstablishment**<br>Run the TTS engine to produce a WAV file. Ask baresip to start the call, then wait")
-		WaitForCallCompletion("**WaitForCallCompletion**<br>Ask baresip to reproduce the TTS message")
+		CallsInProgress("**CallsInProgress**<br>At least one call is in progress")
 
 		Uninitialized -- "Baresip TCP socket connected" --> WaitingUserAgentRegistration
-		WaitingUserAgentRegistration -- "Baresip Event: Register OK" --> WaitingInputs
-		WaitingInputs -- "HTTP Call Request from HA" --> WaitForCallEstablishment
-		WaitForCallEstablishment -- "Baresip call ESTABLISHED event" --> WaitForCallCompletion
-		WaitForCallCompletion -- "Baresip call CLOSED event" --> WaitingInputs
-		WaitForCallCompletion -- "Baresip End-of-File event (send hangup command)" --> WaitingInputs
+		WaitingUserAgentRegistration -- "Baresip Event: Register OK (for any account)" --> WaitingInputs
+		WaitingInputs -- "HTTP Call Request from HA, queued request or incoming call" --> CallsInProgress
+		CallsInProgress -- "Last call completed" --> WaitingInputs
+		WaitingUserAgentRegistration -- "Baresip TCP socket disconnected" --> Uninitialized
+		WaitingInputs -- "Baresip TCP socket disconnected" --> Uninitialized
+		CallsInProgress -- "Baresip TCP socket disconnected (calls in progress fail)" --> Uninitialized
 
-	    WaitForCallEstablishment -- "Timeout during establishment" --> WaitingInputs
-	    WaitForCallCompletion -- "Timeout during call" --> WaitingInputs
+and the following code to visualize the state machine of each call:
+
+	flowchart TD
+
+		WaitingTTS("**WaitingTTS**<br>The TTS workers produce the WAV files, without blocking the FSM")
+		WaitForCallEstablishment("**WaitForCallEstablishment**<br>Ask baresip to start the call, then wait")
+		WaitForCallCompletion("**WaitForCallCompletion**<br>Ask baresip to reproduce the TTS message, then the DTMF menu prompt (if any)")
+		IncomingRinging("**IncomingRinging**<br>Ask baresip to answer the call, then wait")
+		IncomingAnswered("**IncomingAnswered**<br>Ask baresip to reproduce the greeting message")
+		Completed("**Completed**<br>The call result is published")
+
+		WaitingTTS -- "TTS completed (outgoing call)" --> WaitForCallEstablishment
+		WaitingTTS -- "Dial-first mode: dial at once, TTS continues in background" --> WaitForCallEstablishment
+		WaitingTTS -- "TTS completed (incoming call)" --> IncomingRinging
+		WaitingTTS -- "TTS failure, hangup request or baresip disconnection" --> Completed
+		WaitForCallEstablishment -- "Baresip call ESTABLISHED event" --> WaitForCallCompletion
+		WaitForCallCompletion -- "Baresip call CLOSED event" --> Completed
+		WaitForCallCompletion -- "Baresip End-of-File event (send hangup command)" --> Completed
+		WaitForCallCompletion -- "Baresip DTMF event (play next menu prompt)" --> WaitForCallCompletion
+
+	    WaitForCallEstablishment -- "Timeout during establishment" --> Completed
+	    WaitForCallCompletion -- "Timeout during call" --> Completed
+
+		IncomingRinging -- "Baresip call ESTABLISHED event" --> IncomingAnswered
+		IncomingRinging -- "Baresip call CLOSED event" --> Completed
+		IncomingAnswered -- "Baresip call CLOSED event" --> Completed
+		IncomingAnswered -- "Baresip End-of-File event (send hangup command)" --> Completed
+
+The audio files of each call are prepared by a [TTSWorkerPool], since the TTS engine can take several
+seconds: the call waits in the WaitingTTS state, holding its slot among the concurrent calls, until the
+result is delivered to [VoipClientFSM.OnTTSCompleted] by the FSM goroutine.
+In dial-first mode, see [VoipClientFSM.EnableDialFirst], outgoing calls are instead dialed at once
+and a hold tone is played if the call gets established before the audio files are ready.
+
+Call requests received while too many calls are in progress are stored in a [CallRequestQueue]
+and are served, in FIFO order, every time a call completes; requests received while no account is
+registered are rejected.
+
+Incoming calls are handled according to the [IncomingCallPolicy]: calls to be rejected or ignored do not
+cause any state transition, and so are calls that arrive while the FSM is busy (these are always rejected,
+unless the policy says to ignore them).
+The caller ID of every incoming call is published to Home Assistant.
+
+Outgoing call requests can reference a [DTMFMenuNode]: in such case, after the message has been played,
+the menu prompt is played and the FSM waits for DTMF digits from the called party, navigating the menu tree.
+The End-of-File event causes the hangup only for calls without a DTMF menu.
+
+Call requests can also carry an [EscalationChain]: the FSM then queues one call per contact, in turn,
+waiting for the configured delay between attempts, until one contact acknowledges using the DTMF menu.
+Call requests with multiple recipients instead queue one call per recipient at once, so that all
+recipients are called in parallel.
 */
 type VoipClientFSM struct {
 	// config
 	maxVoiceCallDuration time.Duration
+	longMessagePolicy    LongMessagePolicy
+	maxConcurrentCalls   int
+	accountFailover      bool
+
+	registration RegistrationPolicy
+
+	// dial-first mode, see [VoipClientFSM.EnableDialFirst]
+	dialFirst    bool
+	holdToneFile string
+	fallbackFile string
+
+	// getAudioDuration returns the duration of an audio file; replaced in tests
+	getAudioDuration func(path string) (time.Duration, error)
 
 	// link to other objects
 	logger        *logger.CustomLogger
-	baresipHandle *gobaresip.Baresip
-	ttsService    *tts.TTSService
+	baresipHandle BaresipHandle
+	ttsWorkers    *TTSWorkerPool
+	callQueue     *CallRequestQueue
+	incomingCalls *IncomingCallPolicy
+	dtmfMenus     *DTMFMenus
+	haClient      *homeassistant.Client
 
 	// state changes channel
 	stateChangesPubCh broadcast.Broadcaster
@@ -86,12 +292,30 @@ type VoipClientFSM struct {
 	currentState FSMState
 
 	// secondary state variables
-	registered             bool
-	numDialCmds            int
-	pendingAudioFileToPlay string
-	currentCallId          string
-	currentCallStartTime   time.Time
-	currentCallAbortTime   time.Time
+	numDialCmds  int
+	servingQueue bool
+	lastTTSJobID uint64
+
+	// SIP accounts, the first one is the default one
+	accounts []*sipAccount
+
+	// calls in progress, indexed by baresip call ID
+	calls map[string]*activeCall
+	// outgoing calls waiting for their audio files, before being dialed
+	preparingCalls []*activeCall
+	// calls that have been dialed but whose baresip call ID is not known yet, oldest first
+	pendingDials []*activeCall
+	// the call whose audio source was set last, i.e. the target of END_OF_FILE events
+	audioSourceCall *activeCall
+
+	// escalation chains in progress, indexed by request ID
+	escalations map[string]*escalationState
+	// requests with multiple recipients in progress, indexed by request ID
+	groups map[string]*callGroup
+
+	// IDs of incoming calls that have been rejected or ignored and whose CALL_CLOSED event
+	// is expected to arrive regardless of the current FSM state
+	ignoredCallIds map[string]bool
 }
 
 /*
@@ -104,18 +328,50 @@ func panicIf(condition bool) {
 
 func NewVoipClientFSM(
 	logger *logger.CustomLogger,
-	baresipHandle *gobaresip.Baresip,
-	ttsService *tts.TTSService,
+	baresipHandle BaresipHandle,
+	ttsWorkers *TTSWorkerPool,
+	callQueue *CallRequestQueue,
+	incomingCalls *IncomingCallPolicy,
+	dtmfMenus *DTMFMenus,
+	haClient *homeassistant.Client,
 	fsmStatePubSub broadcast.Broadcaster,
-	maxVoiceCallDuration time.Duration) *VoipClientFSM {
-	return &VoipClientFSM{
+	accounts []config.AddonVoipProvider,
+	accountFailover bool,
+	maxVoiceCallDuration time.Duration,
+	longMessagePolicy LongMessagePolicy,
+	maxConcurrentCalls int) *VoipClientFSM {
+	fsm := &VoipClientFSM{
 		currentState:         Uninitialized, // initial state
 		logger:               logger,
 		baresipHandle:        baresipHandle,
-		ttsService:           ttsService,
+		ttsWorkers:           ttsWorkers,
+		callQueue:            callQueue,
+		incomingCalls:        incomingCalls,
+		dtmfMenus:            dtmfMenus,
+		haClient:             haClient,
+		accounts:             newSIPAccounts(accounts),
+		accountFailover:      accountFailover,
+		calls:                make(map[string]*activeCall),
+		ignoredCallIds:       make(map[string]bool),
+		escalations:          make(map[string]*escalationState),
+		groups:               make(map[string]*callGroup),
 		maxVoiceCallDuration: maxVoiceCallDuration,
+		longMessagePolicy:    longMessagePolicy,
+		maxConcurrentCalls:   maxConcurrentCalls,
+		getAudioDuration:     audio.Duration,
 		stateChangesPubCh:    fsmStatePubSub,
 	}
+
+	// expose all states and accounts since the beginning
+	for _, state := range []FSMState{Uninitialized, WaitingUserAgentRegistration, WaitingInputs, CallsInProgress} {
+		metrics.FSMState.WithLabelValues(state.String()).Set(0)
+	}
+	metrics.FSMState.WithLabelValues(fsm.currentState.String()).Set(1)
+	for _, account := range fsm.accounts {
+		metrics.SIPRegistered.WithLabelValues(sipAOR(account.uri)).Set(0)
+	}
+
+	return fsm
 }
 
 func (fsm *VoipClientFSM) GetCurrentState() FSMState {
@@ -129,40 +385,64 @@ func (fsm *VoipClientFSM) getLogPrefix() string {
 func (fsm *VoipClientFSM) transitionTo(state FSMState) {
 	fsm.logger.InfoPkgf(fsm.getLogPrefix(), "Transitioning from state %s to %s",
 		fsm.currentState.String(), state.String())
+	metrics.FSMState.WithLabelValues(fsm.currentState.String()).Set(0)
+	metrics.FSMState.WithLabelValues(state.String()).Set(1)
 	fsm.currentState = state
 
-	// ensure invariants for each state are respected:
-	if state == WaitingInputs {
-		fsm.pendingAudioFileToPlay = ""
-		fsm.currentCallId = ""
-		fsm.currentCallStartTime = time.Time{} // empty time
-		fsm.currentCallAbortTime = time.Time{} // empty time
-	}
-
 	// notify listeners, if any
 	// NOTE: compared to a regular go channel, the broadcaster allows multiple subscribers
 	//       and won't block if no one is listening
-	fsm.stateChangesPubCh.Submit(fsm.currentState)
+	fsm.stateChangesPubCh.Submit(StateChange{
+		State: fsm.currentState,
+	})
 }
 
-func (fsm *VoipClientFSM) InitializeUserAgent(sip_uri, password string) error {
-	fsm.logger.InfoPkgf(fsm.getLogPrefix(), "Initializing User Agent [%s]", sip_uri)
+// updateGlobalState moves the FSM between WaitingInputs and CallsInProgress depending on
+// the number of calls in progress
+func (fsm *VoipClientFSM) updateGlobalState() {
+	switch {
+	case fsm.currentState == WaitingInputs && fsm.numActiveCalls() > 0:
+		fsm.transitionTo(CallsInProgress)
+	case fsm.currentState == CallsInProgress && fsm.numActiveCalls() == 0:
+		fsm.transitionTo(WaitingInputs)
+	}
+}
 
+// newRequestID returns a random identifier for a new call request
+func newRequestID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// InitializeUserAgents creates one SIP User Agent for each configured account.
+// The User Agents that cannot be created are retried according to the [RegistrationPolicy].
+func (fsm *VoipClientFSM) InitializeUserAgents() error {
 	if fsm.currentState != Uninitialized {
 		fsm.logger.WarnPkgf(fsm.getLogPrefix(), "FSM is not in the Uninitialized state, current state: %s. Ignoring initialization request.", fsm.currentState)
 		return ErrInvalidState
 	}
+	if len(fsm.accounts) == 0 {
+		fsm.logger.WarnPkgf(fsm.getLogPrefix(), "No SIP account is configured. Please check the 'voip_provider' addon configuration.")
+		return ErrNoAccounts
+	}
 
-	_, err := fsm.baresipHandle.CmdTxWithAck(gobaresip.CommandMsg{
-		Command: "uanew",
-		Params:  fmt.Sprintf("%s;auth_pass=%s", sip_uri, password),
-	})
-	if err != nil {
-		fsm.logger.InfoPkgf(fsm.getLogPrefix(), "Failed to create new SIP User Agent: %s", err)
-		return err
+	var lastErr error
+	numCreated := 0
+	for _, account := range fsm.accounts {
+		if err := fsm.startRegistration(account); err != nil {
+			lastErr = err
+			continue
+		}
+		numCreated++
+	}
+	if numCreated == 0 && fsm.registration.RetryDelay <= 0 {
+		// nothing would ever happen in the next state
+		return lastErr
 	}
+
 	fsm.transitionTo(WaitingUserAgentRegistration)
-	return nil
+	return lastErr
 }
 
 /* -------------------------------------------------------------------------- */
@@ -170,51 +450,53 @@ func (fsm *VoipClientFSM) InitializeUserAgent(sip_uri, password string) error {
 /* -------------------------------------------------------------------------- */
 
 func (fsm *VoipClientFSM) OnTimeoutTicker() {
+	// registrations might need to be retried
+	fsm.superviseRegistrations()
 
-	switch fsm.currentState {
-	case Uninitialized, WaitingUserAgentRegistration, WaitingInputs:
-		// ignore timer... there is no timeout associated to these FSM states
-		return
+	// queued requests might expire in any state
+	fsm.discardRequests(fsm.callQueue.PurgeExpired(), OutcomeExpired)
 
-	case WaitForCallEstablishment, WaitForCallCompletion:
+	// escalation chains might need to call the next contact
+	fsm.runDueEscalations()
+
+	// check if there are any calls that have been in progress for too long
+	for _, call := range fsm.allCalls() {
 		// debug log
-		// fsm.logger.InfoPkgf(fsm.getLogPrefix(), "start call time is %s; max duration is %s", fsm.currentCallStartTime, fsm.maxVoiceCallDuration)
-
-		if !fsm.currentCallStartTime.IsZero() &&
-			time.Since(fsm.currentCallStartTime) > fsm.maxVoiceCallDuration {
-
-			if fsm.currentCallAbortTime.IsZero() {
-
-				// this is the first time we reach the timeout for this call;
-				// * if the current state is "WaitForCallEstablishment", then it means we
-				//   reached timeout for the whole call even before the call becomes established
-				// * if the current state is "WaitForCallCompletion", then it means the call was established
-				//   but the audio file was not finished playing before the timeout expired
-
-				fsm.logger.WarnPkgf(fsm.getLogPrefix(), "Timeout after %s in state [%s]. Call [%s] aborted.",
-					fsm.maxVoiceCallDuration.String(), fsm.currentState.String(), fsm.currentCallId)
-
-				_, err := fsm.baresipHandle.CmdHangupID(fsm.currentCallId)
-				if err != nil {
-					fsm.logger.InfoPkgf(fsm.getLogPrefix(), "Error hanging up the call after timeout: %s", err)
-					// keep going
-				}
-
-				// NOTE: we don't really need to transition to WaitingInputs here:
-				//       Baresip will produce a CALL_CLOSED event which will force the transition
-				//       back to WaitingInputs
-				fsm.currentCallAbortTime = time.Now()
-
-			} else if time.Since(fsm.currentCallAbortTime) > maxCallAbortDuration {
-
-				// an abort attempt was already made for this call... but the FSM has not returned yet into
-				// the WaitingInputs state...
-				// we waited enough time for the call to be aborted, but it seems that Baresip is not
-				// producing the CALL_CLOSED event... the safest thing we can do is to transition back to WaitingInputs
-				fsm.logger.WarnPkgf(fsm.getLogPrefix(), "Timeout after %s in state [%s]. Call [%s] aborted but Baresip did not produce CALL_CLOSED event. Transitioning back to WaitingInputs.",
-					fsm.maxVoiceCallDuration.String(), fsm.currentState.String(), fsm.currentCallId)
-				fsm.transitionTo(WaitingInputs)
+		// fsm.logger.InfoPkgf(fsm.getCallLogPrefix(call), "start call time is %s; max duration is %s", call.startTime, call.maxDuration)
+
+		if call.startTime.IsZero() || time.Since(call.startTime) <= call.maxDuration {
+			continue
+		}
+
+		if call.abortTime.IsZero() {
+
+			// this is the first time we reach the timeout for this call;
+			// * if the call state is "WaitForCallEstablishment", then it means we
+			//   reached timeout for the whole call even before the call becomes established
+			// * if the call state is "WaitForCallCompletion", then it means the call was established
+			//   but the audio file was not finished playing before the timeout expired
+			// * the same applies to "IncomingRinging" and "IncomingAnswered" for incoming calls
+
+			fsm.logger.WarnPkgf(fsm.getCallLogPrefix(call), "Timeout after %s in state [%s]. Call aborted.",
+				call.maxDuration.String(), call.state.String())
+			// an outcome already known, e.g. a cancellation, is more accurate than the timeout
+			if call.tracker.outcome == "" {
+				call.tracker.outcome = OutcomeTimeout
 			}
+
+			// NOTE: we don't really need to complete the call here:
+			//       Baresip will produce a CALL_CLOSED event which will complete it
+			fsm.hangupCall(call)
+			call.abortTime = time.Now()
+
+		} else if time.Since(call.abortTime) > maxCallAbortDuration {
+
+			// an abort attempt was already made for this call... but the call is still in progress...
+			// we waited enough time for the call to be aborted, but it seems that Baresip is not
+			// producing the CALL_CLOSED event... the safest thing we can do is to forget about this call
+			fsm.logger.WarnPkgf(fsm.getCallLogPrefix(call), "Timeout after %s in state [%s]. Call aborted but Baresip did not produce CALL_CLOSED event. Forgetting about this call.",
+				call.maxDuration.String(), call.state.String())
+			fsm.completeCall(call)
 		}
 	}
 }
@@ -223,46 +505,313 @@ func (fsm *VoipClientFSM) OnTimeoutTicker() {
 /*                            HOMEASSISTANT EVENTS                            */
 /* -------------------------------------------------------------------------- */
 
-func (fsm *VoipClientFSM) OnNewOutgoingCallRequest(newRequest NewCallRequest) error {
+func (fsm *VoipClientFSM) OnNewOutgoingCallRequest(newRequest NewCallRequest) (CallRequestReceipt, error) {
+	newRequest.ID = newRequestID()
+	newRequest.CreatedAt = time.Now()
 	fsm.logger.InfoPkgf(fsm.getLogPrefix(), "Received new outgoing call request: %+v", newRequest)
 
-	if fsm.currentState != WaitingInputs {
-		// FIXME: perhaps we might instead abort the current operation and start a new call?
-		fsm.logger.WarnPkgf(fsm.getLogPrefix(), "FSM is not in the WaitingInputs state, current state: %s. Dropping the new call request. Please wait for previous call to get closed.", fsm.currentState)
-		return ErrInvalidState
+	if newRequest.DTMFMenu != "" && fsm.dtmfMenus.Get(newRequest.DTMFMenu) == nil {
+		fsm.logger.WarnPkgf(fsm.getLogPrefix(), "Cannot accept call request [%s]: unknown DTMF menu [%s]", newRequest.ID, newRequest.DTMFMenu)
+		return CallRequestReceipt{}, ErrUnknownDTMFMenu
+	}
+	if newRequest.Account != "" && fsm.findAccount(newRequest.Account) == nil {
+		fsm.logger.WarnPkgf(fsm.getLogPrefix(), "Cannot accept call request [%s]: unknown SIP account [%s]", newRequest.ID, newRequest.Account)
+		return CallRequestReceipt{}, ErrUnknownAccount
 	}
 
-	// ask TTS to generate the WAV file and get its path
-	var err error
-	fsm.pendingAudioFileToPlay, err = fsm.ttsService.GetAudioFile(newRequest.MessageTTS)
+	// requests are queued only while calls are in progress: without a registered account they
+	// would just wait for an unknown time
+	switch fsm.currentState {
+	case Uninitialized:
+		fsm.logger.WarnPkgf(fsm.getLogPrefix(), "Cannot accept call request [%s]: baresip is not connected", newRequest.ID)
+		return CallRequestReceipt{}, ErrNotConnected
+	case WaitingUserAgentRegistration:
+		fsm.logger.WarnPkgf(fsm.getLogPrefix(), "Cannot accept call request [%s]: no SIP account is registered", newRequest.ID)
+		return CallRequestReceipt{}, ErrNotRegistered
+	}
+
+	// free up the queue from requests that waited too long, before checking its depth
+	fsm.discardRequests(fsm.callQueue.PurgeExpired(), OutcomeExpired)
+
+	if newRequest.Escalation != nil {
+		return fsm.startEscalation(newRequest)
+	}
+	if len(newRequest.Recipients) > 0 {
+		return fsm.startGroup(newRequest)
+	}
+
+	_, err := fsm.callQueue.Push(newRequest)
 	if err != nil {
-		fsm.logger.InfoPkgf(fsm.getLogPrefix(), "Error doing the Text-to-Speech conversion: %s", err)
-		fsm.transitionTo(WaitingInputs)
-		return nil
+		fsm.logger.WarnPkgf(fsm.getLogPrefix(), "Cannot accept call request [%s]: %s. Please wait for previous calls to get closed.", newRequest.ID, err)
+		return CallRequestReceipt{}, err
+	}
+
+	fsm.serveQueuedRequests()
+
+	position := fsm.callQueue.Position(newRequest.ID)
+	if position > 0 {
+		fsm.logger.InfoPkgf(fsm.getLogPrefix(), "FSM is busy, call request [%s] has been queued at position %d", newRequest.ID, position)
+	}
+	return CallRequestReceipt{RequestID: newRequest.ID, QueuePosition: position}, nil
+}
+
+// OnHangupRequest cancels the calls and the call requests with the given baresip call ID or
+// request ID, which can also be the ID of a group or escalation chain:
+//   - calls in progress are hung up;
+//   - requests waiting in the queue are removed from it;
+//   - escalation chains waiting for their next attempt are stopped.
+//
+// If both IDs are empty, everything is cancelled. Queued requests have no call ID yet, so
+// they are left untouched when a call ID is given.
+// The result of all cancelled requests has the [OutcomeCancelled] outcome.
+// The number of calls and requests being cancelled is returned.
+func (fsm *VoipClientFSM) OnHangupRequest(callID, requestID string) (int, error) {
+	fsm.logger.InfoPkgf(fsm.getLogPrefix(), "Received hangup request: call ID [%s], request ID [%s]", callID, requestID)
+
+	n := 0
+	var notDialed []*activeCall
+	for _, call := range fsm.allCalls() {
+		if !call.matches(callID, requestID) {
+			continue
+		}
+		fsm.logger.InfoPkgf(fsm.getCallLogPrefix(call), "Hanging up the call on request")
+		// NOTE: calls dialed but without a call ID yet are hung up as soon as their ID is known
+		call.tracker.outcome = OutcomeCancelled
+		if call.state == WaitingTTS && call.request != nil {
+			// not dialed yet: the result of the TTS workers will be ignored
+			notDialed = append(notDialed, call)
+		} else {
+			fsm.hangupCall(call)
+		}
+		n++
+	}
+
+	if callID == "" {
+		removed := fsm.callQueue.Remove(func(req NewCallRequest) bool { return req.matchesID(requestID) })
+		for _, req := range removed {
+			fsm.logger.InfoPkgf(fsm.getLogPrefix(), "Call request [%s] to [%s] removed from the queue on request", req.ID, req.CalledNumber)
+		}
+		n += len(removed)
+		fsm.discardRequests(removed, OutcomeCancelled)
+
+		n += fsm.cancelEscalations(requestID)
+	}
+
+	// complete the calls only now, since this serves the queue
+	for _, call := range notDialed {
+		fsm.completeCall(call)
+	}
+
+	if n == 0 {
+		return 0, ErrNoMatchingCall
+	}
+	return n, nil
+}
+
+// serveQueuedRequests pops requests from the call queue and starts them, as long as
+// the FSM can start new calls
+func (fsm *VoipClientFSM) serveQueuedRequests() {
+	if fsm.servingQueue {
+		// avoid recursion: startCall() may complete calls immediately, e.g. on TTS failures
+		return
+	}
+	fsm.servingQueue = true
+	defer func() { fsm.servingQueue = false }()
+
+	for fsm.canStartCall() {
+		req, expired := fsm.callQueue.Pop()
+		fsm.discardRequests(expired, OutcomeExpired)
+		if req == nil {
+			return
+		}
+
+		fsm.startCall(*req)
+	}
+}
+
+// discardRequests notifies the listeners that the given requests will never be served
+func (fsm *VoipClientFSM) discardRequests(requests []NewCallRequest, outcome CallOutcome) {
+	for _, req := range requests {
+		result := CallResult{
+			RequestID:     req.ID,
+			CalledNumber:  req.CalledNumber,
+			CalledContact: req.CalledContact,
+			Outcome:       outcome,
+		}
+		fsm.stateChangesPubCh.Submit(StateChange{
+			State:     fsm.currentState,
+			RequestID: req.ID,
+			Result:    &result,
+		})
+		fsm.fireCallEvent(haEventCallFailed, &activeCall{request: &req}, map[string]any{
+			"outcome": string(result.Outcome),
+		})
+		fsm.onRequestCompleted(req, result)
+	}
+}
+
+// onRequestCompleted notifies escalation chains and groups about the completion of one of their calls
+func (fsm *VoipClientFSM) onRequestCompleted(req NewCallRequest, result CallResult) {
+	if req.EscalationID != "" {
+		fsm.onEscalationStepCompleted(req, result)
+	}
+	if req.GroupID != "" {
+		fsm.onGroupCallCompleted(req, result)
+	}
+}
+
+func (fsm *VoipClientFSM) startCall(newRequest NewCallRequest) {
+	call := &activeCall{
+		request:     &newRequest,
+		maxDuration: fsm.maxVoiceCallDuration,
+	}
+	if newRequest.MaxDuration > 0 {
+		call.maxDuration = newRequest.MaxDuration
+	}
+	fsm.logger.InfoPkgf(fsm.getCallLogPrefix(call), "Starting call to [%s] %s", newRequest.CalledNumber, newRequest.CalledContact)
+
+	// prepare the audio files in the TTS workers, then dial the call
+	job := ttsJob{
+		audio:         newRequest.audioRequest(),
+		leadInSilence: newRequest.LeadInSilence,
+	}
+	if newRequest.PauseBetween > 0 && newRequest.repetitions() != 1 {
+		job.pauseSilence = newRequest.PauseBetween
+	}
+	if newRequest.DTMFMenu != "" {
+		call.menuNode = fsm.dtmfMenus.Get(newRequest.DTMFMenu)
+		job.menuPrompts = make(map[string]string)
+		for _, node := range fsm.dtmfMenus.Subtree(newRequest.DTMFMenu) {
+			job.menuPrompts[node.Name] = node.PromptTTS
+		}
+	}
+	if !fsm.submitTTSJob(call, job) {
+		call.tracker.outcome = OutcomeTTSFailure
+		fsm.completeCall(call)
+		return
+	}
+	if fsm.dialFirst {
+		// the phone rings while the TTS workers prepare the audio files
+		call.audioPending = true
+		fsm.dialCall(call)
+		return
+	}
+	fsm.preparingCalls = append(fsm.preparingCalls, call)
+	fsm.callTransitionTo(call, WaitingTTS)
+	fsm.updateGlobalState()
+}
+
+// submitTTSJob hands the given job to the TTS workers, on behalf of the given call
+func (fsm *VoipClientFSM) submitTTSJob(call *activeCall, job ttsJob) bool {
+	fsm.lastTTSJobID++
+	job.id = fsm.lastTTSJobID
+	if !fsm.ttsWorkers.submit(job) {
+		fsm.logger.WarnPkgf(fsm.getCallLogPrefix(call), "Too many TTS jobs in progress, cannot prepare the audio files")
+		return false
 	}
+	call.ttsJobID = job.id
+	return true
+}
 
-	// TODO1: detect if it's necessary to convert the audio file using ffmpeg
-	// As of Aug 2025, Google Translate produces WAVs that Baresip can handle, so this is not
-	// strictly necessary... but in future who knows?
+// dialCall dials the given outgoing call, whose audio files are ready
+func (fsm *VoipClientFSM) dialCall(call *activeCall) {
+	newRequest := call.request
 
-	// TODO2: it would be good to check if the DURATION of the audio file is LONGER than
-	// the 	fsm.maxVoiceCallDuration, and if so, warn the user that the call will be aborted
-	// after fsm.maxVoiceCallDuration seconds, even if the audio file is not finished
+	// choose the account to dial from
+	call.account = fsm.chooseAccount(newRequest)
+	if call.account == nil {
+		fsm.logger.InfoPkgf(fsm.getCallLogPrefix(call), "No registered SIP account is available to dial from (requested account: [%s])", newRequest.Account)
+		call.tracker.outcome = OutcomeDialFailure
+		fsm.completeCall(call)
+		return
+	}
+	if len(fsm.accounts) > 1 {
+		// make the chosen account the current one inside baresip, which is used by the dial command
+		_, err := fsm.baresipHandle.CmdUafind(sipAOR(call.account.uri))
+		if err != nil {
+			fsm.logger.InfoPkgf(fsm.getCallLogPrefix(call), "Error selecting the account [%s]: %s", call.account, err)
+			call.tracker.outcome = OutcomeDialFailure
+			fsm.completeCall(call)
+			return
+		}
+	}
 
 	// Dial a new call
 	fsm.numDialCmds++
-	fsm.currentCallStartTime = time.Now()
+	call.startTime = time.Now()
 	_, err2 := fsm.baresipHandle.CmdDial(newRequest.CalledNumber)
 	if err2 != nil {
-		fsm.logger.InfoPkgf(fsm.getLogPrefix(), "Error dialing: %s", err2)
-		fsm.transitionTo(WaitingInputs)
+		fsm.logger.InfoPkgf(fsm.getCallLogPrefix(call), "Error dialing: %s", err2)
+		call.tracker.outcome = OutcomeDialFailure
+		fsm.completeCall(call)
+		return
+	}
+	call.tracker.dialTime = time.Now()
+	metrics.CallAttempts.WithLabelValues(sipAOR(call.account.uri)).Inc()
+	fsm.fireCallEvent(haEventCallStarted, call, nil)
+	fsm.removeCall(call)
+	fsm.pendingDials = append(fsm.pendingDials, call)
+	fsm.callTransitionTo(call, WaitForCallEstablishment)
+	fsm.updateGlobalState()
+
+	fsm.logger.InfoPkgf(fsm.getCallLogPrefix(call), "Dial command sent successfully from account [%s], waiting up to %s for call to be established...",
+		call.account, call.maxDuration.String())
+}
+
+/* -------------------------------------------------------------------------- */
+/*                                 TTS EVENTS                                 */
+/* -------------------------------------------------------------------------- */
+
+// OnTTSCompleted continues the call waiting for the audio files produced by the given TTS job:
+// outgoing calls get dialed and incoming calls get answered
+func (fsm *VoipClientFSM) OnTTSCompleted(result TTSResult) error {
+	var call *activeCall
+	for _, c := range fsm.allCalls() {
+		if (c.state == WaitingTTS || c.audioPending) && c.ttsJobID == result.JobID {
+			call = c
+			break
+		}
+	}
+	if call == nil {
+		fsm.logger.InfoPkgf(fsm.getLogPrefix(), "Received the result of TTS job %d, whose call is not waiting for it anymore. Ignoring it.", result.JobID)
+		fsm.ttsWorkers.release(result.files())
+		return ErrInvalidState
+	}
+	call.audioFiles = result.files()
+	if call.audioPending {
+		fsm.onDialFirstAudioReady(call, result)
 		return nil
 	}
-	fsm.transitionTo(WaitForCallEstablishment)
 
-	fsm.logger.InfoPkgf(fsm.getLogPrefix(), "Dial command sent successfully, waiting up to %s for call to be established...",
-		fsm.maxVoiceCallDuration.String())
+	if result.Err != nil {
+		if call.request == nil {
+			fsm.logger.InfoPkgf(fsm.getCallLogPrefix(call), "Error doing the Text-to-Speech conversion: %s. Rejecting the incoming call.", result.Err)
+			fsm.hangupCall(call)
+			return nil
+		}
+		fsm.logger.InfoPkgf(fsm.getCallLogPrefix(call), "Error preparing the audio to play: %s", result.Err)
+		call.tracker.outcome = OutcomeTTSFailure
+		fsm.completeCall(call)
+		return nil
+	}
 
+	call.audioFile = result.AudioFile
+	call.menuPromptFiles = result.MenuPromptFiles
+	call.leadInFile = result.LeadInFile
+	call.pauseFile = result.PauseFile
+	if call.request == nil {
+		fsm.callTransitionTo(call, IncomingRinging)
+		fsm.answerCall(call)
+		return nil
+	}
+
+	// make sure the whole message can be played before the call gets aborted by the timeout
+	if !fsm.checkAudioDuration(call) {
+		call.tracker.outcome = OutcomeMessageTooLong
+		fsm.completeCall(call)
+		return nil
+	}
+	fsm.dialCall(call)
 	return nil
 }
 
@@ -270,12 +819,57 @@ func (fsm *VoipClientFSM) OnNewOutgoingCallRequest(newRequest NewCallRequest) er
 /*                               BARESIP EVENTS                               */
 /* -------------------------------------------------------------------------- */
 
+// OnBaresipDisconnected must be invoked when the connection to the baresip control socket is lost,
+// e.g. because baresip has been restarted: the calls handled by that baresip instance cannot be
+// tracked anymore, so the calls in progress are failed and the FSM goes back to the Uninitialized
+// state, waiting for [VoipClientFSM.InitializeUserAgents] to be invoked on reconnection, which
+// re-creates the User Agents only if baresip has lost them.
+// Queued requests and escalation chains are kept and served once an account is registered again.
+func (fsm *VoipClientFSM) OnBaresipDisconnected() error {
+	if fsm.currentState == Uninitialized {
+		return ErrInvalidState
+	}
+	fsm.logger.WarnPkgf(fsm.getLogPrefix(), "Lost connection to baresip; failing %d calls in progress", fsm.numActiveCalls())
+
+	// go back to the initial state first, so that completing the calls does not start new ones
+	fsm.transitionTo(Uninitialized)
+	for _, account := range fsm.accounts {
+		if account.registered {
+			account.registered = false
+			account.lastChange = time.Now()
+			metrics.SIPRegistered.WithLabelValues(sipAOR(account.uri)).Set(0)
+		}
+		// the User Agents are gone only if baresip has been restarted, not if just its control socket
+		// dropped: startRegistration() checks which is the case
+		account.attemptTime = time.Time{}
+		account.nextAttempt = time.Time{}
+		if account.failingSince.IsZero() {
+			account.failingSince = time.Now()
+		}
+	}
+
+	for _, call := range fsm.allCalls() {
+		call.tracker.outcome = OutcomeBaresipDisconnected
+		fsm.completeCall(call)
+	}
+	fsm.audioSourceCall = nil
+	clear(fsm.ignoredCallIds)
+	return nil
+}
+
 func (fsm *VoipClientFSM) OnRegisterOk(event gobaresip.EventMsg) error {
 	fsm.logger.InfoPkgf(fsm.getLogPrefix(), "Successful SIP REGISTER for: %s. This is good news. It means your 'voip_provider' addon configuration is valid and Baresip authenticated against your VOIP provider. Now calls can be made and can be received!", event.AccountAOR)
-	fsm.registered = true
+	account := fsm.findAccount(event.AccountAOR)
+	if account == nil {
+		fsm.logger.WarnPkgf(fsm.getLogPrefix(), "Received SIP REGISTER notification for an unknown account: %s. Ignoring it.", event.AccountAOR)
+		return ErrUnknownAccount
+	}
+	fsm.onRegistrationSucceeded(account)
 
 	if fsm.currentState == WaitingUserAgentRegistration {
 		fsm.transitionTo(WaitingInputs)
+		fsm.updateGlobalState()
+		fsm.serveQueuedRequests()
 	}
 	//else: Baresip (as every SIP UA) will periodically re-attempt registration (typically every 1h);
 	//      when that happens this function gets invoked and it might even happen during an outgoing call;
@@ -285,11 +879,13 @@ func (fsm *VoipClientFSM) OnRegisterOk(event gobaresip.EventMsg) error {
 }
 
 func (fsm *VoipClientFSM) OnRegisterFail(event gobaresip.EventMsg) error {
-	fsm.logger.InfoPkgf(fsm.getLogPrefix(), "Failed SIP REGISTER for: %s. This typically means that the 'voip_provider' addon configuration is invalid (either user or password is invalid). Please check above logs for more details. The addon won't work until the configuration will be fixed.", event.AccountAOR)
-	fsm.registered = false
-
-	// in this state any communication will fail... go back to the initial state
-	fsm.transitionTo(WaitingUserAgentRegistration)
+	fsm.logger.InfoPkgf(fsm.getLogPrefix(), "Failed SIP REGISTER for: %s. This typically means that the 'voip_provider' addon configuration is invalid (either user or password is invalid). Please check above logs for more details. The account won't work until the configuration will be fixed.", event.AccountAOR)
+	account := fsm.findAccount(event.AccountAOR)
+	if account == nil {
+		fsm.logger.WarnPkgf(fsm.getLogPrefix(), "Received SIP REGISTER notification for an unknown account: %s. Ignoring it.", event.AccountAOR)
+		return ErrUnknownAccount
+	}
+	fsm.onRegistrationFailed(account, "registration rejected or not answered, see the baresip logs")
 	return nil
 }
 
@@ -297,7 +893,20 @@ func (fsm *VoipClientFSM) OnCallOutgoing(event gobaresip.EventMsg) error {
 	fsm.logger.InfoPkgf(fsm.getLogPrefix(), "Received outgoing call notification for call ID (%s) and Peer URI: %s",
 		event.ID, event.PeerURI)
 
-	fsm.currentCallId = event.ID
+	// bind the baresip call ID to the call that was dialed, unless already done
+	call := fsm.findCall(event)
+	if call == nil {
+		call = fsm.bindPendingDial(event)
+	}
+	if call == nil {
+		fsm.logger.WarnPkgf(fsm.getLogPrefix(), "Received outgoing call notification for an unknown call ID (%s). Was it dialed by this addon?", event.ID)
+		return ErrInvalidState
+	}
+	if call.tracker.outcome != "" {
+		// the call was cancelled, or failed, before its call ID was known
+		fsm.logger.InfoPkgf(fsm.getCallLogPrefix(call), "Hanging up the call with outcome [%s] while dialing", call.tracker.outcome)
+		fsm.hangupCall(call)
+	}
 
 	// No need to transition into any new state...
 	// the call will progress autonomously either to CLOSE or ESTABLISHED statuses
@@ -305,73 +914,285 @@ func (fsm *VoipClientFSM) OnCallOutgoing(event gobaresip.EventMsg) error {
 	return nil
 }
 
+func (fsm *VoipClientFSM) OnCallIncoming(event gobaresip.EventMsg) error {
+	fsm.logger.InfoPkgf(fsm.getLogPrefix(), "Received incoming call notification for call ID (%s) from Peer URI: %s (%s)",
+		event.ID, event.PeerURI, event.PeerDisplayname)
+
+	rule := fsm.incomingCalls.Match(event.PeerURI)
+	if rule.Action == IncomingCallAnswer && !fsm.canStartCall() {
+		fsm.logger.WarnPkgf(fsm.getLogPrefix(), "FSM is busy with %d calls. Rejecting the incoming call instead of answering it.", fsm.numActiveCalls())
+		rule = IncomingCallRule{Action: IncomingCallReject}
+	}
+
+	fsm.publishCallerID(event, rule.Action)
+	metrics.IncomingCalls.WithLabelValues(string(rule.Action)).Inc()
+
+	switch rule.Action {
+	case IncomingCallIgnore:
+		fsm.logger.InfoPkgf(fsm.getLogPrefix(), "Ignoring incoming call (%s) as configured", event.ID)
+		fsm.ignoredCallIds[event.ID] = true
+		return nil
+
+	case IncomingCallReject:
+		fsm.logger.InfoPkgf(fsm.getLogPrefix(), "Rejecting incoming call (%s)", event.ID)
+		fsm.ignoredCallIds[event.ID] = true
+		_, err := fsm.baresipHandle.CmdHangupID(event.ID)
+		if err != nil {
+			fsm.logger.InfoPkgf(fsm.getLogPrefix(), "Error rejecting the incoming call: %s", err)
+		}
+		return nil
+	}
+
+	// answer the call: first of all prepare the audio file to play
+	call := &activeCall{
+		id:              event.ID,
+		peerURI:         event.PeerURI,
+		peerDisplayName: event.PeerDisplayname,
+		account:         fsm.findAccount(event.AccountAOR),
+		maxDuration:     fsm.maxVoiceCallDuration,
+		startTime:       time.Now(),
+		tracker:         callTracker{dialTime: time.Now()},
+	}
+	fsm.calls[call.id] = call
+
+	if rule.AudioFile != "" {
+		call.audioFile = rule.AudioFile
+		fsm.callTransitionTo(call, IncomingRinging)
+		fsm.updateGlobalState()
+		fsm.answerCall(call)
+		return nil
+	}
+
+	// the call keeps ringing while the TTS workers produce the greeting message
+	fsm.callTransitionTo(call, WaitingTTS)
+	fsm.updateGlobalState()
+	if !fsm.submitTTSJob(call, ttsJob{audio: tts.AudioRequest{Message: rule.MessageTTS}}) {
+		fsm.hangupCall(call)
+	}
+	return nil
+}
+
+// answerCall answers the given incoming call, whose audio file is ready
+func (fsm *VoipClientFSM) answerCall(call *activeCall) {
+	fsm.selectCall(call)
+	_, err := fsm.baresipHandle.CmdAccept()
+	if err != nil {
+		fsm.logger.InfoPkgf(fsm.getCallLogPrefix(call), "Error answering the incoming call: %s", err)
+		fsm.hangupCall(call)
+		return
+	}
+
+	fsm.logger.InfoPkgf(fsm.getCallLogPrefix(call), "Incoming call answered, waiting for the call to be established...")
+}
+
+// publishCallerID reports to Home Assistant and to the listeners who is calling
+func (fsm *VoipClientFSM) publishCallerID(event gobaresip.EventMsg, action IncomingCallAction) {
+	fsm.stateChangesPubCh.Submit(StateChange{
+		State: fsm.currentState,
+		IncomingCall: &IncomingCall{
+			CallID:      event.ID,
+			PeerURI:     event.PeerURI,
+			DisplayName: event.PeerDisplayname,
+			Account:     event.AccountAOR,
+			Action:      action,
+			Time:        time.Now(),
+		},
+	})
+	fsm.haClient.SetStateAsync("sensor.voip_client_last_caller", event.PeerURI, map[string]any{
+		"friendly_name": "VOIP Client Last Caller",
+		"icon":          "mdi:phone-incoming",
+		"display_name":  event.PeerDisplayname,
+		"call_id":       event.ID,
+		"account":       event.AccountAOR,
+		"action":        string(action),
+		"timestamp":     time.Now().Format(time.RFC3339),
+	})
+	fsm.haClient.FireEventAsync(haEventCallIncoming, map[string]any{
+		"call_id":   event.ID,
+		"peer_uri":  event.PeerURI,
+		"contact":   event.PeerDisplayname,
+		"direction": "incoming",
+		"account":   event.AccountAOR,
+		"action":    string(action),
+		"timestamp": time.Now().Format(time.RFC3339),
+	})
+}
+
 func (fsm *VoipClientFSM) OnCallEstablished(event gobaresip.EventMsg) error {
-	fsm.logger.InfoPkgf(fsm.getLogPrefix(), "Received call estabilished status update for Peer URI: %s", event.PeerURI)
+	fsm.logger.InfoPkgf(fsm.getLogPrefix(), "Received call estabilished status update for call ID (%s) and Peer URI: %s", event.ID, event.PeerURI)
 
-	if fsm.currentState != WaitForCallEstablishment {
-		fsm.logger.WarnPkgf(fsm.getLogPrefix(), "FSM is not in the WaitForCallEstablishment state, current state: %s. Ignoring new request.", fsm.currentState)
+	call := fsm.findCall(event)
+	if call == nil {
+		fsm.logger.WarnPkgf(fsm.getLogPrefix(), "Received call established event for an unknown call ID (%s). This is a bug.", event.ID)
 		return ErrInvalidState
 	}
 
-	if fsm.currentCallId != "" &&
-		fsm.currentCallId != event.ID {
-		fsm.logger.WarnPkgf(fsm.getLogPrefix(), "Received call established event for a different call ID (%s), expected %s. This is a bug.",
-			event.ID, fsm.currentCallId)
+	var nextState FSMState
+	switch call.state {
+	case WaitForCallEstablishment:
+		nextState = WaitForCallCompletion
+	case IncomingRinging:
+		nextState = IncomingAnswered
+	default:
+		fsm.logger.WarnPkgf(fsm.getCallLogPrefix(call), "Call is not in the WaitForCallEstablishment or IncomingRinging state, current state: %s. Ignoring new request.", call.state)
 		return ErrInvalidState
 	}
 
-	_, err := fsm.baresipHandle.CmdAusrc("aufile", fsm.pendingAudioFileToPlay)
+	var err error
+	if call.audioPending {
+		// dial-first mode: keep the called party on the line till the audio is ready
+		fsm.logger.InfoPkgf(fsm.getCallLogPrefix(call), "The audio file is not ready yet, playing the hold tone")
+		call.playingHoldTone = true
+		err = fsm.playAudioFile(call, fsm.holdToneFile)
+	} else {
+		err = fsm.startPlayback(call)
+	}
+	fsm.callTransitionTo(call, nextState)
+	call.tracker.establishedTime = time.Now()
+	fsm.fireCallEvent(haEventCallAnswered, call, nil)
 	if err != nil {
-		fsm.logger.InfoPkgf(fsm.getLogPrefix(), "Error setting audio source to the right file: %s", err)
-		fsm.transitionTo(WaitForCallCompletion)
 		return nil
 	}
 
-	fsm.transitionTo(WaitForCallCompletion)
-
 	// reset timeout counter:
-	fsm.currentCallStartTime = time.Now()
-	fsm.logger.InfoPkgf(fsm.getLogPrefix(), "Audio playback was started successfully, waiting up to %s for the audio file to complete...",
-		fsm.maxVoiceCallDuration.String())
+	call.startTime = time.Now()
+	if call.talkDuration > call.maxDuration {
+		// the ringing phase is over: give enough time to play the whole message
+		call.maxDuration = call.talkDuration
+	}
+	fsm.logger.InfoPkgf(fsm.getCallLogPrefix(call), "Audio playback was started successfully, waiting up to %s for the audio file to complete...",
+		call.maxDuration.String())
 
 	return nil
 }
 
 func (fsm *VoipClientFSM) OnEndOfFile(event gobaresip.EventMsg) error {
-	fsm.logger.InfoPkgf(fsm.getLogPrefix(), "Received end-of-file notification: %s", event.PeerURI)
+	fsm.logger.InfoPkgf(fsm.getLogPrefix(), "Received end-of-file notification for call ID (%s): %s", event.ID, event.PeerURI)
 
-	if fsm.currentState != WaitForCallCompletion {
-		fsm.logger.WarnPkgf(fsm.getLogPrefix(), "FSM is not in the WaitForCallCompletion state, current state: %s. Ignoring new request.", fsm.currentState)
+	call := fsm.findCall(event)
+	if call == nil && event.ID == "" {
+		// the event does not carry the call ID: it refers to the call that is playing the file
+		call = fsm.audioSourceCall
+	}
+	if call == nil {
+		fsm.logger.WarnPkgf(fsm.getLogPrefix(), "Received end-of-file event for an unknown call ID (%s). Ignoring it.", event.ID)
+		return ErrInvalidState
+	}
+
+	if call.state != WaitForCallCompletion && call.state != IncomingAnswered {
+		fsm.logger.WarnPkgf(fsm.getCallLogPrefix(call), "Call is not in the WaitForCallCompletion or IncomingAnswered state, current state: %s. Ignoring new request.", call.state)
 		return ErrInvalidState
 	}
 
+	if call.playingHoldTone {
+		// still waiting for the audio file
+		_ = fsm.playAudioFile(call, fsm.holdToneFile)
+		return nil
+	}
+	if call.playingSilence {
+		// the lead-in or the pause is over
+		call.playingSilence = false
+		_ = fsm.playAudioFile(call, call.audioFile)
+		return nil
+	}
+
+	if !call.playingMenuPrompt {
+		call.tracker.audioCompleted = true
+		call.playbacks++
+		if fsm.repeatMessage(call) {
+			return nil
+		}
+	}
+
+	if call.menuNode != nil {
+		if !call.playingMenuPrompt {
+			// the message is over, now ask the called party to choose
+			fsm.playMenuPrompt(call)
+		}
+		// else: the prompt is over, keep waiting for DTMF digits till the call timeout
+		return nil
+	}
+
 	// hang up the call!
-	_, err := fsm.baresipHandle.CmdHangupID(fsm.currentCallId)
-	if err != nil {
-		fsm.logger.InfoPkgf(fsm.getLogPrefix(), "Error hanging up the call: %s", err)
+	fsm.hangupCall(call)
+	return nil
+}
+
+func (fsm *VoipClientFSM) OnDTMF(event gobaresip.EventMsg) error {
+	digit := event.Param
+	fsm.logger.InfoPkgf(fsm.getLogPrefix(), "Received DTMF digit [%s] for call ID (%s)", digit, event.ID)
+
+	call := fsm.findCall(event)
+	if call == nil || call.state != WaitForCallCompletion || call.menuNode == nil || call.playingHoldTone {
+		fsm.logger.InfoPkgf(fsm.getLogPrefix(), "No DTMF menu is active for call ID (%s). Ignoring DTMF digit.", event.ID)
+		return ErrInvalidState
+	}
+
+	call.collectedDigits += digit
+	fsm.fireCallEvent(haEventCallDTMF, call, map[string]any{
+		"menu":   call.menuNode.Name,
+		"digit":  digit,
+		"digits": call.collectedDigits,
+	})
+
+	opt, exists := call.menuNode.Options[digit]
+	if !exists {
+		fsm.logger.InfoPkgf(fsm.getCallLogPrefix(call), "Digit [%s] is not valid for DTMF menu [%s], playing again the prompt", digit, call.menuNode.Name)
+		fsm.playMenuPrompt(call)
 		return nil
 	}
 
+	switch opt.Action {
+	case DTMFAcknowledge:
+		fsm.logger.InfoPkgf(fsm.getCallLogPrefix(call), "Call acknowledged by the called party")
+		call.acknowledged = true
+		fsm.hangupCall(call)
+
+	case DTMFHangup:
+		fsm.hangupCall(call)
+
+	case DTMFRepeat:
+		call.playingMenuPrompt = false
+		call.playingSilence = false
+		_ = fsm.playAudioFile(call, call.audioFile)
+
+	case DTMFMenu:
+		call.menuNode = fsm.dtmfMenus.Get(opt.NextMenu)
+		fsm.playMenuPrompt(call)
+	}
+
 	return nil
 }
 
+// playMenuPrompt plays the prompt of the current DTMF menu node of the given call; if the prompt
+// could not be prepared, the fallback audio file is played instead, while the menu keeps working
+func (fsm *VoipClientFSM) playMenuPrompt(call *activeCall) {
+	call.playingMenuPrompt = true
+	promptFile, exists := call.menuPromptFiles[call.menuNode.Name]
+	if !exists {
+		promptFile = fsm.fallbackFile
+	}
+	_ = fsm.playAudioFile(call, promptFile)
+}
+
 func (fsm *VoipClientFSM) OnCallClosed(event gobaresip.EventMsg) error {
-	fsm.logger.InfoPkgf(fsm.getLogPrefix(), "Received call closed event for Peer URI: %s", event.PeerURI)
+	fsm.logger.InfoPkgf(fsm.getLogPrefix(), "Received call closed event for call ID (%s) and Peer URI: %s", event.ID, event.PeerURI)
 
-	if fsm.currentState == WaitingInputs {
-		fsm.logger.WarnPkgf(fsm.getLogPrefix(), "FSM is not in a state where a call should be active, current state: %s. This is a bug.", fsm.currentState)
-		return ErrInvalidState
+	if fsm.ignoredCallIds[event.ID] {
+		// this is a rejected/ignored incoming call: it never affected the FSM state
+		delete(fsm.ignoredCallIds, event.ID)
+		return nil
 	}
 
-	if fsm.currentCallId != "" &&
-		fsm.currentCallId != event.ID {
-		fsm.logger.WarnPkgf(fsm.getLogPrefix(), "Received call closed event for a different call ID (%s), expected %s. This is a bug.",
-			event.ID, fsm.currentCallId)
+	call := fsm.findCall(event)
+	if call == nil {
+		fsm.logger.WarnPkgf(fsm.getLogPrefix(), "Received call closed event for an unknown call ID (%s). This is a bug.", event.ID)
 		return ErrInvalidState
 	}
 
-	fsm.logger.InfoPkgf(fsm.getLogPrefix(), "Aborting any operation in progress since the call %s has ended...", event.ID)
-	fsm.transitionTo(WaitingInputs)
+	call.tracker.onClosed(event.Param)
+	fsm.logger.InfoPkgf(fsm.getCallLogPrefix(call), "Aborting any operation in progress since the call has ended (reason: %s)...", event.Param)
+	fsm.completeCall(call)
 
 	return nil
 }
@@ -0,0 +1,1286 @@
+package fsm
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"voip-client-backend/pkg/config"
+	"voip-client-backend/pkg/homeassistant"
+	"voip-client-backend/pkg/logger"
+	"voip-client-backend/pkg/tts"
+
+	"github.com/dustin/go-broadcast"
+	"github.com/f18m/go-baresip/pkg/gobaresip"
+)
+
+const testAccountAOR = "sip:user@example.com"
+
+// fakeBaresip is a [BaresipHandle] recording all commands, which always succeed except uafind
+// for the User Agents never created with uanew
+type fakeBaresip struct {
+	cmds []string
+	uas  map[string]bool // AORs of the User Agents created
+}
+
+func (b *fakeBaresip) record(cmd string) (gobaresip.ResponseMsg, error) {
+	b.cmds = append(b.cmds, cmd)
+	return gobaresip.ResponseMsg{Response: true, Ok: true}, nil
+}
+
+func (b *fakeBaresip) CmdTxWithAck(cmd gobaresip.CommandMsg) (gobaresip.ResponseMsg, error) {
+	if cmd.Command == "uanew" {
+		aor, _, _ := strings.Cut(strings.TrimPrefix(cmd.Params, "<"), ">")
+		if b.uas == nil {
+			b.uas = make(map[string]bool)
+		}
+		b.uas[aor] = true
+	}
+	return b.record(strings.TrimSpace(cmd.Command + " " + cmd.Params))
+}
+
+func (b *fakeBaresip) CmdDial(calledsipURI string) (gobaresip.ResponseMsg, error) {
+	return b.record("dial " + calledsipURI)
+}
+
+func (b *fakeBaresip) CmdHangupID(callID string) (gobaresip.ResponseMsg, error) {
+	return b.record("hangup " + callID)
+}
+
+func (b *fakeBaresip) CmdAccept() (gobaresip.ResponseMsg, error) {
+	return b.record("accept")
+}
+
+func (b *fakeBaresip) CmdAusrc(driver, device string) (gobaresip.ResponseMsg, error) {
+	return b.record("ausrc " + driver + "," + device)
+}
+
+func (b *fakeBaresip) CmdUafind(sipURI string) (gobaresip.ResponseMsg, error) {
+	resp, err := b.record("uafind " + sipURI)
+	resp.Ok = b.uas[sipURI]
+	return resp, err
+}
+
+// restart forgets the User Agents created so far, like a restarted baresip
+func (b *fakeBaresip) restart() {
+	b.uas = nil
+}
+
+// reset forgets the commands recorded so far
+func (b *fakeBaresip) reset() {
+	b.cmds = nil
+}
+
+type testFSM struct {
+	*VoipClientFSM
+	baresip *fakeBaresip
+	notifCh chan interface{}
+}
+
+// newTestFSM returns an FSM with a registered account, ready to start calls
+func newTestFSM(t *testing.T, maxConcurrentCalls, queueDepth int) *testFSM {
+	t.Helper()
+	// use the hardcoded audio file instead of the Home Assistant TTS service
+	t.Setenv("LOCAL_TESTING", "1")
+	t.Setenv("HASSIO_TOKEN", "")
+
+	log := logger.NewCustomLogger("test")
+	incomingCalls, err := NewIncomingCallPolicy(nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dtmfMenus, err := NewDTMFMenus([]config.AddonDTMFMenu{
+		{Name: "alarm", PromptTTS: "Press 1 to acknowledge", Options: []config.AddonDTMFMenuOption{{Digit: "1", Action: "ack"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	broadcaster := broadcast.NewBroadcaster(100)
+	notifCh := make(chan interface{}, 100)
+	broadcaster.Register(notifCh)
+	t.Cleanup(func() {
+		broadcaster.Unregister(notifCh)
+		_ = broadcaster.Close()
+	})
+
+	ttsWorkers := NewTTSWorkerPool(log, tts.NewTTSService(log, "test", tts.NewCache(log, t.TempDir(), 0, 0)), 2)
+	go ttsWorkers.Run(t.Context())
+
+	b := &fakeBaresip{}
+	f := NewVoipClientFSM(log, b, ttsWorkers, NewCallRequestQueue(log, queueDepth, 5*time.Minute, ""),
+		incomingCalls, dtmfMenus, homeassistant.NewClient(log), broadcaster,
+		[]config.AddonVoipProvider{{Name: "main", Account: "<" + testAccountAOR + ">", Password: "secret"}},
+		true, time.Minute, LongMessageSplit, maxConcurrentCalls)
+	if err := f.InitializeUserAgents(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.OnRegisterOk(gobaresip.EventMsg{AccountAOR: testAccountAOR}); err != nil {
+		t.Fatal(err)
+	}
+	if f.GetCurrentState() != WaitingInputs {
+		t.Fatalf("expected state WaitingInputs, got %s", f.GetCurrentState())
+	}
+	b.reset()
+
+	return &testFSM{VoipClientFSM: f, baresip: b, notifCh: notifCh}
+}
+
+// waitResult waits for the result of the given request to be published
+func (f *testFSM) waitResult(t *testing.T, requestID string) CallResult {
+	t.Helper()
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case n := <-f.notifCh:
+			change, ok := n.(StateChange)
+			if ok && change.RequestID == requestID && change.Result != nil {
+				return *change.Result
+			}
+		case <-timeout:
+			t.Fatalf("no result published for request [%s]", requestID)
+		}
+	}
+}
+
+// waitTTS delivers to the FSM the results of the TTS workers, till no call is waiting for them
+func (f *testFSM) waitTTS(t *testing.T) {
+	t.Helper()
+	timeout := time.After(2 * time.Second)
+	for f.numWaitingTTS() > 0 {
+		select {
+		case r := <-f.ttsWorkers.GetResultChannel():
+			_ = f.OnTTSCompleted(r)
+		case <-timeout:
+			t.Fatalf("%d calls still waiting for the TTS workers", f.numWaitingTTS())
+		}
+	}
+}
+
+func (f *testFSM) numWaitingTTS() int {
+	n := 0
+	for _, call := range f.allCalls() {
+		if call.state == WaitingTTS {
+			n++
+		}
+	}
+	return n
+}
+
+// dial submits a new call request, waits for its audio files and returns its ID
+func (f *testFSM) dial(t *testing.T, req NewCallRequest) string {
+	t.Helper()
+	if req.MessageTTS == "" {
+		req.MessageTTS = "test message"
+	}
+	receipt, err := f.OnNewOutgoingCallRequest(req)
+	if err != nil {
+		t.Fatalf("unexpected error for call request: %s", err)
+	}
+	f.waitTTS(t)
+	return receipt.RequestID
+}
+
+func event(id, peerURI string) gobaresip.EventMsg {
+	return gobaresip.EventMsg{ID: id, PeerURI: peerURI, AccountAOR: testAccountAOR}
+}
+
+func (f *testFSM) hasCmd(cmd string) bool {
+	for _, c := range f.baresip.cmds {
+		if c == cmd {
+			return true
+		}
+	}
+	return false
+}
+
+func TestBindPendingDial(t *testing.T) {
+	tests := []struct {
+		name        string
+		peerURI     string
+		wantCalled  string
+		wantPending int
+	}{
+		{"same peer is preferred", "sip:b@example.com", "sip:b@example.com", 1},
+		{"same peer with params", "<sip:B@example.com;transport=tcp>", "sip:b@example.com", 1},
+		{"unknown peer binds the oldest", "sip:c@example.com", "sip:a@example.com", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newTestFSM(t, 2, 5)
+			f.dial(t, NewCallRequest{CalledNumber: "sip:a@example.com"})
+			f.dial(t, NewCallRequest{CalledNumber: "sip:b@example.com"})
+
+			if err := f.OnCallOutgoing(event("id1", tt.peerURI)); err != nil {
+				t.Fatal(err)
+			}
+			call := f.calls["id1"]
+			if call == nil {
+				t.Fatal("call ID was not bound")
+			}
+			if call.request.CalledNumber != tt.wantCalled {
+				t.Errorf("bound call to %s, want %s", call.request.CalledNumber, tt.wantCalled)
+			}
+			if len(f.pendingDials) != tt.wantPending {
+				t.Errorf("%d pending dials, want %d", len(f.pendingDials), tt.wantPending)
+			}
+		})
+	}
+}
+
+func TestFindCall(t *testing.T) {
+	f := newTestFSM(t, 2, 5)
+	f.dial(t, NewCallRequest{CalledNumber: "sip:a@example.com"})
+	f.dial(t, NewCallRequest{CalledNumber: "sip:b@example.com"})
+	if err := f.OnCallOutgoing(event("id-a", "sip:a@example.com")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		event  gobaresip.EventMsg
+		wantID string // empty if no call must be found
+	}{
+		{"known call ID", event("id-a", "sip:a@example.com"), "id-a"},
+		{"unknown call ID towards a pending dial", event("id-b", "sip:b@example.com"), ""},
+		{"empty call ID", event("", "sip:b@example.com"), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			call := f.findCall(tt.event)
+			switch {
+			case tt.wantID == "" && call != nil:
+				t.Errorf("found call [%s], want none", call.id)
+			case tt.wantID != "" && (call == nil || call.id != tt.wantID):
+				t.Errorf("found call %v, want [%s]", call, tt.wantID)
+			}
+		})
+	}
+
+	// findCall must never bind pending dials
+	if len(f.pendingDials) != 1 {
+		t.Errorf("%d pending dials, want 1", len(f.pendingDials))
+	}
+}
+
+func TestLateCallClosedDoesNotCompleteAnotherCall(t *testing.T) {
+	f := newTestFSM(t, 1, 5)
+	idA := f.dial(t, NewCallRequest{CalledNumber: "sip:a@example.com"})
+	if err := f.OnCallOutgoing(event("id-a", "sip:a@example.com")); err != nil {
+		t.Fatal(err)
+	}
+
+	// call A is forgotten, e.g. after the abort timeout, and call B is dialed
+	f.completeCall(f.calls["id-a"])
+	f.waitResult(t, idA)
+	f.dial(t, NewCallRequest{CalledNumber: "sip:b@example.com"})
+
+	// the late CALL_CLOSED of call A must not affect call B
+	if err := f.OnCallClosed(event("id-a", "sip:a@example.com")); err != ErrInvalidState {
+		t.Errorf("got error %v, want %v", err, ErrInvalidState)
+	}
+	if len(f.pendingDials) != 1 || f.numActiveCalls() != 1 {
+		t.Errorf("call B is not pending anymore: %d pending dials, %d active calls", len(f.pendingDials), f.numActiveCalls())
+	}
+}
+
+func TestSelectCallBeforeAudio(t *testing.T) {
+	f := newTestFSM(t, 2, 5)
+	f.dial(t, NewCallRequest{CalledNumber: "sip:a@example.com"})
+	if err := f.OnCallOutgoing(event("id-a", "sip:a@example.com")); err != nil {
+		t.Fatal(err)
+	}
+	// call B is dialed but its CALL_OUTGOING is not received yet
+	f.dial(t, NewCallRequest{CalledNumber: "sip:b@example.com"})
+	f.baresip.reset()
+
+	if err := f.OnCallEstablished(event("id-a", "sip:a@example.com")); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.baresip.cmds) < 2 || f.baresip.cmds[0] != "callfind id-a" || !strings.HasPrefix(f.baresip.cmds[1], "ausrc aufile,") {
+		t.Errorf("unexpected commands: %v", f.baresip.cmds)
+	}
+}
+
+func TestEndOfFileWithoutCallID(t *testing.T) {
+	f := newTestFSM(t, 2, 5)
+	for _, id := range []string{"a", "b"} {
+		f.dial(t, NewCallRequest{CalledNumber: fmt.Sprintf("sip:%s@example.com", id)})
+		if err := f.OnCallOutgoing(event("id-"+id, fmt.Sprintf("sip:%s@example.com", id))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.OnCallEstablished(event("id-a", "sip:a@example.com")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.OnCallEstablished(event("id-b", "sip:b@example.com")); err != nil {
+		t.Fatal(err)
+	}
+	f.baresip.reset()
+
+	// the END_OF_FILE event refers to the last call whose audio source was set
+	if err := f.OnEndOfFile(gobaresip.EventMsg{}); err != nil {
+		t.Fatal(err)
+	}
+	if !f.hasCmd("hangup id-b") {
+		t.Errorf("call B was not hung up: %v", f.baresip.cmds)
+	}
+	if !f.calls["id-b"].tracker.audioCompleted || f.calls["id-a"].tracker.audioCompleted {
+		t.Error("audio completion recorded on the wrong call")
+	}
+}
+
+func TestGroupCompletion(t *testing.T) {
+	f := newTestFSM(t, 2, 5)
+	groupID := f.dial(t, NewCallRequest{Recipients: []CallContact{
+		{Name: "A", URI: "sip:a@example.com"},
+		{Name: "B", URI: "sip:b@example.com"},
+	}})
+	if f.numActiveCalls() != 2 {
+		t.Fatalf("%d active calls, want 2", f.numActiveCalls())
+	}
+
+	steps := []struct {
+		id, peer, closeReason string
+		established           bool
+	}{
+		{"id-a", "sip:a@example.com", "486 Busy Here", false},
+		{"id-b", "sip:b@example.com", "Connection reset by user", true},
+	}
+	for _, s := range steps {
+		if err := f.OnCallOutgoing(event(s.id, s.peer)); err != nil {
+			t.Fatal(err)
+		}
+		if s.established {
+			if err := f.OnCallEstablished(event(s.id, s.peer)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		ev := event(s.id, s.peer)
+		ev.Param = s.closeReason
+		if err := f.OnCallClosed(ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	result := f.waitResult(t, groupID)
+	if result.Outcome != OutcomeAnswered {
+		t.Errorf("group outcome %s, want %s", result.Outcome, OutcomeAnswered)
+	}
+	if len(result.Calls) != 2 || result.Calls[0].Outcome != OutcomeBusy || result.Calls[0].SIPCode != 486 {
+		t.Errorf("unexpected results of the calls: %+v", result.Calls)
+	}
+	if len(f.groups) != 0 || f.GetCurrentState() != WaitingInputs {
+		t.Errorf("group not cleaned up: %d groups, state %s", len(f.groups), f.GetCurrentState())
+	}
+}
+
+func TestGroupLargerThanQueue(t *testing.T) {
+	f := newTestFSM(t, 2, 1)
+
+	// 2 recipients are called immediately, only 1 needs to be queued
+	_, err := f.OnNewOutgoingCallRequest(NewCallRequest{MessageTTS: "test", Recipients: []CallContact{
+		{URI: "sip:a@example.com"}, {URI: "sip:b@example.com"}, {URI: "sip:c@example.com"},
+	}})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if f.numActiveCalls() != 2 || f.callQueue.Len() != 1 {
+		t.Errorf("%d active calls and %d queued requests, want 2 and 1", f.numActiveCalls(), f.callQueue.Len())
+	}
+
+	// now there is no room for further recipients
+	_, err = f.OnNewOutgoingCallRequest(NewCallRequest{MessageTTS: "test", Recipients: []CallContact{
+		{URI: "sip:d@example.com"}, {URI: "sip:e@example.com"},
+	}})
+	if err != ErrQueueFull {
+		t.Errorf("got error %v, want %v", err, ErrQueueFull)
+	}
+}
+
+func TestDTMFMenuNavigation(t *testing.T) {
+	tests := []struct {
+		name     string
+		digits   string
+		wantMenu string
+		wantAck  bool
+		wantHang bool
+	}{
+		{"acknowledge", "1", "main", true, true},
+		{"hang up", "9", "main", false, true},
+		{"submenu", "2", "more", false, false},
+		{"back to the root", "20", "main", false, false},
+		{"acknowledge after navigation", "201", "main", true, true},
+		{"repeat in submenu", "21", "more", false, false},
+		{"invalid digit", "5", "main", false, false},
+		{"digit of another menu", "29", "more", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newTestFSM(t, 1, 5)
+			menus, err := NewDTMFMenus([]config.AddonDTMFMenu{
+				{Name: "main", PromptTTS: "Press 1 to acknowledge, 2 for more options, 9 to hang up", Options: []config.AddonDTMFMenuOption{
+					{Digit: "1", Action: "ack"}, {Digit: "2", Action: "menu", NextMenu: "more"}, {Digit: "9", Action: "hangup"},
+				}},
+				{Name: "more", PromptTTS: "Press 1 to listen again, 0 to go back", Options: []config.AddonDTMFMenuOption{
+					{Digit: "1", Action: "repeat"}, {Digit: "0", Action: "menu", NextMenu: "main"},
+				}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.dtmfMenus = menus
+
+			f.dial(t, NewCallRequest{CalledNumber: "sip:a@example.com", DTMFMenu: "main"})
+			ev := event("id1", "sip:a@example.com")
+			if err := f.OnCallOutgoing(ev); err != nil {
+				t.Fatal(err)
+			}
+			if err := f.OnCallEstablished(ev); err != nil {
+				t.Fatal(err)
+			}
+			// the message is over, the prompt of the root menu starts
+			if err := f.OnEndOfFile(ev); err != nil {
+				t.Fatal(err)
+			}
+			for _, digit := range tt.digits {
+				dtmf := event("id1", "sip:a@example.com")
+				dtmf.Param = string(digit)
+				if err := f.OnDTMF(dtmf); err != nil {
+					t.Fatalf("digit %c: %s", digit, err)
+				}
+			}
+
+			call := f.calls["id1"]
+			if call.menuNode.Name != tt.wantMenu || call.acknowledged != tt.wantAck || call.collectedDigits != tt.digits {
+				t.Errorf("got menu %s, acknowledged %v, digits %q", call.menuNode.Name, call.acknowledged, call.collectedDigits)
+			}
+			if f.hasCmd("hangup id1") != tt.wantHang {
+				t.Errorf("call hung up: %v, want %v", f.hasCmd("hangup id1"), tt.wantHang)
+			}
+		})
+	}
+}
+
+func TestEscalationStepCompleted(t *testing.T) {
+	f := newTestFSM(t, 1, 5)
+	escalationID := f.dial(t, NewCallRequest{
+		DTMFMenu: "alarm",
+		Escalation: &EscalationChain{
+			Contacts: []CallContact{{Name: "A", URI: "sip:a@example.com"}, {Name: "B", URI: "sip:b@example.com"}},
+		},
+	})
+
+	// A does not answer, so B is called next
+	if err := f.OnCallOutgoing(event("id-a", "sip:a@example.com")); err != nil {
+		t.Fatal(err)
+	}
+	closed := event("id-a", "sip:a@example.com")
+	closed.Param = "408 Request Timeout"
+	if err := f.OnCallClosed(closed); err != nil {
+		t.Fatal(err)
+	}
+	f.OnTimeoutTicker()
+	f.waitTTS(t)
+	if len(f.pendingDials) != 1 || f.pendingDials[0].request.CalledContact != "B" {
+		t.Fatalf("contact B was not dialed")
+	}
+
+	// B acknowledges
+	if err := f.OnCallOutgoing(event("id-b", "sip:b@example.com")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.OnCallEstablished(event("id-b", "sip:b@example.com")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.OnEndOfFile(gobaresip.EventMsg{}); err != nil {
+		t.Fatal(err)
+	}
+	dtmf := event("id-b", "sip:b@example.com")
+	dtmf.Param = "1"
+	if err := f.OnDTMF(dtmf); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.OnCallClosed(event("id-b", "sip:b@example.com")); err != nil {
+		t.Fatal(err)
+	}
+
+	result := f.waitResult(t, escalationID)
+	if !result.Acknowledged || result.AcknowledgedBy != "B" {
+		t.Errorf("escalation not acknowledged by B: %+v", result)
+	}
+	if len(f.escalations) != 0 {
+		t.Errorf("escalation not cleaned up")
+	}
+}
+
+func TestEscalationOrder(t *testing.T) {
+	tests := []struct {
+		name       string
+		retries    int
+		ackAt      int // number of the call acknowledged, zero for none
+		wantDialed string
+		wantAckBy  string
+	}{
+		{"first contact acknowledges", 0, 1, "A", "A"},
+		{"second contact acknowledges", 0, 2, "A,B", "B"},
+		{"nobody acknowledges", 0, 0, "A,B,C", ""},
+		{"acknowledged during a retry", 1, 5, "A,B,C,A,B", "B"},
+		{"nobody acknowledges after the retries", 1, 0, "A,B,C,A,B,C", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newTestFSM(t, 1, 5)
+			escalationID := f.dial(t, NewCallRequest{
+				DTMFMenu: "alarm",
+				Escalation: &EscalationChain{
+					Contacts: []CallContact{{Name: "A", URI: "sip:a@example.com"}, {Name: "B", URI: "sip:b@example.com"}, {Name: "C", URI: "sip:c@example.com"}},
+					Retries:  tt.retries,
+				},
+			})
+
+			var dialed []string
+			for step := 0; len(f.escalations) > 0; step++ {
+				if step >= 10 || len(f.pendingDials) != 1 {
+					t.Fatalf("escalation stuck after dialing %v", dialed)
+				}
+				contact := f.pendingDials[0].request.CalledContact
+				dialed = append(dialed, contact)
+
+				ev := event(fmt.Sprintf("id%d", step), f.pendingDials[0].request.CalledNumber)
+				if err := f.OnCallOutgoing(ev); err != nil {
+					t.Fatal(err)
+				}
+				if len(dialed) == tt.ackAt {
+					if err := f.OnCallEstablished(ev); err != nil {
+						t.Fatal(err)
+					}
+					if err := f.OnEndOfFile(ev); err != nil {
+						t.Fatal(err)
+					}
+					dtmf := ev
+					dtmf.Param = "1"
+					if err := f.OnDTMF(dtmf); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if err := f.OnCallClosed(ev); err != nil {
+					t.Fatal(err)
+				}
+				f.OnTimeoutTicker()
+				f.waitTTS(t)
+			}
+
+			if strings.Join(dialed, ",") != tt.wantDialed {
+				t.Errorf("dialed %v, want %s", dialed, tt.wantDialed)
+			}
+			result := f.waitResult(t, escalationID)
+			if result.Acknowledged != (tt.wantAckBy != "") || result.AcknowledgedBy != tt.wantAckBy {
+				t.Errorf("got acknowledged %v by %q, want acknowledged by %q", result.Acknowledged, result.AcknowledgedBy, tt.wantAckBy)
+			}
+		})
+	}
+}
+
+func TestEscalationStepExpiry(t *testing.T) {
+	expiresAt := time.Now().Add(time.Minute)
+	e := &escalationState{request: NewCallRequest{
+		ID:         "esc",
+		ExpiresAt:  expiresAt,
+		Escalation: &EscalationChain{Contacts: []CallContact{{Name: "A", URI: "sip:a@example.com"}}, Retries: 1},
+	}}
+	e.attempts = 1
+	step := e.nextStep()
+	if step.ID != "esc-2" || step.CalledContact != "A" || !step.ExpiresAt.Equal(expiresAt) {
+		t.Errorf("unexpected retry step: %+v", step)
+	}
+}
+
+func TestHangupRequest(t *testing.T) {
+	f := newTestFSM(t, 2, 5)
+	reqA := f.dial(t, NewCallRequest{CalledNumber: "sip:a@example.com"})
+	f.dial(t, NewCallRequest{CalledNumber: "sip:b@example.com"})
+	for _, ev := range []gobaresip.EventMsg{event("id-a", "sip:a@example.com"), event("id-b", "sip:b@example.com")} {
+		if err := f.OnCallOutgoing(ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := f.OnHangupRequest("unknown", ""); !errors.Is(err, ErrNoMatchingCall) {
+		t.Errorf("hangup of an unknown call returned %v, want %v", err, ErrNoMatchingCall)
+	}
+
+	n, err := f.OnHangupRequest("", reqA)
+	if err != nil || n != 1 || !f.hasCmd("hangup id-a") || f.hasCmd("hangup id-b") {
+		t.Errorf("hangup by request ID: %d calls, err %v, commands %v", n, err, f.baresip.cmds)
+	}
+
+	f.baresip.reset()
+	n, err = f.OnHangupRequest("", "")
+	if err != nil || n != 2 || !f.hasCmd("hangup id-a") || !f.hasCmd("hangup id-b") {
+		t.Errorf("hangup of all calls: %d calls, err %v, commands %v", n, err, f.baresip.cmds)
+	}
+}
+
+func TestWaitingTTS(t *testing.T) {
+	f := newTestFSM(t, 1, 5)
+	receipt, err := f.OnNewOutgoingCallRequest(NewCallRequest{CalledNumber: "sip:a@example.com", MessageTTS: "test message"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reqA := receipt.RequestID
+
+	// the call holds its slot while waiting for the TTS workers, without being dialed
+	if f.numWaitingTTS() != 1 || f.hasCmd("dial sip:a@example.com") || f.GetCurrentState() != CallsInProgress {
+		t.Fatalf("call not waiting for TTS: state %s, commands %v", f.GetCurrentState(), f.baresip.cmds)
+	}
+	receipt, err = f.OnNewOutgoingCallRequest(NewCallRequest{CalledNumber: "sip:b@example.com", MessageTTS: "test message"})
+	if err != nil || receipt.QueuePosition != 1 {
+		t.Fatalf("second request: position %d, err %v, want it queued", receipt.QueuePosition, err)
+	}
+	reqB := receipt.RequestID
+
+	// baresip events are still processed
+	if err := f.OnRegisterOk(gobaresip.EventMsg{AccountAOR: testAccountAOR}); err != nil {
+		t.Fatal(err)
+	}
+
+	// cancelling the call completes it at once, and the late TTS result is ignored
+	jobA := f.preparingCalls[0].ttsJobID
+	if n, err := f.OnHangupRequest("", reqA); err != nil || n != 1 {
+		t.Fatalf("hangup: %d calls, err %v", n, err)
+	}
+	if result := f.waitResult(t, reqA); result.Outcome != OutcomeCancelled {
+		t.Errorf("call outcome is %s, want %s", result.Outcome, OutcomeCancelled)
+	}
+	f.waitTTS(t)
+	if f.hasCmd("dial sip:a@example.com") || !f.hasCmd("dial sip:b@example.com") {
+		t.Errorf("want only the queued call dialed, commands %v", f.baresip.cmds)
+	}
+	if err := f.OnTTSCompleted(TTSResult{JobID: jobA}); !errors.Is(err, ErrInvalidState) {
+		t.Errorf("late TTS result returned %v, want %v", err, ErrInvalidState)
+	}
+	if len(f.pendingDials) != 1 || f.pendingDials[0].request.ID != reqB {
+		t.Errorf("want only the call to B dialed")
+	}
+}
+
+func TestTTSFailure(t *testing.T) {
+	f := newTestFSM(t, 1, 5)
+	receipt, err := f.OnNewOutgoingCallRequest(NewCallRequest{CalledNumber: "sip:a@example.com", MessageTTS: "test message"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.OnTTSCompleted(TTSResult{JobID: f.preparingCalls[0].ttsJobID, Err: errors.New("TTS engine unavailable")}); err != nil {
+		t.Fatal(err)
+	}
+	if result := f.waitResult(t, receipt.RequestID); result.Outcome != OutcomeTTSFailure {
+		t.Errorf("call outcome is %s, want %s", result.Outcome, OutcomeTTSFailure)
+	}
+	if f.numActiveCalls() != 0 || f.GetCurrentState() != WaitingInputs {
+		t.Errorf("call not completed: %d active calls, state %s", f.numActiveCalls(), f.GetCurrentState())
+	}
+}
+
+func TestTimeoutKeepsKnownOutcome(t *testing.T) {
+	tests := []struct {
+		name  string
+		known CallOutcome
+		want  CallOutcome
+	}{
+		{"no outcome yet", "", OutcomeTimeout},
+		{"message too long", OutcomeMessageTooLong, OutcomeMessageTooLong},
+		{"cancelled", OutcomeCancelled, OutcomeCancelled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newTestFSM(t, 1, 5)
+			id := f.dial(t, NewCallRequest{CalledNumber: "sip:a@example.com"})
+			ev := event("id-a", "sip:a@example.com")
+			if err := f.OnCallOutgoing(ev); err != nil {
+				t.Fatal(err)
+			}
+			call := f.allCalls()[0]
+			call.tracker.outcome = tt.known
+			call.startTime = time.Now().Add(-2 * call.maxDuration)
+			f.OnTimeoutTicker()
+			if !f.hasCmd("hangup id-a") {
+				t.Fatalf("call not hung up on timeout, commands %v", f.baresip.cmds)
+			}
+			if err := f.OnCallClosed(ev); err != nil {
+				t.Fatal(err)
+			}
+			if result := f.waitResult(t, id); result.Outcome != tt.want {
+				t.Errorf("call outcome is %s, want %s", result.Outcome, tt.want)
+			}
+		})
+	}
+}
+
+func TestHangupCancelsPendingAndQueuedRequests(t *testing.T) {
+	f := newTestFSM(t, 1, 5)
+	reqA := f.dial(t, NewCallRequest{CalledNumber: "sip:a@example.com"})
+	reqB := f.dial(t, NewCallRequest{CalledNumber: "sip:b@example.com"})
+	if f.callQueue.Len() != 1 {
+		t.Fatalf("queue length is %d, want 1", f.callQueue.Len())
+	}
+
+	// the queued request is removed right away
+	n, err := f.OnHangupRequest("", reqB)
+	if err != nil || n != 1 || f.callQueue.Len() != 0 {
+		t.Fatalf("cancel of the queued request: %d cancelled, err %v, queue length %d", n, err, f.callQueue.Len())
+	}
+	if result := f.waitResult(t, reqB); result.Outcome != OutcomeCancelled {
+		t.Errorf("queued request outcome is %s, want %s", result.Outcome, OutcomeCancelled)
+	}
+
+	// the dialed call has no call ID yet: it's hung up as soon as the ID is known
+	n, err = f.OnHangupRequest("", reqA)
+	if err != nil || n != 1 {
+		t.Fatalf("cancel of the pending dial: %d cancelled, err %v", n, err)
+	}
+	if err := f.OnCallOutgoing(event("id-a", "sip:a@example.com")); err != nil {
+		t.Fatal(err)
+	}
+	if !f.hasCmd("hangup id-a") {
+		t.Errorf("pending dial not hung up, commands: %v", f.baresip.cmds)
+	}
+	closed := event("id-a", "sip:a@example.com")
+	closed.Param = "487 Request Terminated"
+	if err := f.OnCallClosed(closed); err != nil {
+		t.Fatal(err)
+	}
+	if result := f.waitResult(t, reqA); result.Outcome != OutcomeCancelled {
+		t.Errorf("call outcome is %s, want %s", result.Outcome, OutcomeCancelled)
+	}
+
+	if _, err := f.OnHangupRequest("", ""); !errors.Is(err, ErrNoMatchingCall) {
+		t.Errorf("hangup with nothing in progress returned %v, want %v", err, ErrNoMatchingCall)
+	}
+}
+
+func TestHangupCancelsEscalation(t *testing.T) {
+	f := newTestFSM(t, 1, 5)
+	id := f.dial(t, NewCallRequest{
+		DTMFMenu: "alarm",
+		Escalation: &EscalationChain{
+			Contacts:   []CallContact{{Name: "a", URI: "sip:a@example.com"}, {Name: "b", URI: "sip:b@example.com"}},
+			RetryDelay: time.Hour,
+		},
+	})
+	if err := f.OnCallOutgoing(event("id-a", "sip:a@example.com")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.OnCallClosed(event("id-a", "sip:a@example.com")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the chain is now waiting for its next attempt
+	n, err := f.OnHangupRequest("", id)
+	if err != nil || n != 1 {
+		t.Fatalf("cancel of the escalation: %d cancelled, err %v", n, err)
+	}
+	if result := f.waitResult(t, id); result.Outcome != OutcomeCancelled {
+		t.Errorf("escalation outcome is %s, want %s", result.Outcome, OutcomeCancelled)
+	}
+	if len(f.escalations) != 0 {
+		t.Errorf("%d escalations still running", len(f.escalations))
+	}
+}
+
+func TestLongMessagePolicy(t *testing.T) {
+	tests := []struct {
+		policy          LongMessagePolicy
+		wantDial        bool
+		wantRingLimit   time.Duration
+		wantTalkLimit   time.Duration
+		wantDurationSec float64
+	}{
+		{LongMessageReject, false, 0, 0, 120},
+		{LongMessageSplit, true, time.Minute, 2*time.Minute + audioDurationMargin, 0},
+		{LongMessageExtend, true, 2*time.Minute + audioDurationMargin, 2*time.Minute + audioDurationMargin, 0},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			f := newTestFSM(t, 1, 5)
+			f.longMessagePolicy = tt.policy
+			f.getAudioDuration = func(string) (time.Duration, error) { return 2 * time.Minute, nil }
+
+			reqID := f.dial(t, NewCallRequest{CalledNumber: "sip:a@example.com"})
+			if f.hasCmd("dial sip:a@example.com") != tt.wantDial {
+				t.Fatalf("dial sent: %v, want %v", !tt.wantDial, tt.wantDial)
+			}
+			if !tt.wantDial {
+				result := f.waitResult(t, reqID)
+				if result.Outcome != OutcomeMessageTooLong || result.AudioDurationSec != tt.wantDurationSec {
+					t.Errorf("got outcome %s and audio duration %.0fs, want %s and %.0fs",
+						result.Outcome, result.AudioDurationSec, OutcomeMessageTooLong, tt.wantDurationSec)
+				}
+				return
+			}
+
+			if err := f.OnCallOutgoing(event("id1", "sip:a@example.com")); err != nil {
+				t.Fatal(err)
+			}
+			call := f.calls["id1"]
+			if call.maxDuration != tt.wantRingLimit {
+				t.Errorf("ringing limit is %s, want %s", call.maxDuration, tt.wantRingLimit)
+			}
+			if err := f.OnCallEstablished(event("id1", "sip:a@example.com")); err != nil {
+				t.Fatal(err)
+			}
+			if call.maxDuration != tt.wantTalkLimit {
+				t.Errorf("talk limit is %s, want %s", call.maxDuration, tt.wantTalkLimit)
+			}
+		})
+	}
+
+	if _, err := ParseLongMessagePolicy("truncate"); err == nil {
+		t.Error("an invalid long message policy was accepted")
+	}
+}
+
+func TestLongMessagePlaybackDuration(t *testing.T) {
+	// the FSM allows 1 minute: the playback, plus the margin, must not exceed it
+	tests := []struct {
+		name     string
+		req      NewCallRequest
+		wantDial bool
+	}{
+		{"message only", NewCallRequest{}, true},
+		{"short lead-in", NewCallRequest{LeadInSilence: 5 * time.Second}, true},
+		{"long lead-in", NewCallRequest{LeadInSilence: 15 * time.Second}, false},
+		{"repeated", NewCallRequest{Repeat: 2}, false},
+		{"DTMF menu prompt", NewCallRequest{DTMFMenu: "alarm"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newTestFSM(t, 1, 5)
+			f.longMessagePolicy = LongMessageReject
+			// the first file measured is the message (45s), then the DTMF menu prompt (15s)
+			numFiles := 0
+			f.getAudioDuration = func(string) (time.Duration, error) {
+				numFiles++
+				if numFiles == 1 {
+					return 45 * time.Second, nil
+				}
+				return 15 * time.Second, nil
+			}
+
+			tt.req.CalledNumber = "sip:a@example.com"
+			f.dial(t, tt.req)
+			if f.hasCmd("dial sip:a@example.com") != tt.wantDial {
+				t.Errorf("dial sent: %v, want %v", !tt.wantDial, tt.wantDial)
+			}
+		})
+	}
+}
+
+func TestRepeatMessage(t *testing.T) {
+	// the silence files are generated in the cache directory of the test: compare only the file names
+	const message = "test-message.wav"
+	const silence = "silence_1000ms.wav"
+	tests := []struct {
+		name     string
+		req      NewCallRequest
+		wantPlay []string
+	}{
+		{"once", NewCallRequest{}, []string{message}},
+		{"with lead-in", NewCallRequest{LeadInSilence: time.Second}, []string{silence, message}},
+		{"twice", NewCallRequest{Repeat: 2}, []string{message, message}},
+		{"twice with pause", NewCallRequest{Repeat: 2, PauseBetween: time.Second, LeadInSilence: time.Second},
+			[]string{silence, message, silence, message}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newTestFSM(t, 1, 5)
+			tt.req.CalledNumber = "sip:a@example.com"
+			f.dial(t, tt.req)
+			ev := event("id1", "sip:a@example.com")
+			if err := f.OnCallOutgoing(ev); err != nil {
+				t.Fatal(err)
+			}
+			f.baresip.reset()
+			if err := f.OnCallEstablished(ev); err != nil {
+				t.Fatal(err)
+			}
+			for range tt.wantPlay {
+				if err := f.OnEndOfFile(ev); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var played []string
+			for _, cmd := range f.baresip.cmds {
+				if strings.HasPrefix(cmd, "ausrc ") {
+					played = append(played, filepath.Base(cmd))
+				}
+			}
+			if strings.Join(played, "|") != strings.Join(tt.wantPlay, "|") {
+				t.Errorf("played %v, want %v", played, tt.wantPlay)
+			}
+			if !f.hasCmd("hangup id1") {
+				t.Error("the call was not hung up after the last repetition")
+			}
+		})
+	}
+
+	t.Run("till the end of the call", func(t *testing.T) {
+		f := newTestFSM(t, 1, 5)
+		f.dial(t, NewCallRequest{CalledNumber: "sip:a@example.com", Repeat: -1})
+		ev := event("id1", "sip:a@example.com")
+		if err := f.OnCallOutgoing(ev); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.OnCallEstablished(ev); err != nil {
+			t.Fatal(err)
+		}
+		for range 10 {
+			if err := f.OnEndOfFile(ev); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if f.hasCmd("hangup id1") || f.calls["id1"].playbacks != 10 {
+			t.Errorf("the message must be repeated till the end of the call, commands %v", f.baresip.cmds)
+		}
+	})
+}
+
+func TestContactTTSOptions(t *testing.T) {
+	e := escalationState{request: NewCallRequest{
+		ID:         "esc",
+		MessageTTS: "intruder detected",
+		TTS:        tts.EngineOptions{Voice: "alarm-voice"},
+		Escalation: &EscalationChain{Contacts: []CallContact{
+			{Name: "A", URI: "sip:a@example.com", TTS: tts.EngineOptions{Language: "it-IT", Voice: "paola"}},
+			{Name: "B", URI: "sip:b@example.com"},
+		}},
+	}}
+
+	want := []tts.EngineOptions{{Language: "it-IT", Voice: "alarm-voice"}, {Voice: "alarm-voice"}}
+	for i, w := range want {
+		step := e.nextStep()
+		e.attempts++
+		if step.TTS.Language != w.Language || step.TTS.Voice != w.Voice {
+			t.Errorf("step %d has TTS options %+v, want %+v", i+1, step.TTS, w)
+		}
+	}
+}
+
+func TestDialFirst(t *testing.T) {
+	const message = "ausrc aufile,/usr/share/baresip/test-message.wav"
+	const holdTone = "ausrc aufile,/hold.wav"
+	const fallback = "ausrc aufile,/fallback.wav"
+	tests := []struct {
+		name         string
+		ttsErr       error
+		wantPlay     []string
+		wantFallback bool
+	}{
+		{"audio ready", nil, []string{holdTone, holdTone, message}, false},
+		{"TTS failure", errors.New("TTS engine unavailable"), []string{holdTone, holdTone, fallback}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newTestFSM(t, 1, 5)
+			f.EnableDialFirst("/hold.wav", "/fallback.wav")
+			receipt, err := f.OnNewOutgoingCallRequest(NewCallRequest{CalledNumber: "sip:a@example.com", MessageTTS: "test message"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the call is dialed without waiting for the TTS workers
+			if !f.hasCmd("dial sip:a@example.com") || len(f.pendingDials) != 1 {
+				t.Fatalf("call not dialed at once, commands %v", f.baresip.cmds)
+			}
+			jobID := f.pendingDials[0].ttsJobID
+
+			// the call is answered before the audio is ready: the hold tone is played, and again at its end
+			ev := event("id1", "sip:a@example.com")
+			if err := f.OnCallOutgoing(ev); err != nil {
+				t.Fatal(err)
+			}
+			if err := f.OnCallEstablished(ev); err != nil {
+				t.Fatal(err)
+			}
+			if err := f.OnEndOfFile(ev); err != nil {
+				t.Fatal(err)
+			}
+
+			result := TTSResult{JobID: jobID, AudioFile: "/usr/share/baresip/test-message.wav", Err: tt.ttsErr}
+			if err := f.OnTTSCompleted(result); err != nil {
+				t.Fatal(err)
+			}
+			if err := f.OnEndOfFile(ev); err != nil {
+				t.Fatal(err)
+			}
+			if err := f.OnCallClosed(ev); err != nil {
+				t.Fatal(err)
+			}
+
+			var played []string
+			for _, cmd := range f.baresip.cmds {
+				if strings.HasPrefix(cmd, "ausrc ") {
+					played = append(played, cmd)
+				}
+			}
+			if strings.Join(played, "|") != strings.Join(tt.wantPlay, "|") {
+				t.Errorf("played %v, want %v", played, tt.wantPlay)
+			}
+			if !f.hasCmd("hangup id1") {
+				t.Errorf("call not hung up at the end of the audio")
+			}
+			r := f.waitResult(t, receipt.RequestID)
+			if r.Outcome != OutcomeAnswered || r.AudioFallback != tt.wantFallback {
+				t.Errorf("result %+v, want answered with audio fallback %v", r, tt.wantFallback)
+			}
+		})
+	}
+}
+
+func TestDialFirstFallbackAcknowledged(t *testing.T) {
+	f := newTestFSM(t, 1, 5)
+	f.EnableDialFirst("/hold.wav", "/fallback.wav")
+	receipt, err := f.OnNewOutgoingCallRequest(NewCallRequest{CalledNumber: "sip:a@example.com", MessageTTS: "test message", DTMFMenu: "alarm"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobID := f.pendingDials[0].ttsJobID
+	ev := event("id1", "sip:a@example.com")
+	if err := f.OnCallOutgoing(ev); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.OnCallEstablished(ev); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.OnTTSCompleted(TTSResult{JobID: jobID, Err: errors.New("TTS engine unavailable")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the fallback file replaces both the message and the missing prompt of the DTMF menu
+	f.baresip.reset()
+	if err := f.OnEndOfFile(ev); err != nil {
+		t.Fatal(err)
+	}
+	if !f.hasCmd("ausrc aufile,/fallback.wav") {
+		t.Fatalf("fallback file not played as prompt, commands %v", f.baresip.cmds)
+	}
+	dtmf := ev
+	dtmf.Param = "1"
+	if err := f.OnDTMF(dtmf); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.OnCallClosed(ev); err != nil {
+		t.Fatal(err)
+	}
+	if r := f.waitResult(t, receipt.RequestID); !r.Acknowledged || !r.AudioFallback {
+		t.Errorf("result %+v, want acknowledged with audio fallback", r)
+	}
+}
+
+func TestRequestsRejectedWhenNotRegistered(t *testing.T) {
+	f := newTestFSM(t, 1, 5)
+	if err := f.OnRegisterFail(gobaresip.EventMsg{AccountAOR: testAccountAOR}); err != nil {
+		t.Fatal(err)
+	}
+	_, err := f.OnNewOutgoingCallRequest(NewCallRequest{CalledNumber: "sip:a@example.com", MessageTTS: "test message"})
+	if !errors.Is(err, ErrNotRegistered) || f.callQueue.Len() != 0 {
+		t.Errorf("request while not registered returned %v with %d queued requests, want %v", err, f.callQueue.Len(), ErrNotRegistered)
+	}
+}
+
+func TestBaresipDisconnected(t *testing.T) {
+	f := newTestFSM(t, 1, 5)
+	first := f.dial(t, NewCallRequest{CalledNumber: "sip:a@example.com"})
+	_ = f.OnCallOutgoing(event("call-a", "sip:a@example.com"))
+	_ = f.OnCallEstablished(event("call-a", "sip:a@example.com"))
+	queued, err := f.OnNewOutgoingCallRequest(NewCallRequest{CalledNumber: "sip:b@example.com", MessageTTS: "test message"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// baresip gets restarted: the call in progress fails, the queued request is kept
+	if err := f.OnBaresipDisconnected(); err != nil {
+		t.Fatal(err)
+	}
+	if r := f.waitResult(t, first); r.Outcome != OutcomeBaresipDisconnected {
+		t.Errorf("got outcome %s, want %s", r.Outcome, OutcomeBaresipDisconnected)
+	}
+	if f.GetCurrentState() != Uninitialized || f.numActiveCalls() != 0 || f.callQueue.Len() != 1 {
+		t.Fatalf("got state %s with %d calls and %d queued requests, want Uninitialized with only the queued request",
+			f.GetCurrentState(), f.numActiveCalls(), f.callQueue.Len())
+	}
+	if _, err := f.OnNewOutgoingCallRequest(NewCallRequest{CalledNumber: "sip:c@example.com", MessageTTS: "test message"}); !errors.Is(err, ErrNotConnected) {
+		t.Errorf("request while disconnected returned %v, want %v", err, ErrNotConnected)
+	}
+
+	// on reconnection the User Agent is created again and the queued request is served
+	f.baresip.reset()
+	f.baresip.restart()
+	if err := f.InitializeUserAgents(); err != nil {
+		t.Fatal(err)
+	}
+	if !f.hasCmd("uanew <" + testAccountAOR + ">;auth_pass=secret") {
+		t.Errorf("User Agent not created again, commands: %v", f.baresip.cmds)
+	}
+	if err := f.OnRegisterOk(gobaresip.EventMsg{AccountAOR: testAccountAOR}); err != nil {
+		t.Fatal(err)
+	}
+	f.waitTTS(t)
+	if !f.hasCmd("dial sip:b@example.com") || f.callQueue.Len() != 0 {
+		t.Errorf("queued request [%s] not dialed after the reconnection, commands: %v", queued.RequestID, f.baresip.cmds)
+	}
+}
+
+func TestBaresipControlSocketDropped(t *testing.T) {
+	f := newTestFSM(t, 1, 5)
+
+	// only the control socket drops: baresip still has the User Agent, which must not be duplicated
+	if err := f.OnBaresipDisconnected(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.InitializeUserAgents(); err != nil {
+		t.Fatal(err)
+	}
+	for _, cmd := range f.baresip.cmds {
+		if strings.HasPrefix(cmd, "uanew ") {
+			t.Errorf("User Agent created again while baresip still has it, commands: %v", f.baresip.cmds)
+		}
+	}
+	if !f.hasCmd("uafind "+testAccountAOR) || !f.hasCmd("uareg 3600") {
+		t.Errorf("User Agent not registered again, commands: %v", f.baresip.cmds)
+	}
+	if err := f.OnRegisterOk(gobaresip.EventMsg{AccountAOR: testAccountAOR}); err != nil {
+		t.Fatal(err)
+	}
+	if f.GetCurrentState() != WaitingInputs {
+		t.Errorf("got state %s after the registration, want WaitingInputs", f.GetCurrentState())
+	}
+}
+
+func TestChooseAccount(t *testing.T) {
+	tests := []struct {
+		name        string
+		account     string
+		registered  [2]bool // registration state of the accounts "main" and "backup"
+		failover    bool
+		wantAccount string // empty if no account can be used
+	}{
+		{"default account", "", [2]bool{true, true}, false, "main"},
+		{"requested by name", "backup", [2]bool{true, true}, false, "backup"},
+		{"requested by AOR", "<sip:Backup@example.com;transport=tcp>", [2]bool{true, true}, false, "backup"},
+		{"default not registered", "", [2]bool{false, true}, false, ""},
+		{"default not registered with failover", "", [2]bool{false, true}, true, "backup"},
+		{"requested not registered with failover", "backup", [2]bool{true, false}, true, "main"},
+		{"none registered with failover", "", [2]bool{false, false}, true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newTestFSM(t, 1, 5)
+			f.accounts = []*sipAccount{
+				{name: "main", uri: "<sip:main@example.com>", registered: tt.registered[0]},
+				{name: "backup", uri: "<sip:backup@example.com>", registered: tt.registered[1]},
+			}
+			f.accountFailover = tt.failover
+
+			chosen := f.chooseAccount(&NewCallRequest{ID: "r1", Account: tt.account})
+			got := ""
+			if chosen != nil {
+				got = chosen.name
+			}
+			if got != tt.wantAccount {
+				t.Errorf("chose account %q, want %q", got, tt.wantAccount)
+			}
+		})
+	}
+}
+
+func TestRegistrationSupervisor(t *testing.T) {
+	f := newTestFSM(t, 1, 5)
+	f.SetRegistrationPolicy(RegistrationPolicy{
+		Timeout:       30 * time.Second,
+		Interval:      time.Hour,
+		RetryDelay:    10 * time.Second,
+		RetryMaxDelay: 25 * time.Second,
+		NotifyAfter:   15 * time.Minute,
+	})
+	account := f.accounts[0]
+	retryIn := func() time.Duration {
+		return time.Until(account.nextAttempt).Round(time.Second)
+	}
+
+	// a failed registration is retried after the initial delay, re-registering the User Agent
+	if err := f.OnRegisterFail(gobaresip.EventMsg{AccountAOR: testAccountAOR}); err != nil {
+		t.Fatal(err)
+	}
+	if f.GetCurrentState() != WaitingUserAgentRegistration || retryIn() != 10*time.Second {
+		t.Fatalf("got state %s and retry in %s, want WaitingUserAgentRegistration and 10s", f.GetCurrentState(), retryIn())
+	}
+	account.nextAttempt = time.Now().Add(-time.Second)
+	f.OnTimeoutTicker()
+	if !f.hasCmd("uafind "+testAccountAOR) || !f.hasCmd("uareg 3600") || account.attemptTime.IsZero() {
+		t.Fatalf("registration not retried, commands: %v", f.baresip.cmds)
+	}
+
+	// registrations without an outcome time out, and the delay doubles up to the max
+	for _, want := range []time.Duration{20 * time.Second, 25 * time.Second} {
+		account.attemptTime = time.Now().Add(-31 * time.Second)
+		f.OnTimeoutTicker()
+		if retryIn() != want {
+			t.Errorf("after %d failures got retry in %s, want %s", account.numFailures, retryIn(), want)
+		}
+		account.nextAttempt = time.Now().Add(-time.Second)
+		f.OnTimeoutTicker()
+	}
+
+	// a notification is raised once the account has been failing for too long, then dismissed
+	account.failingSince = time.Now().Add(-16 * time.Minute)
+	f.OnTimeoutTicker()
+	if !account.notified {
+		t.Error("no notification raised for the account failing for 16 minutes")
+	}
+	if err := f.OnRegisterOk(gobaresip.EventMsg{AccountAOR: testAccountAOR}); err != nil {
+		t.Fatal(err)
+	}
+	status := f.GetStatus().Accounts[0]
+	if f.GetCurrentState() != WaitingInputs || account.notified || status.Failures != 0 || status.ExpiresAt.IsZero() {
+		t.Fatalf("got state %s and account status %+v after the registration", f.GetCurrentState(), status)
+	}
+
+	// a registration not refreshed in time is considered lost
+	account.registeredAt = time.Now().Add(-2 * time.Hour)
+	f.OnTimeoutTicker()
+	if account.registered || f.GetCurrentState() != WaitingUserAgentRegistration || retryIn() != 10*time.Second {
+		t.Errorf("expired registration not detected: state %s, status %+v", f.GetCurrentState(), f.GetStatus().Accounts[0])
+	}
+}
+
+func TestIncomingCallPublished(t *testing.T) {
+	f := newTestFSM(t, 1, 5)
+	if err := f.OnCallIncoming(event("in1", "sip:caller@example.com")); err != nil {
+		t.Fatal(err)
+	}
+	if !f.hasCmd("hangup in1") {
+		t.Errorf("incoming call not rejected, commands %v", f.baresip.cmds)
+	}
+
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case n := <-f.notifCh:
+			change, ok := n.(StateChange)
+			if !ok || change.IncomingCall == nil {
+				continue
+			}
+			if change.IncomingCall.PeerURI != "sip:caller@example.com" || change.IncomingCall.Action != IncomingCallReject || change.State != WaitingInputs {
+				t.Errorf("unexpected incoming call notification: %+v %+v", change, change.IncomingCall)
+			}
+			return
+		case <-timeout:
+			t.Fatal("no notification published for the incoming call")
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package fsm
+
+import (
+	"fmt"
+	"time"
+)
+
+// callGroup tracks a call request with multiple recipients, which are called in parallel
+// (within the limit of the max number of concurrent calls)
+type callGroup struct {
+	// the original request, holding the list of recipients
+	request NewCallRequest
+	// results of the calls completed so far
+	results []CallResult
+}
+
+// startGroup starts one call for each recipient of the given request, queueing the calls
+// that exceed the max number of concurrent calls
+func (fsm *VoipClientFSM) startGroup(newRequest NewCallRequest) (CallRequestReceipt, error) {
+	// only the recipients that cannot be called immediately need space in the queue
+	toQueue := len(newRequest.Recipients) - fsm.freeCallSlots()
+	if toQueue > 0 && fsm.callQueue.Free() < toQueue {
+		fsm.logger.WarnPkgf(fsm.getLogPrefix(), "Cannot accept call request [%s] with %d recipients: %s",
+			newRequest.ID, len(newRequest.Recipients), ErrQueueFull)
+		return CallRequestReceipt{}, ErrQueueFull
+	}
+
+	// register the group before starting any call, since calls might complete immediately
+	fsm.groups[newRequest.ID] = &callGroup{request: newRequest}
+
+	var firstStepID string
+	for i, recipient := range newRequest.Recipients {
+		step := NewCallRequest{
+			ID:            fmt.Sprintf("%s-%d", newRequest.ID, i+1),
+			CalledNumber:  recipient.URI,
+			CalledContact: recipient.Name,
+			MessageTTS:    newRequest.MessageTTS,
+			AudioFile:     newRequest.AudioFile,
+			AudioURL:      newRequest.AudioURL,
+			TTS:           newRequest.TTS.WithDefaults(recipient.TTS),
+			DTMFMenu:      newRequest.DTMFMenu,
+			Account:       newRequest.Account,
+			MaxDuration:   newRequest.MaxDuration,
+			Repeat:        newRequest.Repeat,
+			PauseBetween:  newRequest.PauseBetween,
+			LeadInSilence: newRequest.LeadInSilence,
+			CreatedAt:     time.Now(),
+			ExpiresAt:     newRequest.ExpiresAt,
+			GroupID:       newRequest.ID,
+		}
+		if i == 0 {
+			firstStepID = step.ID
+		}
+		// the queue has enough space, no error can happen here
+		_, _ = fsm.callQueue.Push(step)
+
+		// start the call right away if possible, to free up the queue for the next recipients
+		fsm.serveQueuedRequests()
+	}
+
+	fsm.logger.InfoPkgf(fsm.getLogPrefix(), "Started call request [%s] towards %d recipients", newRequest.ID, len(newRequest.Recipients))
+
+	return CallRequestReceipt{RequestID: newRequest.ID, QueuePosition: fsm.callQueue.Position(firstStepID)}, nil
+}
+
+// onGroupCallCompleted is invoked when one of the calls of a group is over
+func (fsm *VoipClientFSM) onGroupCallCompleted(step NewCallRequest, result CallResult) {
+	g := fsm.groups[step.GroupID]
+	if g == nil {
+		// this happens e.g. for calls loaded from the persisted queue after a restart
+		return
+	}
+
+	g.results = append(g.results, result)
+	if len(g.results) < len(g.request.Recipients) {
+		return
+	}
+	delete(fsm.groups, step.GroupID)
+
+	// the group is answered if at least one recipient answered
+	groupResult := CallResult{
+		RequestID: g.request.ID,
+		Outcome:   g.results[0].Outcome,
+		Calls:     g.results,
+	}
+	for _, r := range g.results {
+		if r.Outcome == OutcomeAnswered {
+			groupResult.Outcome = OutcomeAnswered
+		}
+		if r.Acknowledged {
+			groupResult.Acknowledged = true
+			groupResult.AcknowledgedBy = r.CalledContact
+		}
+	}
+
+	fsm.logger.InfoPkgf(fsm.getLogPrefix(), "All %d calls of request [%s] completed with outcome [%s]",
+		len(g.results), g.request.ID, groupResult.Outcome)
+	fsm.stateChangesPubCh.Submit(StateChange{
+		State:     fsm.currentState,
+		RequestID: g.request.ID,
+		Result:    &groupResult,
+	})
+}
@@ -0,0 +1,98 @@
+package fsm
+
+import (
+	"fmt"
+	"regexp"
+
+	"voip-client-backend/pkg/config"
+)
+
+// IncomingCallAction is what the [VoipClientFSM] does with an incoming call
+type IncomingCallAction string
+
+const (
+	// IncomingCallReject hangs up the incoming call immediately
+	IncomingCallReject IncomingCallAction = "reject"
+	// IncomingCallIgnore lets the incoming call ring until the caller gives up
+	IncomingCallIgnore IncomingCallAction = "ignore"
+	// IncomingCallAnswer answers the incoming call and plays a message
+	IncomingCallAnswer IncomingCallAction = "answer"
+)
+
+// IncomingCallRule associates an [IncomingCallAction] to all callers whose URI matches a pattern
+type IncomingCallRule struct {
+	CallerPattern *regexp.Regexp
+	Action        IncomingCallAction
+	// only for IncomingCallAnswer: the message to play, either from TTS or from a WAV file
+	MessageTTS string
+	AudioFile  string
+}
+
+// IncomingCallPolicy is the ordered list of [IncomingCallRule]s to apply to incoming calls.
+// The first rule matching the caller URI wins; if no rule matches, the default rule is used.
+type IncomingCallPolicy struct {
+	rules       []IncomingCallRule
+	defaultRule IncomingCallRule
+}
+
+func parseIncomingCallAction(s string) (IncomingCallAction, error) {
+	switch IncomingCallAction(s) {
+	case IncomingCallReject, IncomingCallIgnore, IncomingCallAnswer:
+		return IncomingCallAction(s), nil
+	default:
+		return "", fmt.Errorf("invalid incoming call action [%s]: valid values are 'reject', 'ignore' and 'answer'", s)
+	}
+}
+
+// NewIncomingCallPolicy validates the incoming call rules from the addon configuration.
+func NewIncomingCallPolicy(rules []config.AddonIncomingCallRule, defaultAction string) (*IncomingCallPolicy, error) {
+	p := &IncomingCallPolicy{
+		defaultRule: IncomingCallRule{Action: IncomingCallReject},
+	}
+
+	if defaultAction != "" {
+		action, err := parseIncomingCallAction(defaultAction)
+		if err != nil {
+			return nil, err
+		}
+		if action == IncomingCallAnswer {
+			return nil, fmt.Errorf("the default incoming call action cannot be 'answer': please define a rule with a message to play")
+		}
+		p.defaultRule.Action = action
+	}
+
+	for i, r := range rules {
+		action, err := parseIncomingCallAction(r.Action)
+		if err != nil {
+			return nil, fmt.Errorf("incoming call rule #%d: %w", i+1, err)
+		}
+
+		pattern, err := regexp.Compile(r.Caller)
+		if err != nil {
+			return nil, fmt.Errorf("incoming call rule #%d: invalid caller regular expression [%s]: %w", i+1, r.Caller, err)
+		}
+
+		if action == IncomingCallAnswer && r.MessageTTS == "" && r.AudioFile == "" {
+			return nil, fmt.Errorf("incoming call rule #%d: action 'answer' requires either 'message_tts' or 'audio_file'", i+1)
+		}
+
+		p.rules = append(p.rules, IncomingCallRule{
+			CallerPattern: pattern,
+			Action:        action,
+			MessageTTS:    r.MessageTTS,
+			AudioFile:     r.AudioFile,
+		})
+	}
+
+	return p, nil
+}
+
+// Match returns the rule to apply to a call coming from the given caller URI
+func (p *IncomingCallPolicy) Match(callerURI string) IncomingCallRule {
+	for _, r := range p.rules {
+		if r.CallerPattern.MatchString(callerURI) {
+			return r
+		}
+	}
+	return p.defaultRule
+}
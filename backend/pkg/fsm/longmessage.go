@@ -0,0 +1,84 @@
+package fsm
+
+import (
+	"fmt"
+	"time"
+)
+
+// LongMessagePolicy decides what happens to call requests whose audio message is longer than
+// the maximum duration of the call
+type LongMessagePolicy string
+
+const (
+	// LongMessageReject fails the call request without dialing
+	LongMessageReject LongMessagePolicy = "reject"
+	// LongMessageSplit keeps the max duration for the ringing phase and extends only the time
+	// allowed once the call has been established, so that the whole message can be played
+	LongMessageSplit LongMessagePolicy = "split"
+	// LongMessageExtend extends the max duration of both the ringing phase and the established call
+	LongMessageExtend LongMessagePolicy = "extend"
+)
+
+// audioDurationMargin is added to the duration of the audio message when extending the timeout,
+// to account for the time baresip needs to start the playback
+const audioDurationMargin = 3 * time.Second
+
+// ParseLongMessagePolicy validates the policy from the addon configuration
+func ParseLongMessagePolicy(s string) (LongMessagePolicy, error) {
+	switch LongMessagePolicy(s) {
+	case LongMessageReject, LongMessageSplit, LongMessageExtend:
+		return LongMessagePolicy(s), nil
+	default:
+		return "", fmt.Errorf("invalid long message policy [%s]: valid values are 'reject', 'split' and 'extend'", s)
+	}
+}
+
+// checkAudioDuration compares the time needed to play the audio message of the given call, with all
+// its repetitions, pauses and lead-in silence, followed by the prompt of its DTMF menu, if any, with
+// its max duration and applies the long message policy; it returns false if the call must not be dialed
+func (fsm *VoipClientFSM) checkAudioDuration(call *activeCall) bool {
+	var err error
+	call.audioDuration, err = fsm.getAudioDuration(call.audioFile)
+	if err != nil {
+		// baresip will anyway try to play it: do not block the call
+		fsm.logger.WarnPkgf(fsm.getCallLogPrefix(call), "Cannot read the duration of the audio file [%s]: %s", call.audioFile, err)
+		return true
+	}
+
+	req := call.request
+	repeat := req.repetitions()
+	if repeat < 0 {
+		// the message is repeated till the end of the call: the max duration decides when to stop
+		return true
+	}
+	playback := req.LeadInSilence + time.Duration(repeat)*call.audioDuration + time.Duration(repeat-1)*req.PauseBetween
+	if call.menuNode != nil {
+		// once the message is over, the prompt of the DTMF menu is played
+		promptFile := call.menuPromptFiles[call.menuNode.Name]
+		promptDuration, err := fsm.getAudioDuration(promptFile)
+		if err != nil {
+			fsm.logger.WarnPkgf(fsm.getCallLogPrefix(call), "Cannot read the duration of the audio file [%s]: %s", promptFile, err)
+		}
+		playback += promptDuration
+	}
+	required := playback + audioDurationMargin
+	if required <= call.maxDuration {
+		return true
+	}
+
+	switch fsm.longMessagePolicy {
+	case LongMessageReject:
+		fsm.logger.WarnPkgf(fsm.getCallLogPrefix(call), "Playing the audio message takes %s, longer than the max duration of the call (%s): rejecting the call request. Increase 'max_duration' or change 'long_message' to play it.",
+			playback, call.maxDuration)
+		return false
+	case LongMessageExtend:
+		fsm.logger.WarnPkgf(fsm.getCallLogPrefix(call), "Playing the audio message takes %s, longer than the max duration of the call (%s): extending the max duration to %s",
+			playback, call.maxDuration, required)
+		call.maxDuration = required
+	default:
+		fsm.logger.WarnPkgf(fsm.getCallLogPrefix(call), "Playing the audio message takes %s, longer than the max duration of the call (%s): the call will be allowed to last %s once established",
+			playback, call.maxDuration, required)
+		call.talkDuration = required
+	}
+	return true
+}
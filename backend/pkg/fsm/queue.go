@@ -0,0 +1,197 @@
+package fsm
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"voip-client-backend/pkg/logger"
+)
+
+const queueLogPrefix = "fsm-queue"
+
+/*
+CallRequestQueue is a bounded FIFO of [NewCallRequest]s that could not be served immediately
+because the [VoipClientFSM] was busy (e.g. with another call) or not yet registered.
+The queue is persisted as a JSON file after every change, so that pending requests survive
+an addon restart.
+Requests older than the configured max age, or past their own expiry time, are considered
+expired and are discarded.
+Note that this type is not thread-safe, just like [VoipClientFSM].
+*/
+type CallRequestQueue struct {
+	// config
+	maxDepth int
+	maxAge   time.Duration
+	filePath string
+
+	// link to other objects
+	logger *logger.CustomLogger
+
+	// the queued requests, oldest first
+	items []NewCallRequest
+}
+
+// NewCallRequestQueue creates a new queue and loads from filePath any request persisted
+// by a previous instance of the addon. An empty filePath disables persistence.
+func NewCallRequestQueue(logger *logger.CustomLogger, maxDepth int, maxAge time.Duration, filePath string) *CallRequestQueue {
+	q := &CallRequestQueue{
+		maxDepth: maxDepth,
+		maxAge:   maxAge,
+		filePath: filePath,
+		logger:   logger,
+	}
+	q.load()
+	return q
+}
+
+// Len returns the number of requests currently queued.
+func (q *CallRequestQueue) Len() int {
+	return len(q.items)
+}
+
+// Free returns the number of requests that can still be queued.
+func (q *CallRequestQueue) Free() int {
+	return q.maxDepth - len(q.items)
+}
+
+// Position returns the 1-based position of the request with the given ID, or 0 if
+// the request is not queued.
+func (q *CallRequestQueue) Position(requestID string) int {
+	for i, req := range q.items {
+		if req.ID == requestID {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// Push appends a new request at the end of the queue and returns its 1-based position.
+func (q *CallRequestQueue) Push(req NewCallRequest) (int, error) {
+	if len(q.items) >= q.maxDepth {
+		return 0, ErrQueueFull
+	}
+
+	q.items = append(q.items, req)
+	q.save()
+	return len(q.items), nil
+}
+
+// Pop removes and returns the oldest non-expired request, if any.
+// Expired requests found on the way are discarded and returned as second value.
+func (q *CallRequestQueue) Pop() (*NewCallRequest, []NewCallRequest) {
+	expired := q.PurgeExpired()
+	if len(q.items) == 0 {
+		return nil, expired
+	}
+
+	req := q.items[0]
+	q.items = q.items[1:]
+	q.save()
+	return &req, expired
+}
+
+// Remove removes from the queue all requests selected by the given function and returns them.
+func (q *CallRequestQueue) Remove(match func(NewCallRequest) bool) []NewCallRequest {
+	var removed []NewCallRequest
+	kept := q.items[:0]
+	for _, req := range q.items {
+		if match(req) {
+			removed = append(removed, req)
+		} else {
+			kept = append(kept, req)
+		}
+	}
+	q.items = kept
+
+	if len(removed) > 0 {
+		q.save()
+	}
+	return removed
+}
+
+// isExpired returns true if the given request has its own expiry time and it's past, or if it
+// has no expiry time and it's older than the configured max age
+func (q *CallRequestQueue) isExpired(req NewCallRequest, now time.Time) bool {
+	if !req.ExpiresAt.IsZero() {
+		return now.After(req.ExpiresAt)
+	}
+	return now.Sub(req.CreatedAt) > q.maxAge
+}
+
+// PurgeExpired removes from the queue all expired requests and returns them.
+func (q *CallRequestQueue) PurgeExpired() []NewCallRequest {
+	var expired []NewCallRequest
+	now := time.Now()
+	valid := q.items[:0]
+	for _, req := range q.items {
+		if q.isExpired(req, now) {
+			q.logger.WarnPkgf(queueLogPrefix, "Call request [%s] to [%s] expired after waiting %s in the queue. Discarding it.",
+				req.ID, req.CalledNumber, now.Sub(req.CreatedAt).Round(time.Second).String())
+			expired = append(expired, req)
+		} else {
+			valid = append(valid, req)
+		}
+	}
+	q.items = valid
+
+	if len(expired) > 0 {
+		q.save()
+	}
+	return expired
+}
+
+func (q *CallRequestQueue) load() {
+	if q.filePath == "" {
+		return
+	}
+
+	data, err := os.ReadFile(q.filePath)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			q.logger.WarnPkgf(queueLogPrefix, "Error reading persisted call queue from [%s]: %s", q.filePath, err)
+		}
+		return
+	}
+
+	var items []NewCallRequest
+	if err := json.Unmarshal(data, &items); err != nil {
+		q.logger.WarnPkgf(queueLogPrefix, "Error parsing persisted call queue from [%s]: %s. Starting with an empty queue.", q.filePath, err)
+		return
+	}
+
+	// never load more than the configured depth, the config might have changed since last run
+	if len(items) > q.maxDepth {
+		items = items[:q.maxDepth]
+	}
+	q.items = items
+	q.logger.InfoPkgf(queueLogPrefix, "Loaded %d pending call requests from [%s]", len(q.items), q.filePath)
+}
+
+func (q *CallRequestQueue) save() {
+	if q.filePath == "" {
+		return
+	}
+
+	data, err := json.Marshal(q.items)
+	if err != nil {
+		q.logger.WarnPkgf(queueLogPrefix, "Error serializing call queue: %s", err)
+		return
+	}
+
+	// write to a temporary file and then rename it, to avoid leaving a truncated file around
+	if err := os.MkdirAll(filepath.Dir(q.filePath), 0750); err != nil {
+		q.logger.WarnPkgf(queueLogPrefix, "Error creating directory for call queue file [%s]: %s", q.filePath, err)
+		return
+	}
+	tmpPath := q.filePath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		q.logger.WarnPkgf(queueLogPrefix, "Error writing call queue file [%s]: %s", tmpPath, err)
+		return
+	}
+	if err := os.Rename(tmpPath, q.filePath); err != nil {
+		q.logger.WarnPkgf(queueLogPrefix, "Error renaming call queue file [%s]: %s", tmpPath, err)
+	}
+}
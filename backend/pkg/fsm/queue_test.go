@@ -0,0 +1,103 @@
+package fsm
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"voip-client-backend/pkg/logger"
+)
+
+func newTestQueue(t *testing.T, maxDepth int, filePath string) *CallRequestQueue {
+	t.Helper()
+	return NewCallRequestQueue(logger.NewCustomLogger("test"), maxDepth, time.Minute, filePath)
+}
+
+func TestCallRequestQueuePushPop(t *testing.T) {
+	q := newTestQueue(t, 2, "")
+	for i, id := range []string{"first", "second"} {
+		pos, err := q.Push(NewCallRequest{ID: id, CreatedAt: time.Now()})
+		if err != nil || pos != i+1 {
+			t.Fatalf("Push(%s) = %d, %v; want %d, nil", id, pos, err, i+1)
+		}
+	}
+	if _, err := q.Push(NewCallRequest{ID: "third", CreatedAt: time.Now()}); err != ErrQueueFull {
+		t.Errorf("Push on a full queue returned %v, want %v", err, ErrQueueFull)
+	}
+	if q.Free() != 0 || q.Position("second") != 2 || q.Position("third") != 0 {
+		t.Errorf("unexpected queue state: free %d, positions %d %d", q.Free(), q.Position("second"), q.Position("third"))
+	}
+
+	for _, id := range []string{"first", "second"} {
+		req, expired := q.Pop()
+		if req == nil || req.ID != id || len(expired) != 0 {
+			t.Fatalf("Pop() = %v, %v; want %s", req, expired, id)
+		}
+	}
+	if req, _ := q.Pop(); req != nil {
+		t.Errorf("Pop() on an empty queue returned %v", req)
+	}
+}
+
+func TestCallRequestQueuePurgeExpired(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name        string
+		req         NewCallRequest
+		wantExpired bool
+	}{
+		{"fresh", NewCallRequest{CreatedAt: now}, false},
+		{"older than max age", NewCallRequest{CreatedAt: now.Add(-2 * time.Minute)}, true},
+		{"own expiry in the future", NewCallRequest{CreatedAt: now.Add(-2 * time.Minute), ExpiresAt: now.Add(time.Minute)}, false},
+		{"own expiry in the past", NewCallRequest{CreatedAt: now, ExpiresAt: now.Add(-time.Second)}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newTestQueue(t, 5, "")
+			tt.req.ID = "req"
+			_, _ = q.Push(tt.req)
+
+			expired := q.PurgeExpired()
+			if got := len(expired) == 1; got != tt.wantExpired {
+				t.Errorf("expired = %v, want %v", got, tt.wantExpired)
+			}
+			if got := q.Len() == 0; got != tt.wantExpired {
+				t.Errorf("request removed from the queue = %v, want %v", got, tt.wantExpired)
+			}
+		})
+	}
+}
+
+func TestCallRequestQueuePopDiscardsExpired(t *testing.T) {
+	q := newTestQueue(t, 5, "")
+	_, _ = q.Push(NewCallRequest{ID: "old", CreatedAt: time.Now().Add(-time.Hour)})
+	_, _ = q.Push(NewCallRequest{ID: "new", CreatedAt: time.Now()})
+
+	req, expired := q.Pop()
+	if req == nil || req.ID != "new" || len(expired) != 1 || expired[0].ID != "old" {
+		t.Errorf("Pop() = %v, %v; want [new] and expired [old]", req, expired)
+	}
+}
+
+func TestCallRequestQueueLoad(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "queue.json")
+	q := newTestQueue(t, 5, filePath)
+	for _, id := range []string{"a", "b", "c"} {
+		_, _ = q.Push(NewCallRequest{ID: id, CalledNumber: "sip:" + id + "@example.com", CreatedAt: time.Now()})
+	}
+
+	// a new instance loads the persisted requests, up to its max depth
+	loaded := newTestQueue(t, 2, filePath)
+	if loaded.Len() != 2 || loaded.Position("a") != 1 || loaded.Position("b") != 2 {
+		t.Errorf("unexpected requests loaded: len %d", loaded.Len())
+	}
+	req, _ := loaded.Pop()
+	if req == nil || req.CalledNumber != "sip:a@example.com" {
+		t.Errorf("unexpected request loaded: %+v", req)
+	}
+
+	// a missing file means an empty queue
+	if empty := newTestQueue(t, 5, filepath.Join(t.TempDir(), "missing.json")); empty.Len() != 0 {
+		t.Errorf("queue loaded from a missing file has %d requests", empty.Len())
+	}
+}
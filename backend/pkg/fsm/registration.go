@@ -0,0 +1,211 @@
+package fsm
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"voip-client-backend/pkg/metrics"
+
+	"github.com/f18m/go-baresip/pkg/gobaresip"
+)
+
+// defaultRegistrationInterval is the registration interval used by baresip when none is configured
+const defaultRegistrationInterval = 3600 * time.Second
+
+// RegistrationPolicy configures the supervision of the registration of the SIP accounts.
+// Without a policy, see [VoipClientFSM.SetRegistrationPolicy], the FSM relies only on baresip,
+// which retries failed registrations on its own schedule.
+type RegistrationPolicy struct {
+	// Timeout is the max time waited for the outcome of a registration started by the FSM;
+	// zero means waiting forever
+	Timeout time.Duration
+	// Interval is the registration interval requested to the registrar; a registration not
+	// refreshed within Interval (plus Timeout) is considered lost.
+	// Zero keeps the baresip default and disables the expiry check.
+	Interval time.Duration
+	// RetryDelay is the delay before retrying a failed registration, doubled at every
+	// consecutive failure up to RetryMaxDelay; zero disables the retries
+	RetryDelay    time.Duration
+	RetryMaxDelay time.Duration
+	// NotifyAfter is how long an account can stay unregistered before a persistent notification
+	// is raised in Home Assistant; zero disables the notification
+	NotifyAfter time.Duration
+}
+
+// SetRegistrationPolicy enables the supervision of the registrations: registrations that fail,
+// time out or expire are retried with an exponential backoff, re-creating the User Agent if needed,
+// and a persistent notification is raised in Home Assistant if an account stays unregistered too long.
+// It must be invoked before [VoipClientFSM.InitializeUserAgents].
+func (fsm *VoipClientFSM) SetRegistrationPolicy(policy RegistrationPolicy) {
+	fsm.registration = policy
+}
+
+// startRegistration creates the User Agent of the given account, if baresip does not have it yet, or asks
+// baresip to register it again; the outcome is reported by the REGISTER_OK and REGISTER_FAIL events
+func (fsm *VoipClientFSM) startRegistration(account *sipAccount) error {
+	account.attemptTime = time.Now()
+	account.nextAttempt = time.Time{}
+	metrics.SIPRegistrationAttempts.WithLabelValues(sipAOR(account.uri)).Inc()
+
+	// baresip still has the User Agent if only the connection to its control socket was lost, while
+	// it has none after a restart: creating it again would add a duplicate User Agent.
+	// uafind also makes the account the current one inside baresip, which is used by the uareg command
+	var err error
+	if fsm.hasUserAgent(account) {
+		fsm.logger.InfoPkgf(fsm.getLogPrefix(), "Registering again User Agent [%s], attempt %d", account, account.numFailures+1)
+		account.uaCreated = true
+		_, err = fsm.baresipHandle.CmdTxWithAck(gobaresip.CommandMsg{
+			Command: "uareg",
+			Params:  fmt.Sprintf("%d", int(fsm.registrationInterval().Seconds())),
+		})
+	} else {
+		if account.uaCreated {
+			fsm.logger.InfoPkgf(fsm.getLogPrefix(), "User Agent [%s] not found in baresip, it has probably been restarted", account)
+		}
+		fsm.logger.InfoPkgf(fsm.getLogPrefix(), "Initializing User Agent [%s]", account)
+		params := fmt.Sprintf("%s;auth_pass=%s", account.uri, account.password)
+		if fsm.registration.Interval > 0 {
+			params += fmt.Sprintf(";regint=%d", int(fsm.registration.Interval.Seconds()))
+		}
+		_, err = fsm.baresipHandle.CmdTxWithAck(gobaresip.CommandMsg{Command: "uanew", Params: params})
+		account.uaCreated = err == nil
+	}
+	if err != nil {
+		fsm.logger.WarnPkgf(fsm.getLogPrefix(), "Failed to start the registration of User Agent [%s]: %s", account, err)
+		fsm.onRegistrationFailed(account, err.Error())
+	}
+	return err
+}
+
+// hasUserAgent returns true if baresip has the User Agent of the given account
+func (fsm *VoipClientFSM) hasUserAgent(account *sipAccount) bool {
+	resp, err := fsm.baresipHandle.CmdUafind(sipAOR(account.uri))
+	return err == nil && resp.Ok
+}
+
+// registrationInterval returns the registration interval requested to the registrar
+func (fsm *VoipClientFSM) registrationInterval() time.Duration {
+	if fsm.registration.Interval > 0 {
+		return fsm.registration.Interval
+	}
+	return defaultRegistrationInterval
+}
+
+// onRegistrationSucceeded updates the given account after a successful registration
+func (fsm *VoipClientFSM) onRegistrationSucceeded(account *sipAccount) {
+	now := time.Now()
+	account.registered = true
+	account.lastChange = now
+	account.registeredAt = now
+	account.attemptTime = time.Time{}
+	account.nextAttempt = time.Time{}
+	account.numFailures = 0
+	account.lastError = ""
+	account.failingSince = time.Time{}
+	metrics.SIPRegistered.WithLabelValues(sipAOR(account.uri)).Set(1)
+
+	if account.notified {
+		account.notified = false
+		fsm.haClient.DismissPersistentNotificationAsync(registrationNotificationID(account))
+	}
+}
+
+// onRegistrationFailed updates the given account after a failed, timed out or expired registration,
+// scheduling the next retry, and goes back to WaitingUserAgentRegistration if no account is registered
+func (fsm *VoipClientFSM) onRegistrationFailed(account *sipAccount, reason string) {
+	now := time.Now()
+	if account.registered {
+		metrics.SIPRegistrationFlaps.WithLabelValues(sipAOR(account.uri)).Inc()
+	}
+	account.registered = false
+	account.lastChange = now
+	account.attemptTime = time.Time{}
+	account.numFailures++
+	account.lastError = reason
+	if account.failingSince.IsZero() {
+		account.failingSince = now
+	}
+	metrics.SIPRegistered.WithLabelValues(sipAOR(account.uri)).Set(0)
+
+	if fsm.registration.RetryDelay > 0 {
+		delay := fsm.registration.RetryDelay << min(account.numFailures-1, 16)
+		if fsm.registration.RetryMaxDelay > 0 {
+			delay = min(delay, fsm.registration.RetryMaxDelay)
+		}
+		account.nextAttempt = now.Add(delay)
+		fsm.logger.InfoPkgf(fsm.getLogPrefix(), "Registration of [%s] will be retried in %s", account, delay)
+	}
+
+	if fsm.numRegisteredAccounts() == 0 && (fsm.currentState == WaitingInputs || fsm.currentState == CallsInProgress) {
+		// in this state any communication will fail... go back to the initial state
+		fsm.transitionTo(WaitingUserAgentRegistration)
+	}
+}
+
+// superviseRegistrations checks the registration of each account, retrying the registrations
+// that failed, timed out or expired, and raises a persistent notification for the accounts that
+// have been failing for too long; it is invoked periodically
+func (fsm *VoipClientFSM) superviseRegistrations() {
+	now := time.Now()
+	for _, account := range fsm.accounts {
+		fsm.notifyRegistrationFailures(account, now)
+		if fsm.currentState == Uninitialized {
+			// the User Agents will be created again once baresip is connected
+			continue
+		}
+
+		switch {
+		case !account.attemptTime.IsZero():
+			if fsm.registration.Timeout > 0 && now.Sub(account.attemptTime) > fsm.registration.Timeout {
+				fsm.logger.WarnPkgf(fsm.getLogPrefix(), "No outcome for the registration of [%s] after %s", account, fsm.registration.Timeout)
+				fsm.onRegistrationFailed(account, fmt.Sprintf("no answer from the registrar within %s", fsm.registration.Timeout))
+			}
+
+		case account.registered:
+			if fsm.registration.Interval > 0 && now.After(fsm.registrationExpiry(account).Add(fsm.registration.Timeout)) {
+				fsm.logger.WarnPkgf(fsm.getLogPrefix(), "The registration of [%s] expired at %s without being refreshed",
+					account, fsm.registrationExpiry(account).Format(time.RFC3339))
+				fsm.onRegistrationFailed(account, "registration expired without being refreshed")
+			}
+
+		case !account.nextAttempt.IsZero() && !now.Before(account.nextAttempt):
+			_ = fsm.startRegistration(account)
+		}
+	}
+}
+
+// notifyRegistrationFailures raises a persistent notification in Home Assistant if the given
+// account has been unregistered for longer than allowed by the policy
+func (fsm *VoipClientFSM) notifyRegistrationFailures(account *sipAccount, now time.Time) {
+	if fsm.registration.NotifyAfter <= 0 || account.notified || account.failingSince.IsZero() ||
+		now.Sub(account.failingSince) < fsm.registration.NotifyAfter {
+		return
+	}
+
+	account.notified = true
+	failingFor := now.Sub(account.failingSince).Round(time.Second)
+	fsm.logger.WarnPkgf(fsm.getLogPrefix(), "The registration of [%s] has been failing for %s: notifying Home Assistant", account, failingFor)
+	message := fmt.Sprintf("The SIP account %s has not been registered for %s, so it cannot make or receive calls.", account, failingFor)
+	if account.lastError != "" {
+		message += fmt.Sprintf(" Last error: %s.", account.lastError)
+	}
+	fsm.haClient.CreatePersistentNotificationAsync(registrationNotificationID(account), "VOIP client: SIP registration failing", message)
+}
+
+// registrationExpiry returns the time at which the registration of the given account expires,
+// unless refreshed
+func (fsm *VoipClientFSM) registrationExpiry(account *sipAccount) time.Time {
+	return account.registeredAt.Add(fsm.registrationInterval())
+}
+
+// registrationNotificationID returns the ID of the persistent notification about the given account
+func registrationNotificationID(account *sipAccount) string {
+	id := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, strings.ToLower(sipAOR(account.uri)))
+	return "voip_client_registration_" + id
+}
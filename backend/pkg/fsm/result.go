@@ -0,0 +1,144 @@
+package fsm
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CallOutcome is the final outcome of a call request
+type CallOutcome string
+
+const (
+	OutcomeAnswered    CallOutcome = "answered"
+	OutcomeBusy        CallOutcome = "busy"
+	OutcomeNoAnswer    CallOutcome = "no-answer"
+	OutcomeRejected    CallOutcome = "rejected"
+	OutcomeTTSFailure  CallOutcome = "tts-failure"
+	OutcomeDialFailure CallOutcome = "dial-failure"
+	OutcomeTimeout     CallOutcome = "timeout"
+	// OutcomeMessageTooLong is used for requests rejected because of the long message policy
+	OutcomeMessageTooLong CallOutcome = "message-too-long"
+	// OutcomeExpired is used for requests discarded from the call queue without ever being dialed
+	OutcomeExpired CallOutcome = "expired"
+	// OutcomeCancelled is used for calls hung up and requests removed on request of the user
+	OutcomeCancelled CallOutcome = "cancelled"
+	// OutcomeBaresipDisconnected is used for calls in progress when the connection to baresip is lost
+	OutcomeBaresipDisconnected CallOutcome = "baresip-disconnected"
+)
+
+// CallResult describes how a call request has been processed by the [VoipClientFSM]
+type CallResult struct {
+	RequestID     string `json:"request_id"`
+	CallID        string `json:"call_id"`
+	CalledNumber  string `json:"called_number"`
+	CalledContact string `json:"called_contact,omitempty"`
+	// Account is the AOR of the SIP account used to dial the call
+	Account string      `json:"account,omitempty"`
+	Outcome CallOutcome `json:"outcome"`
+	// SIPCode and SIPReason are extracted from the reason provided by baresip when the call gets closed,
+	// e.g. "486 Busy Here"; SIPCode is zero if baresip did not provide any SIP response code
+	SIPCode   int    `json:"sip_code,omitempty"`
+	SIPReason string `json:"sip_reason,omitempty"`
+	// RingTimeSec is the time elapsed between the dial and the call establishment (or closure)
+	RingTimeSec float64 `json:"ring_time_sec"`
+	// TalkTimeSec is the time elapsed between the call establishment and its closure
+	TalkTimeSec float64 `json:"talk_time_sec"`
+	// AudioCompleted is true if the message has been played till its end at least once
+	AudioCompleted bool `json:"audio_completed"`
+	// AudioDurationSec is the duration of the audio message, if known
+	AudioDurationSec float64 `json:"audio_duration_sec,omitempty"`
+	// AudioFallback is true if the fallback audio file was played, since the message could not be
+	// prepared in time (dial-first mode only)
+	AudioFallback bool   `json:"audio_fallback,omitempty"`
+	DTMFDigits    string `json:"dtmf_digits,omitempty"`
+	Acknowledged  bool   `json:"acknowledged"`
+	// AcknowledgedBy is the name of the contact that acknowledged an escalation chain, if any
+	AcknowledgedBy string `json:"acknowledged_by,omitempty"`
+	// Calls contains the results of the individual calls, for requests with multiple recipients
+	Calls []CallResult `json:"calls,omitempty"`
+}
+
+// callTracker collects the information required to build the [CallResult] of the current call
+type callTracker struct {
+	dialTime        time.Time
+	establishedTime time.Time
+	closedTime      time.Time
+	outcome         CallOutcome // set as soon as the outcome is known for sure, e.g. on failures
+	sipCode         int
+	sipReason       string
+	audioCompleted  bool
+}
+
+// parseCloseReason splits the reason of a CALL_CLOSED event, e.g. "486 Busy Here", into
+// the SIP response code and the reason phrase
+func parseCloseReason(param string) (int, string) {
+	param = strings.TrimSpace(param)
+	codeStr, reason, _ := strings.Cut(param, " ")
+	code, err := strconv.Atoi(codeStr)
+	if err != nil || code < 100 || code > 699 {
+		return 0, param
+	}
+	return code, reason
+}
+
+// outcomeFromSIPCode classifies the SIP response code of a call that was never established
+func outcomeFromSIPCode(code int) CallOutcome {
+	switch code {
+	case 486, 600:
+		return OutcomeBusy
+	case 403, 603:
+		return OutcomeRejected
+	case 0, 408, 480, 487:
+		return OutcomeNoAnswer
+	default:
+		return OutcomeDialFailure
+	}
+}
+
+// onClosed records the closure of the call
+func (t *callTracker) onClosed(param string) {
+	t.closedTime = time.Now()
+	t.sipCode, t.sipReason = parseCloseReason(param)
+}
+
+// finalOutcome returns the outcome of the call, deducing it from the call events when not explicitly set
+func (t *callTracker) finalOutcome() CallOutcome {
+	if t.outcome != "" {
+		return t.outcome
+	}
+	if !t.establishedTime.IsZero() {
+		return OutcomeAnswered
+	}
+	if t.dialTime.IsZero() {
+		return OutcomeDialFailure
+	}
+	return outcomeFromSIPCode(t.sipCode)
+}
+
+// ringTime returns the time spent before the call got established or closed
+func (t *callTracker) ringTime() time.Duration {
+	if t.dialTime.IsZero() {
+		return 0
+	}
+	end := t.establishedTime
+	if end.IsZero() {
+		end = t.closedTime
+	}
+	if end.IsZero() {
+		end = time.Now()
+	}
+	return end.Sub(t.dialTime)
+}
+
+// talkTime returns the time spent with the call established
+func (t *callTracker) talkTime() time.Duration {
+	if t.establishedTime.IsZero() {
+		return 0
+	}
+	end := t.closedTime
+	if end.IsZero() {
+		end = time.Now()
+	}
+	return end.Sub(t.establishedTime)
+}
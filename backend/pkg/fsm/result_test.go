@@ -0,0 +1,71 @@
+package fsm
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCloseReason(t *testing.T) {
+	tests := []struct {
+		param      string
+		wantCode   int
+		wantReason string
+	}{
+		{"486 Busy Here", 486, "Busy Here"},
+		{" 603 Decline ", 603, "Decline"},
+		{"408", 408, ""},
+		{"Connection reset by user", 0, "Connection reset by user"},
+		{"99 Too Low", 0, "99 Too Low"},
+		{"700 Too High", 0, "700 Too High"},
+		{"", 0, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.param, func(t *testing.T) {
+			code, reason := parseCloseReason(tt.param)
+			if code != tt.wantCode || reason != tt.wantReason {
+				t.Errorf("parseCloseReason(%q) = %d, %q; want %d, %q", tt.param, code, reason, tt.wantCode, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestFinalOutcome(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name    string
+		tracker callTracker
+		want    CallOutcome
+	}{
+		{"explicit outcome wins", callTracker{outcome: OutcomeTimeout, dialTime: now, establishedTime: now}, OutcomeTimeout},
+		{"established", callTracker{dialTime: now, establishedTime: now, sipCode: 486}, OutcomeAnswered},
+		{"never dialed", callTracker{}, OutcomeDialFailure},
+		{"busy", callTracker{dialTime: now, sipCode: 486}, OutcomeBusy},
+		{"busy everywhere", callTracker{dialTime: now, sipCode: 600}, OutcomeBusy},
+		{"declined", callTracker{dialTime: now, sipCode: 603}, OutcomeRejected},
+		{"forbidden", callTracker{dialTime: now, sipCode: 403}, OutcomeRejected},
+		{"request timeout", callTracker{dialTime: now, sipCode: 408}, OutcomeNoAnswer},
+		{"no SIP code", callTracker{dialTime: now}, OutcomeNoAnswer},
+		{"server error", callTracker{dialTime: now, sipCode: 500}, OutcomeDialFailure},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.tracker.finalOutcome(); got != tt.want {
+				t.Errorf("finalOutcome() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCallTrackerOnClosed(t *testing.T) {
+	tracker := callTracker{dialTime: time.Now()}
+	tracker.onClosed("480 Temporarily Unavailable")
+	if tracker.sipCode != 480 || tracker.sipReason != "Temporarily Unavailable" || tracker.closedTime.IsZero() {
+		t.Errorf("unexpected tracker after closure: %+v", tracker)
+	}
+	if got := tracker.finalOutcome(); got != OutcomeNoAnswer {
+		t.Errorf("finalOutcome() = %s, want %s", got, OutcomeNoAnswer)
+	}
+	if tracker.talkTime() != 0 {
+		t.Errorf("talkTime() = %s for a call never established", tracker.talkTime())
+	}
+}
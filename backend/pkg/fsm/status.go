@@ -0,0 +1,103 @@
+package fsm
+
+import "time"
+
+// AccountStatus describes the registration state of one of the SIP accounts
+type AccountStatus struct {
+	Name       string    `json:"name,omitempty"`
+	AOR        string    `json:"aor"`
+	Registered bool      `json:"registered"`
+	LastChange time.Time `json:"last_change,omitzero"`
+	// RegistrationAgeSec is the time elapsed since the last successful registration, if registered
+	RegistrationAgeSec float64   `json:"registration_age_sec,omitempty"`
+	ExpiresAt          time.Time `json:"expires_at,omitzero"`
+	// FailingSince is the time of the first failure since the account was last registered
+	FailingSince time.Time `json:"failing_since,omitzero"`
+	Failures     int       `json:"failures,omitempty"`
+	LastError    string    `json:"last_error,omitempty"`
+	NextAttempt  time.Time `json:"next_attempt,omitzero"`
+}
+
+// CallStatus describes one of the calls in progress
+type CallStatus struct {
+	CallID        string  `json:"call_id"`
+	RequestID     string  `json:"request_id,omitempty"`
+	Direction     string  `json:"direction"`
+	PeerURI       string  `json:"peer_uri"`
+	CalledContact string  `json:"called_contact,omitempty"`
+	Account       string  `json:"account,omitempty"`
+	State         string  `json:"state"`
+	DurationSec   float64 `json:"duration_sec"`
+}
+
+// Status is a snapshot of the state of the [VoipClientFSM]
+type Status struct {
+	State              string          `json:"state"`
+	Registered         bool            `json:"registered"`
+	Accounts           []AccountStatus `json:"accounts"`
+	NumDialCmds        int             `json:"num_dial_cmds"`
+	MaxConcurrentCalls int             `json:"max_concurrent_calls"`
+	ActiveCalls        []CallStatus    `json:"active_calls"`
+	QueueLength        int             `json:"queue_length"`
+	Escalations        int             `json:"escalations_in_progress"`
+}
+
+// GetStatus returns a snapshot of the FSM state; like all other methods of the FSM, it must
+// be invoked from the FSM goroutine
+func (fsm *VoipClientFSM) GetStatus() Status {
+	s := Status{
+		State:              fsm.currentState.String(),
+		Registered:         fsm.numRegisteredAccounts() > 0,
+		Accounts:           make([]AccountStatus, 0, len(fsm.accounts)),
+		NumDialCmds:        fsm.numDialCmds,
+		MaxConcurrentCalls: fsm.maxConcurrentCalls,
+		ActiveCalls:        make([]CallStatus, 0, fsm.numActiveCalls()),
+		QueueLength:        fsm.callQueue.Len(),
+		Escalations:        len(fsm.escalations),
+	}
+
+	for _, a := range fsm.accounts {
+		as := AccountStatus{
+			Name:         a.name,
+			AOR:          sipAOR(a.uri),
+			Registered:   a.registered,
+			LastChange:   a.lastChange,
+			FailingSince: a.failingSince,
+			Failures:     a.numFailures,
+			LastError:    a.lastError,
+			NextAttempt:  a.nextAttempt,
+		}
+		if a.registered {
+			as.RegistrationAgeSec = time.Since(a.registeredAt).Seconds()
+			as.ExpiresAt = fsm.registrationExpiry(a)
+		}
+		s.Accounts = append(s.Accounts, as)
+	}
+
+	for _, call := range fsm.allCalls() {
+		cs := CallStatus{
+			CallID:  call.id,
+			PeerURI: call.peerURI,
+			State:   call.state.String(),
+		}
+		if call.request != nil {
+			cs.Direction = "outgoing"
+			cs.RequestID = call.request.ID
+			cs.CalledContact = call.request.CalledContact
+			if cs.PeerURI == "" {
+				cs.PeerURI = call.request.CalledNumber
+			}
+		} else {
+			cs.Direction = "incoming"
+		}
+		if call.account != nil {
+			cs.Account = sipAOR(call.account.uri)
+		}
+		if !call.tracker.dialTime.IsZero() {
+			cs.DurationSec = time.Since(call.tracker.dialTime).Seconds()
+		}
+		s.ActiveCalls = append(s.ActiveCalls, cs)
+	}
+
+	return s
+}
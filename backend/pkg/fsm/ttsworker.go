@@ -0,0 +1,187 @@
+package fsm
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"voip-client-backend/pkg/logger"
+	"voip-client-backend/pkg/tts"
+)
+
+const ttsWorkerLogPrefix = "fsm-tts"
+
+// maxAcquireAttempts is the max number of times an audio file is prepared, if it keeps being evicted
+// from the cache before the call can acquire it
+const maxAcquireAttempts = 3
+
+// ttsJobQueueSize is the max number of jobs waiting for a worker and of results waiting for the FSM;
+// the FSM never prepares more calls than the max number of concurrent calls, so it's never reached
+const ttsJobQueueSize = 64
+
+// ttsJob describes all the audio files to prepare before a call can start
+type ttsJob struct {
+	id    uint64
+	audio tts.AudioRequest
+	// menuPrompts are the prompts of the DTMF menu, indexed by menu name
+	menuPrompts   map[string]string
+	leadInSilence time.Duration
+	pauseSilence  time.Duration
+}
+
+// TTSResult is produced by the [TTSWorkerPool] once all the audio files of a call are ready,
+// or as soon as one of them cannot be prepared.
+// The audio files are acquired from the cache, so that they cannot be evicted while the call uses
+// them: they must be released once the call completes.
+type TTSResult struct {
+	JobID           uint64
+	AudioFile       string
+	MenuPromptFiles map[string]string
+	LeadInFile      string
+	PauseFile       string
+	Err             error
+}
+
+// files returns all the audio files of the result
+func (r *TTSResult) files() []string {
+	files := []string{r.AudioFile, r.LeadInFile, r.PauseFile}
+	for _, f := range r.MenuPromptFiles {
+		files = append(files, f)
+	}
+	return slices.DeleteFunc(files, func(f string) bool { return f == "" })
+}
+
+// TTSWorkerPool runs the TTS conversions, and the downloads of the audio files, outside of the
+// FSM goroutine, so that a slow TTS engine never delays the processing of the baresip events.
+// The results must be read from [TTSWorkerPool.GetResultChannel] by the FSM goroutine and passed
+// to [VoipClientFSM.OnTTSCompleted].
+type TTSWorkerPool struct {
+	logger     *logger.CustomLogger
+	ttsService *tts.TTSService
+	numWorkers int
+
+	jobs    chan ttsJob
+	results chan TTSResult
+}
+
+func NewTTSWorkerPool(logger *logger.CustomLogger, ttsService *tts.TTSService, numWorkers int) *TTSWorkerPool {
+	return &TTSWorkerPool{
+		logger:     logger,
+		ttsService: ttsService,
+		numWorkers: max(1, numWorkers),
+		jobs:       make(chan ttsJob, ttsJobQueueSize),
+		results:    make(chan TTSResult, ttsJobQueueSize),
+	}
+}
+
+// GetResultChannel returns the channel where the results of the jobs are published
+func (p *TTSWorkerPool) GetResultChannel() <-chan TTSResult {
+	return p.results
+}
+
+// Run starts the workers and blocks until the given context is cancelled
+func (p *TTSWorkerPool) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for range p.numWorkers {
+		wg.Go(func() { p.work(ctx) })
+	}
+	wg.Wait()
+}
+
+// submit enqueues the given job without blocking; it returns false if the queue is full
+func (p *TTSWorkerPool) submit(job ttsJob) bool {
+	select {
+	case p.jobs <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *TTSWorkerPool) work(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case job := <-p.jobs:
+			result := p.prepare(job)
+			select {
+			case p.results <- result:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// prepare produces, and acquires, all the audio files of the given job
+func (p *TTSWorkerPool) prepare(job ttsJob) TTSResult {
+	result := TTSResult{JobID: job.id}
+	err := p.prepareFiles(job, &result)
+	if err != nil {
+		p.release(result.files())
+		result = TTSResult{JobID: job.id, Err: err}
+	}
+	return result
+}
+
+func (p *TTSWorkerPool) prepareFiles(job ttsJob, result *TTSResult) error {
+	var err error
+
+	// ask TTS to generate the WAV file, or fetch the pre-recorded one, and get its path
+	result.AudioFile, err = p.getFile(func() (string, error) { return p.ttsService.GetAudio(job.audio) })
+	if err != nil {
+		return fmt.Errorf("error preparing the audio file: %w", err)
+	}
+
+	// prepare also the prompts of the DTMF menu, so that navigating the menu is quick;
+	// they are spoken by the same TTS engine and voice of the message
+	if len(job.menuPrompts) > 0 {
+		result.MenuPromptFiles = make(map[string]string, len(job.menuPrompts))
+		for name, prompt := range job.menuPrompts {
+			promptAudio := tts.AudioRequest{Message: prompt, Engine: job.audio.Engine}
+			result.MenuPromptFiles[name], err = p.getFile(func() (string, error) { return p.ttsService.GetAudio(promptAudio) })
+			if err != nil {
+				return fmt.Errorf("error doing the Text-to-Speech conversion of DTMF menu [%s]: %w", name, err)
+			}
+		}
+	}
+
+	// prepare the silence to play before the message and between its repetitions
+	if job.leadInSilence > 0 {
+		result.LeadInFile, err = p.getFile(func() (string, error) { return p.ttsService.GetSilenceFile(job.leadInSilence) })
+	}
+	if err == nil && job.pauseSilence > 0 {
+		result.PauseFile, err = p.getFile(func() (string, error) { return p.ttsService.GetSilenceFile(job.pauseSilence) })
+	}
+	if err != nil {
+		return fmt.Errorf("error preparing the silence to play: %w", err)
+	}
+	return nil
+}
+
+// getFile produces an audio file using the given function and acquires it, so that it cannot be
+// evicted from the cache while the call uses it; the file is produced again if it gets evicted
+// before being acquired, e.g. to make room for the files of another call
+func (p *TTSWorkerPool) getFile(get func() (string, error)) (string, error) {
+	for range maxAcquireAttempts {
+		path, err := get()
+		if err != nil {
+			return "", err
+		}
+		if p.ttsService.AcquireFile(path) {
+			return path, nil
+		}
+		p.logger.WarnPkgf(ttsWorkerLogPrefix, "Audio file [%s] evicted from the cache before being used, preparing it again", path)
+	}
+	return "", fmt.Errorf("the audio file keeps being evicted from the cache: increase its max size")
+}
+
+// release marks the given audio files, acquired by the workers, as no longer used by a call
+func (p *TTSWorkerPool) release(files []string) {
+	for _, f := range files {
+		p.ttsService.ReleaseFile(f)
+	}
+}
@@ -0,0 +1,246 @@
+// Package homeassistant provides a minimal client for the Home Assistant Core REST API,
+// reached through the Supervisor proxy using the HASSIO_TOKEN provided to the addon,
+// and for the few Supervisor API endpoints needed by the addon.
+package homeassistant
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"voip-client-backend/pkg/logger"
+)
+
+const haApiUrl = "http://hassio/homeassistant/api"
+const supervisorApiUrl = "http://supervisor"
+const haHttpApiTimeout = 10 * time.Second
+const logPrefix = "homeassistant"
+
+// maxPendingRequests is the max number of state updates, events and service calls waiting to be sent in background
+const maxPendingRequests = 100
+
+// Client sends data to the Home Assistant Core REST API.
+// All its methods are safe to be used from multiple goroutines.
+type Client struct {
+	logger *logger.CustomLogger
+	apiURL string
+
+	// state updates, events and service calls to be sent in background, in order, by a single worker goroutine
+	requests chan haRequest
+}
+
+type haRequest struct {
+	path    string
+	payload any
+	name    string // used for logging, e.g. "event [voip_client_call_finished]"
+}
+
+// see https://developers.home-assistant.io/docs/api/rest/
+type haStatePayload struct {
+	State      string         `json:"state"`
+	Attributes map[string]any `json:"attributes,omitempty"`
+}
+
+func NewClient(logger *logger.CustomLogger) *Client {
+	c := &Client{
+		logger:   logger,
+		apiURL:   haApiUrl,
+		requests: make(chan haRequest, maxPendingRequests),
+	}
+	go c.sendRequests()
+	return c
+}
+
+// SetState creates or updates the state of the given entity, e.g. "sensor.voip_client_last_caller".
+// Note that entities created this way are not persisted by Home Assistant across its restarts.
+func (c *Client) SetState(entityID, state string, attributes map[string]any) error {
+	return c.post("/states/"+entityID, haStatePayload{
+		State:      state,
+		Attributes: attributes,
+	})
+}
+
+// SetStateAsync is like [Client.SetState] but runs in background; errors are just logged.
+// This is meant to be used by callers that must never block on Home Assistant, like the FSM.
+// Like [Client.FireEventAsync], state updates are sent in order, so that the last update wins.
+func (c *Client) SetStateAsync(entityID, state string, attributes map[string]any) {
+	c.enqueue(haRequest{
+		path: "/states/" + entityID,
+		payload: haStatePayload{
+			State:      state,
+			Attributes: attributes,
+		},
+		name: fmt.Sprintf("state of [%s]", entityID),
+	})
+}
+
+// FireEvent fires an event of the given type on the Home Assistant event bus;
+// automations can trigger on it using an "event" trigger.
+func (c *Client) FireEvent(eventType string, data map[string]any) error {
+	return c.post("/events/"+eventType, data)
+}
+
+// FireEventAsync is like [Client.FireEvent] but runs in background; errors are just logged.
+// Events are fired in the same order of the FireEventAsync invocations; if too many events
+// are pending, e.g. because Home Assistant is slow, the event is dropped rather than blocking.
+func (c *Client) FireEventAsync(eventType string, data map[string]any) {
+	c.enqueue(haRequest{path: "/events/" + eventType, payload: data, name: fmt.Sprintf("event [%s]", eventType)})
+}
+
+// CreatePersistentNotificationAsync shows a notification in the Home Assistant UI, which stays there
+// till it is dismissed by the user or by [Client.DismissPersistentNotificationAsync]; a notification
+// with the same ID is replaced. Like [Client.FireEventAsync], it runs in background, in order.
+func (c *Client) CreatePersistentNotificationAsync(notificationID, title, message string) {
+	c.enqueue(haRequest{
+		path: "/services/persistent_notification/create",
+		payload: map[string]any{
+			"notification_id": notificationID,
+			"title":           title,
+			"message":         message,
+		},
+		name: fmt.Sprintf("notification [%s]", notificationID),
+	})
+}
+
+// DismissPersistentNotificationAsync removes the notification created by [Client.CreatePersistentNotificationAsync]
+func (c *Client) DismissPersistentNotificationAsync(notificationID string) {
+	c.enqueue(haRequest{
+		path:    "/services/persistent_notification/dismiss",
+		payload: map[string]any{"notification_id": notificationID},
+		name:    fmt.Sprintf("dismissal of notification [%s]", notificationID),
+	})
+}
+
+// enqueue schedules the given request to be sent in background, dropping it rather than blocking
+func (c *Client) enqueue(req haRequest) {
+	select {
+	case c.requests <- req:
+	default:
+		c.logger.WarnPkgf(logPrefix, "Too many pending requests, dropping %s", req.name)
+	}
+}
+
+// sendRequests sends the requests queued by [Client.enqueue], one at a time
+func (c *Client) sendRequests() {
+	for req := range c.requests {
+		if err := c.post(req.path, req.payload); err != nil {
+			c.logger.WarnPkgf(logPrefix, "Failed to send %s: %s", req.name, err)
+		}
+	}
+}
+
+// MQTTService describes the MQTT broker made available by the Supervisor, e.g. by the Mosquitto addon
+type MQTTService struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	SSL      bool   `json:"ssl"`
+	Username string `json:"username"`
+	Password string `json:"password"` // #nosec G117 -- runtime-provided credentials
+}
+
+// see https://developers.home-assistant.io/docs/api/supervisor/endpoints/#service
+type supervisorResponse struct {
+	Result  string          `json:"result"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// GetMQTTService asks the Supervisor for the MQTT broker details; the addon must declare
+// the "mqtt" service in its configuration.
+func (c *Client) GetMQTTService() (*MQTTService, error) {
+	hassioToken := os.Getenv("HASSIO_TOKEN")
+	if hassioToken == "" {
+		return nil, fmt.Errorf("HASSIO_TOKEN environment variable is not set")
+	}
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), haHttpApiTimeout)
+	defer cancelFn()
+
+	url := supervisorApiUrl + "/services/mqtt"
+	c.logger.InfoPkgf(logPrefix, "Launching HTTP GET to the Supervisor [%s]", url)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+hassioToken)
+
+	client := &http.Client{}
+	// Suppress G704: SSRF via taint analysis (gosec)
+	// Reason: the base URL is hardcoded and points to the local Supervisor, see tts package
+	resp, err := client.Do(req) //nolint:gosec
+	if err != nil {
+		return nil, fmt.Errorf("error making request: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading response body: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error response from the Supervisor (HTTP %d): %s", resp.StatusCode, string(body))
+	}
+
+	var supervisorResp supervisorResponse
+	if err := json.Unmarshal(body, &supervisorResp); err != nil {
+		return nil, fmt.Errorf("error unmarshalling response: %w", err)
+	}
+	if supervisorResp.Result != "ok" {
+		return nil, fmt.Errorf("error response from the Supervisor: %s", supervisorResp.Message)
+	}
+	var service MQTTService
+	if err := json.Unmarshal(supervisorResp.Data, &service); err != nil {
+		return nil, fmt.Errorf("error unmarshalling MQTT service: %w", err)
+	}
+	return &service, nil
+}
+
+func (c *Client) post(path string, payload any) error {
+	hassioToken := os.Getenv("HASSIO_TOKEN")
+	if hassioToken == "" {
+		return fmt.Errorf("HASSIO_TOKEN environment variable is not set")
+	}
+
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("error marshalling payload: %w", err)
+	}
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), haHttpApiTimeout)
+	defer cancelFn()
+
+	url := c.apiURL + path
+	c.logger.InfoPkgf(logPrefix, "Launching HTTP POST to HomeAssistant [%s] with payload [%s]", url, payloadBytes)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payloadBytes))
+	if err != nil {
+		return fmt.Errorf("error creating request: %w", err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+hassioToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{}
+	// Suppress G704: SSRF via taint analysis (gosec)
+	// Reason: the base URL is hardcoded and points to the local Home Assistant instance, see tts package
+	resp, err := client.Do(req) //nolint:gosec
+	if err != nil {
+		return fmt.Errorf("error making request: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("error reading response body: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("error response from HomeAssistant (HTTP %d): %s", resp.StatusCode, string(body))
+	}
+
+	return nil
+}
@@ -0,0 +1,66 @@
+package homeassistant
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"voip-client-backend/pkg/logger"
+)
+
+func TestSetStateAsyncKeepsOrder(t *testing.T) {
+	t.Setenv("HASSIO_TOKEN", "test-token")
+
+	var mu sync.Mutex
+	var states []string
+	first := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload haStatePayload
+		_ = json.NewDecoder(r.Body).Decode(&payload)
+		mu.Lock()
+		slow := first
+		first = false
+		mu.Unlock()
+		if slow {
+			// an older update must not overtake the newer ones even if Home Assistant is slow
+			time.Sleep(100 * time.Millisecond)
+		}
+		mu.Lock()
+		states = append(states, payload.State)
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	c := NewClient(logger.NewCustomLogger("test"))
+	c.apiURL = server.URL
+	for i := range 5 {
+		c.SetStateAsync("sensor.voip_client_last_caller", fmt.Sprintf("sip:%d@test.com", i), nil)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		mu.Lock()
+		n := len(states)
+		mu.Unlock()
+		if n == 5 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(states) != 5 {
+		t.Fatalf("got %d state updates, want 5", len(states))
+	}
+	for i, state := range states {
+		if want := fmt.Sprintf("sip:%d@test.com", i); state != want {
+			t.Errorf("state update %d is %s, want %s", i, state, want)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"voip-client-backend/pkg/callrequest"
+	"voip-client-backend/pkg/fsm"
+)
+
+// HangupPayload selects the calls to cancel; if both fields are empty, all calls in progress
+// and all queued call requests are cancelled
+type HangupPayload struct {
+	CallID    string `json:"call_id"`
+	RequestID string `json:"request_id"`
+}
+
+// HangupResponse is the JSON body returned by the hangup endpoint
+type HangupResponse struct {
+	Cancelled int `json:"cancelled"`
+}
+
+func (h *HttpServer) serveHangup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		h.logger.InfoPkg(logPrefix, "Replying with HTTP 405: Only POST method is allowed, received "+r.Method)
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// the payload is optional: an empty body cancels everything
+	var payload HangupPayload
+	err := json.NewDecoder(r.Body).Decode(&payload)
+	if err != nil && !errors.Is(err, io.EOF) {
+		h.logger.InfoPkgf(logPrefix, "Replying with HTTP 400: invalid JSON payload: %s", err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.logger.InfoPkgf(logPrefix, "Received hangup payload: CallID=%s, RequestID=%s", payload.CallID, payload.RequestID)
+
+	reply := h.dispatcher.Hangup(payload.CallID, payload.RequestID)
+	if errors.Is(reply.Err, fsm.ErrNoMatchingCall) {
+		h.logger.InfoPkgf(logPrefix, "Replying with HTTP 404: %s", reply.Err.Error())
+		http.Error(w, reply.Err.Error(), http.StatusNotFound)
+		return
+	} else if errors.Is(reply.Err, callrequest.ErrFSMBusy) {
+		h.logger.InfoPkgf(logPrefix, "Replying with HTTP 503: %s", reply.Err.Error())
+		http.Error(w, reply.Err.Error(), http.StatusServiceUnavailable)
+		return
+	} else if reply.Err != nil {
+		h.logger.InfoPkgf(logPrefix, "Replying with HTTP 500: %s", reply.Err.Error())
+		http.Error(w, reply.Err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.logger.InfoPkgf(logPrefix, "Replying with HTTP 200: %d calls and call requests cancelled", reply.NumCancelled)
+	h.writeJSON(w, http.StatusOK, HangupResponse{Cancelled: reply.NumCancelled})
+}
@@ -0,0 +1,40 @@
+package httpserver
+
+import (
+	"net/http"
+
+	"voip-client-backend/pkg/metrics"
+)
+
+// serveMetrics exposes all metrics in the Prometheus text format
+func (h *HttpServer) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	if !h.allowOnlyGET(w, r) {
+		return
+	}
+	h.metricsHandler.ServeHTTP(w, r)
+}
+
+// metricsSnapshot reads the metrics owned by the FSM goroutine
+func (h *HttpServer) metricsSnapshot() (metrics.Snapshot, error) {
+	status := h.dispatcher.GetStatus()
+	if status.Err != nil {
+		h.logger.WarnPkgf(logPrefix, "Leaving the FSM metrics out of the scrape: %s", status.Err)
+		return metrics.Snapshot{}, status.Err
+	}
+	snapshot := metrics.Snapshot{
+		ActiveCalls:           len(status.FSM.ActiveCalls),
+		CallQueueLength:       status.FSM.QueueLength,
+		SIPRegistrationAge:    make(map[string]float64),
+		BaresipCommandsOK:     float64(status.Baresip.TxStats.SuccessfulCmds),
+		BaresipCommandsFailed: float64(status.Baresip.TxStats.FailedCmds),
+		BaresipPingsOK:        float64(status.Baresip.TxStats.SuccessfulPings),
+		BaresipPingsFailed:    float64(status.Baresip.TxStats.FailedPings),
+		BaresipDecodeFailures: float64(status.Baresip.RxStats.DecodeFailures),
+		BaresipEvents:         float64(status.Baresip.RxStats.EventMsgs),
+		BaresipResponses:      float64(status.Baresip.RxStats.ResponseMsgs),
+	}
+	for _, account := range status.FSM.Accounts {
+		snapshot.SIPRegistrationAge[account.AOR] = account.RegistrationAgeSec
+	}
+	return snapshot, nil
+}
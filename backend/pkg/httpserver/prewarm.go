@@ -0,0 +1,62 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"voip-client-backend/pkg/tts"
+)
+
+// PrewarmPayload lists the messages to convert into speech in advance; the optional TTS
+// options have the same meaning as in [callrequest.DialPayload]
+type PrewarmPayload struct {
+	Messages    []string       `json:"messages"`
+	TTSPlatform string         `json:"tts_platform"`
+	Language    string         `json:"language"`
+	Voice       string         `json:"voice"`
+	Options     map[string]any `json:"options"`
+}
+
+// PrewarmResponse is the JSON body returned by the prewarm endpoint
+type PrewarmResponse struct {
+	Results []tts.PrewarmResult `json:"results"`
+}
+
+func (h *HttpServer) servePrewarm(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		h.logger.InfoPkg(logPrefix, "Replying with HTTP 405: Only POST method is allowed, received "+r.Method)
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var payload PrewarmPayload
+	err := json.NewDecoder(r.Body).Decode(&payload)
+	if err == nil && len(payload.Messages) == 0 {
+		err = errors.New("messages is required")
+	}
+	if err != nil {
+		h.logger.InfoPkgf(logPrefix, "Replying with HTTP 400: invalid JSON payload: %s", err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.logger.InfoPkgf(logPrefix, "Received prewarm payload: %d messages", len(payload.Messages))
+
+	engine := tts.EngineOptions{
+		Platform: payload.TTSPlatform,
+		Language: payload.Language,
+		Voice:    payload.Voice,
+		Options:  payload.Options,
+	}
+	results := h.ttsService.Prewarm(payload.Messages, engine)
+
+	status := http.StatusOK
+	for _, result := range results {
+		if result.Error != "" {
+			// the TTS engine is unavailable or rejected the message
+			status = http.StatusBadGateway
+		}
+	}
+	h.logger.InfoPkgf(logPrefix, "Replying with HTTP %d to the prewarm request", status)
+	h.writeJSON(w, status, PrewarmResponse{Results: results})
+}
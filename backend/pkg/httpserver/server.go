@@ -5,50 +5,54 @@ import (
 	"fmt"
 	"io"
 	"net/http"
-	"regexp"
 	"time"
 
-	"voip-client-backend/pkg/config"
+	"voip-client-backend/pkg/callrequest"
 	"voip-client-backend/pkg/fsm"
 	"voip-client-backend/pkg/logger"
+	"voip-client-backend/pkg/metrics"
+	"voip-client-backend/pkg/tts"
 
 	"github.com/dustin/go-broadcast"
 )
 
 const logPrefix = "httpserver"
 const dialEndpoint = "/dial"
+const hangupEndpoint = "/hangup"
+const prewarmEndpoint = "/tts/prewarm"
+const statusEndpoint = "/status"
+const healthEndpoint = "/health"
+const statsEndpoint = "/stats"
+const metricsEndpoint = "/metrics"
 const httpClientUpdateInterval = 5 * time.Second
 
-type DialPayload struct {
-	CalledNumber  string `json:"called_number"`
-	CalledContact string `json:"called_contact"`
-	MessageTTS    string `json:"message_tts"`
+// DialSyncResponse is the JSON body returned by the dial endpoint in synchronous mode
+type DialSyncResponse struct {
+	RequestID     string          `json:"request_id"`
+	QueuePosition int             `json:"queue_position"`
+	Result        *fsm.CallResult `json:"result"`
 }
 
 type HttpServer struct {
-	logger           *logger.CustomLogger
-	server           *http.Server
-	contactLookupMap map[string]string // Maps contact names to their URIs
-	synchronous      bool
-
-	fsmStateSubCh broadcast.Broadcaster
-	outCh         chan DialPayload
+	logger      *logger.CustomLogger
+	server      *http.Server
+	synchronous bool
+
+	fsmStateSubCh  broadcast.Broadcaster
+	ttsService     *tts.TTSService
+	dispatcher     *callrequest.Dispatcher
+	metricsHandler http.Handler
 }
 
-func NewServer(logger *logger.CustomLogger, fsmStatePubSub broadcast.Broadcaster, contacts []config.AddonContact) HttpServer {
+func NewServer(logger *logger.CustomLogger, fsmStatePubSub broadcast.Broadcaster, dispatcher *callrequest.Dispatcher, ttsService *tts.TTSService) HttpServer {
 	h := HttpServer{
-		logger:           logger,
-		synchronous:      fsmStatePubSub != nil,
-		fsmStateSubCh:    fsmStatePubSub,
-		outCh:            make(chan DialPayload),
-		contactLookupMap: make(map[string]string),
-	}
-
-	// convert slice to map:
-	for _, contact := range contacts {
-		h.contactLookupMap[contact.Name] = contact.URI
-		h.logger.InfoPkgf(logPrefix, "Contact %s added with URI %s", contact.Name, contact.URI)
+		logger:        logger,
+		synchronous:   fsmStatePubSub != nil,
+		fsmStateSubCh: fsmStatePubSub,
+		ttsService:    ttsService,
+		dispatcher:    dispatcher,
 	}
+	h.metricsHandler = metrics.Handler(h.metricsSnapshot)
 
 	// Use the http.NewServeMux() function to create an empty servemux.
 	mux := http.NewServeMux()
@@ -57,6 +61,24 @@ func NewServer(logger *logger.CustomLogger, fsmStatePubSub broadcast.Broadcaster
 	mux.HandleFunc(dialEndpoint, func(w http.ResponseWriter, r *http.Request) {
 		h.serveDial(w, r)
 	})
+	mux.HandleFunc(hangupEndpoint, func(w http.ResponseWriter, r *http.Request) {
+		h.serveHangup(w, r)
+	})
+	mux.HandleFunc(prewarmEndpoint, func(w http.ResponseWriter, r *http.Request) {
+		h.servePrewarm(w, r)
+	})
+	mux.HandleFunc(statusEndpoint, func(w http.ResponseWriter, r *http.Request) {
+		h.serveStatus(w, r)
+	})
+	mux.HandleFunc(healthEndpoint, func(w http.ResponseWriter, r *http.Request) {
+		h.serveHealth(w, r)
+	})
+	mux.HandleFunc(statsEndpoint, func(w http.ResponseWriter, r *http.Request) {
+		h.serveStats(w, r)
+	})
+	mux.HandleFunc(metricsEndpoint, func(w http.ResponseWriter, r *http.Request) {
+		h.serveMetrics(w, r)
+	})
 
 	// Create a custom HTTP server with timeouts
 	h.server = &http.Server{
@@ -71,13 +93,18 @@ func NewServer(logger *logger.CustomLogger, fsmStatePubSub broadcast.Broadcaster
 	return h
 }
 
-func (h *HttpServer) waitForFSMState(desiredState fsm.FSMState, w http.ResponseWriter) {
-	ch := make(chan interface{})
-
-	// temporarily subscribe to the FSM state changes
+// subscribeFSM registers a new channel to the FSM state changes.
+// The returned channel must be released using [h.fsmStateSubCh.Unregister].
+func (h *HttpServer) subscribeFSM() chan interface{} {
+	// use a buffered channel: the broadcaster blocks while delivering to a slow subscriber
+	ch := make(chan interface{}, 16)
 	h.fsmStateSubCh.Register(ch)
-	defer h.fsmStateSubCh.Unregister(ch)
+	return ch
+}
 
+// waitForRequestCompletion blocks until the FSM completes the given request and returns its
+// result; nil is returned if the HTTP client disconnected in the meanwhile
+func (h *HttpServer) waitForRequestCompletion(requestID string, ch chan interface{}, w http.ResponseWriter) *fsm.CallResult {
 	// create ticker to provide some update to the HTTP client (HomeAssistant)
 	tickerUpdates := time.NewTicker(httpClientUpdateInterval)
 	defer tickerUpdates.Stop()
@@ -87,34 +114,35 @@ func (h *HttpServer) waitForFSMState(desiredState fsm.FSMState, w http.ResponseW
 		panic("expected http.ResponseWriter to be an http.Flusher")
 	}
 
-	h.logger.InfoPkgf(logPrefix, "Now waiting for FSM to reach the [%s] state", desiredState.String())
+	h.logger.InfoPkgf(logPrefix, "Now waiting for FSM to complete the call request [%s]", requestID)
 	for {
 
 		select {
 		case stateIntf := <-ch:
-			state, ok := stateIntf.(fsm.FSMState)
+			change, ok := stateIntf.(fsm.StateChange)
 			if !ok {
 				panic("bug")
 			}
 
-			// Is it the state we are waiting for?
-			if state == desiredState {
+			// Is it the notification we are waiting for?
+			if change.RequestID == requestID && change.Result != nil {
 				// yes
-				h.logger.InfoPkgf(logPrefix, "FSM state changed to the required state [%s]", desiredState.String())
-				return
+				h.logger.InfoPkgf(logPrefix, "FSM completed the call request [%s]", requestID)
+				return change.Result
 			}
 
 			// keep waiting
 			// log disabled: this log is too verbose
-			// h.logger.InfoPkgf(logPrefix, "Ignoring FSM state change to [%s]; waiting for FSM to reach state [%s]",
-			//   state.String(), desiredState.String())
+			// h.logger.InfoPkgf(logPrefix, "Ignoring FSM state change to [%s]; waiting for FSM to complete request [%s]",
+			//   change.State.String(), requestID)
 
 		case <-tickerUpdates.C:
-			// Provide update to the HTTP client
-			_, err := io.WriteString(w, "...call ongoing...\n")
+			// Provide update to the HTTP client; since the response body is JSON, just send
+			// some whitespace, which is ignored by JSON parsers
+			_, err := io.WriteString(w, "\n")
 			if err != nil {
 				h.logger.Warnf("Error writing to HTTP client: %s. Is the client still connected?", err.Error())
-				return // stop waiting
+				return nil // stop waiting
 			}
 			flusher.Flush() // Trigger "chunked" encoding and send a chunk...
 		}
@@ -130,102 +158,86 @@ func (h *HttpServer) serveDial(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Decode the JSON payload from the request body
-	var payload DialPayload
+	var payload callrequest.DialPayload
 	err := json.NewDecoder(r.Body).Decode(&payload)
 	if err != nil {
-		h.logger.InfoPkgf(logPrefix, "Replying with HTTP 400: invalid JSON payload: %s", err.Error())
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		h.writeDialError(w, http.StatusBadRequest, reasonInvalid, fmt.Errorf("invalid JSON payload: %w", err))
 		return
 	}
 
 	// Log the received payload
 	h.logger.InfoPkgf(logPrefix, "**********************************") // log marker
-	h.logger.InfoPkgf(logPrefix, "Received payload: CalledNumber=%s, CalledContact=%s, MessageTTS=%s\n",
-		payload.CalledNumber, payload.CalledContact, payload.MessageTTS)
+	h.logger.InfoPkgf(logPrefix, "Received payload: CalledNumber=%s, CalledContact=%s, CalledNumbers=%v, CalledContacts=%v, MessageTTS=%s, AudioFile=%s, AudioURL=%s, DTMFMenu=%s\n",
+		payload.CalledNumber, payload.CalledContact, payload.CalledNumbers, payload.CalledContacts, payload.MessageTTS, payload.AudioFile, payload.AudioURL, payload.DTMFMenu)
 
 	// Validate it
-	if payload.CalledNumber == "" && payload.CalledContact == "" {
-		h.logger.InfoPkg(logPrefix, "Replying with HTTP 400: CalledNumber or CalledContact is required")
-		http.Error(w, "CalledNumber or CalledContact is required", http.StatusBadRequest)
-		return
-	}
-	if payload.CalledNumber != "" && payload.CalledContact != "" {
-		h.logger.InfoPkg(logPrefix, "Replying with HTTP 400: Only one between CalledNumber and CalledContact can be provided")
-		http.Error(w, "Only one between CalledNumber and CalledContact can be provided", http.StatusBadRequest)
-		return
-	}
-	if payload.MessageTTS == "" {
-		h.logger.InfoPkg(logPrefix, "Replying with HTTP 400: MessageTTS is required")
-		http.Error(w, "MessageTTS is required", http.StatusBadRequest)
+	newCallRequest, err := h.dispatcher.BuildCallRequest(payload)
+	if err != nil {
+		h.writeDialError(w, http.StatusBadRequest, reasonInvalid, err)
 		return
 	}
 
-	if payload.CalledNumber != "" {
-		pattern := `^sip:[^@]+@[^@]+\.[^@]+$`
-		valid, err := regexp.MatchString(pattern, payload.CalledNumber)
-		if err != nil {
-			h.logger.InfoPkg(logPrefix, "Replying with HTTP 500: Error validating CalledNumber")
-			http.Error(w, "Error validating CalledNumber", http.StatusInternalServerError)
-			return
-		}
-		if !valid {
-			h.logger.InfoPkg(logPrefix, "Replying with HTTP 400: CalledNumber must be in the format sip:<number>@<domain>")
-			http.Error(w, "CalledNumber must be in the format sip:<number>@<domain>", http.StatusBadRequest)
-			return
-		}
-	} else if payload.CalledContact != "" {
-		// Check if we know about this contact
-		contactURI, exists := h.contactLookupMap[payload.CalledContact]
-		if !exists {
-			h.logger.InfoPkg(logPrefix, "Replying with HTTP 400: Unknown contact")
-			http.Error(w, fmt.Sprintf("Unknown contact: %s", payload.CalledContact), http.StatusBadRequest)
-			return
-		}
-
-		payload.CalledNumber = contactURI // Use the contact URI as the CalledNumber
-		h.logger.InfoPkgf(logPrefix, "Using contact URI %s for CalledContact %s", payload.CalledNumber, payload.CalledContact)
+	// In synchronous mode, subscribe to FSM notifications before submitting the request,
+	// otherwise a quick failure of the request might get lost
+	var fsmCh chan interface{}
+	if h.synchronous {
+		fsmCh = h.subscribeFSM()
+		defer h.fsmStateSubCh.Unregister(fsmCh)
 	}
 
-	// Send to the output channel
-	// h.logger.InfoPkgf(logPrefix, "Sending new call request to FSM")
-	h.outCh <- payload
-	// h.logger.InfoPkgf(logPrefix, "Sent new call request to the FSM")
-
-	// FIXME wait for FSM to transition out of WaitingInputs at least
+	// Submit the request and let the FSM accept, queue or reject it
+	reply := h.dispatcher.SubmitCallRequest(newCallRequest)
+	if reply.Err != nil {
+		statusCode, reason := dialErrorStatus(reply.Err)
+		h.writeDialError(w, statusCode, reason, reply.Err)
+		return
+	}
 
 	if h.synchronous {
 		h.logger.InfoPkgf(logPrefix, "Writing 200 OK and then waiting for processing to complete (synchronous mode) before sending full body to the HTTP client...")
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.Header().Set("Trailer", "CallCompleted")
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("Trailer", "CallCompleted, CallOutcome")
 		w.WriteHeader(http.StatusOK)
 
-		// wait till the FSM goes back into WaitingInputs state
-		h.waitForFSMState(fsm.WaitingInputs, w)
+		// wait till the FSM has completed our request
+		result := h.waitForRequestCompletion(reply.Receipt.RequestID, fsmCh, w)
+		if result == nil {
+			return
+		}
 
 		// then respond to the client
-		httpMsg := "Payload was valid and the request has been handled synchronously.\nTTS and call have been attempted. Check addon logs to understand if the TTS/call were successful or not.\nProcessing has been completed and the addon is ready to accept new requests."
-		_, _ = io.WriteString(w, httpMsg)
-		w.Header().Set("CallCompleted", "True")
-		h.logger.InfoPkgf(logPrefix, "Delayed reply with HTTP 200: %s", httpMsg)
+		body, _ := json.Marshal(DialSyncResponse{
+			RequestID:     reply.Receipt.RequestID,
+			QueuePosition: reply.Receipt.QueuePosition,
+			Result:        result,
+		})
+		_, _ = w.Write(body)
+		callCompleted := "False"
+		if result.Outcome == fsm.OutcomeAnswered {
+			callCompleted = "True"
+		}
+		w.Header().Set("CallCompleted", callCompleted)
+		w.Header().Set("CallOutcome", string(result.Outcome))
+		h.logger.InfoPkgf(logPrefix, "Delayed reply with HTTP 200: %s", body)
 	} else {
 		// Respond to the client immediately, without any waiting
-		httpMsg := "Payload is valid. Initiating TTS generation and outgoing call in asynchronous way."
-		w.WriteHeader(http.StatusOK)
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		_, _ = io.WriteString(w, httpMsg)
-		h.logger.InfoPkgf(logPrefix, "Immediately replying with HTTP 200 (asynchronous mode): %s", httpMsg)
+		resp := DialAcceptedResponse{
+			RequestID:     reply.Receipt.RequestID,
+			QueuePosition: reply.Receipt.QueuePosition,
+			Status:        reasonAccepted,
+		}
+		if resp.QueuePosition > 0 {
+			resp.Status = reasonQueued
+		}
+		h.logger.InfoPkgf(logPrefix, "Immediately replying with HTTP 202 (asynchronous mode): call request [%s] %s", resp.RequestID, resp.Status)
+		h.writeJSON(w, http.StatusAccepted, resp)
 	}
 }
 
 func (h *HttpServer) ListenAndServe() {
-	h.logger.InfoPkgf(logPrefix, "Server listening on %s, paths: %s", h.server.Addr, dialEndpoint)
+	h.logger.InfoPkgf(logPrefix, "Server listening on %s, paths: %s, %s, %s, %s, %s, %s, %s", h.server.Addr,
+		dialEndpoint, hangupEndpoint, prewarmEndpoint, statusEndpoint, healthEndpoint, statsEndpoint, metricsEndpoint)
 	if err := h.server.ListenAndServe(); err != nil {
 		h.logger.Fatalf("Failed to start server: %s", err)
 	}
 }
-
-// GetInputChannel returns the channel where all requests coming from the HTTP interface are sent
-// This is used by the FSM to read the requests and process them
-func (h *HttpServer) GetInputChannel() chan DialPayload {
-	return h.outCh
-}
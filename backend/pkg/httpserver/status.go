@@ -0,0 +1,111 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"voip-client-backend/pkg/callrequest"
+
+	"github.com/f18m/go-baresip/pkg/gobaresip"
+)
+
+// HealthResponse is the JSON body returned by the health endpoint
+type HealthResponse struct {
+	Ready      bool   `json:"ready"`
+	State      string `json:"state"`
+	Registered bool   `json:"registered"`
+}
+
+// StatsResponse is the JSON body returned by the stats endpoint
+type StatsResponse struct {
+	NumDialCmds    int                          `json:"num_dial_cmds"`
+	NumActiveCalls int                          `json:"num_active_calls"`
+	QueueLength    int                          `json:"queue_length"`
+	Baresip        gobaresip.BareSipClientStats `json:"baresip"`
+}
+
+// writeJSON replies to the HTTP client with the given status code and JSON body
+func (h *HttpServer) writeJSON(w http.ResponseWriter, statusCode int, v any) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		h.logger.InfoPkgf(logPrefix, "Replying with HTTP 500: error serializing the response: %s", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(statusCode)
+	_, _ = w.Write(body)
+}
+
+// allowOnlyGET replies with HTTP 405 and returns false for any method different from GET
+func (h *HttpServer) allowOnlyGET(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodGet {
+		h.logger.InfoPkg(logPrefix, "Replying with HTTP 405: Only GET method is allowed, received "+r.Method)
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
+
+// getStatus reads the FSM status; if the FSM goroutine cannot be reached it replies with HTTP 503
+// and returns false
+func (h *HttpServer) getStatus(w http.ResponseWriter) (callrequest.StatusReply, bool) {
+	status := h.dispatcher.GetStatus()
+	if status.Err != nil {
+		h.logger.InfoPkgf(logPrefix, "Replying with HTTP 503: %s", status.Err.Error())
+		http.Error(w, status.Err.Error(), http.StatusServiceUnavailable)
+		return status, false
+	}
+	return status, true
+}
+
+func (h *HttpServer) serveStatus(w http.ResponseWriter, r *http.Request) {
+	if !h.allowOnlyGET(w, r) {
+		return
+	}
+
+	status, ok := h.getStatus(w)
+	if !ok {
+		return
+	}
+	h.writeJSON(w, http.StatusOK, status.FSM)
+}
+
+// serveHealth implements a readiness probe: it fails with HTTP 503 while no SIP account is registered
+func (h *HttpServer) serveHealth(w http.ResponseWriter, r *http.Request) {
+	if !h.allowOnlyGET(w, r) {
+		return
+	}
+
+	status, ok := h.getStatus(w)
+	if !ok {
+		return
+	}
+	resp := HealthResponse{
+		Ready:      status.FSM.Registered,
+		State:      status.FSM.State,
+		Registered: status.FSM.Registered,
+	}
+	if !resp.Ready {
+		h.writeJSON(w, http.StatusServiceUnavailable, resp)
+		return
+	}
+	h.writeJSON(w, http.StatusOK, resp)
+}
+
+func (h *HttpServer) serveStats(w http.ResponseWriter, r *http.Request) {
+	if !h.allowOnlyGET(w, r) {
+		return
+	}
+
+	status, ok := h.getStatus(w)
+	if !ok {
+		return
+	}
+	h.writeJSON(w, http.StatusOK, StatsResponse{
+		NumDialCmds:    status.FSM.NumDialCmds,
+		NumActiveCalls: len(status.FSM.ActiveCalls),
+		QueueLength:    status.FSM.QueueLength,
+		Baresip:        status.Baresip,
+	})
+}
@@ -0,0 +1,59 @@
+package httpserver
+
+import (
+	"errors"
+	"net/http"
+
+	"voip-client-backend/pkg/callrequest"
+	"voip-client-backend/pkg/fsm"
+)
+
+// Reasons reported in the body of the responses of the dial endpoint
+const (
+	reasonAccepted      = "accepted"
+	reasonQueued        = "queued"
+	reasonInvalid       = "invalid-request"
+	reasonQueueFull     = "queue-full"
+	reasonBusy          = "busy"
+	reasonNotRegistered = "not-registered"
+	reasonDisconnected  = "baresip-disconnected"
+	reasonInternalError = "internal-error"
+)
+
+// DialAcceptedResponse is the JSON body returned by the dial endpoint in asynchronous mode
+type DialAcceptedResponse struct {
+	RequestID     string `json:"request_id"`
+	QueuePosition int    `json:"queue_position"`
+	// Status is "accepted" if the call started immediately, "queued" otherwise
+	Status string `json:"status"`
+}
+
+// DialErrorResponse is the JSON body returned by the dial endpoint when a call request is rejected
+type DialErrorResponse struct {
+	Reason string `json:"reason"`
+	Error  string `json:"error"`
+}
+
+// dialErrorStatus returns the HTTP status code and the reason to report for a rejected call request
+func dialErrorStatus(err error) (int, string) {
+	switch {
+	case errors.Is(err, fsm.ErrQueueFull):
+		return http.StatusTooManyRequests, reasonQueueFull
+	case errors.Is(err, callrequest.ErrFSMBusy):
+		return http.StatusTooManyRequests, reasonBusy
+	case errors.Is(err, fsm.ErrNotRegistered):
+		return http.StatusServiceUnavailable, reasonNotRegistered
+	case errors.Is(err, fsm.ErrNotConnected):
+		return http.StatusServiceUnavailable, reasonDisconnected
+	case errors.Is(err, fsm.ErrUnknownDTMFMenu), errors.Is(err, fsm.ErrInvalidEscalation), errors.Is(err, fsm.ErrUnknownAccount):
+		return http.StatusBadRequest, reasonInvalid
+	default:
+		return http.StatusInternalServerError, reasonInternalError
+	}
+}
+
+// writeDialError replies to the HTTP client that the call request has been rejected
+func (h *HttpServer) writeDialError(w http.ResponseWriter, statusCode int, reason string, err error) {
+	h.logger.InfoPkgf(logPrefix, "Replying with HTTP %d (%s): %s", statusCode, reason, err.Error())
+	h.writeJSON(w, statusCode, DialErrorResponse{Reason: reason, Error: err.Error()})
+}
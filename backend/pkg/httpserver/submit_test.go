@@ -0,0 +1,99 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"voip-client-backend/pkg/callrequest"
+	"voip-client-backend/pkg/config"
+	"voip-client-backend/pkg/fsm"
+	"voip-client-backend/pkg/logger"
+)
+
+func TestServeDialStatusCodes(t *testing.T) {
+	tests := []struct {
+		name       string
+		reply      callrequest.DialReply
+		wantStatus int
+		wantReason string
+	}{
+		{"accepted", callrequest.DialReply{Receipt: fsm.CallRequestReceipt{RequestID: "r1"}}, http.StatusAccepted, reasonAccepted},
+		{"queued", callrequest.DialReply{Receipt: fsm.CallRequestReceipt{RequestID: "r1", QueuePosition: 2}}, http.StatusAccepted, reasonQueued},
+		{"queue full", callrequest.DialReply{Err: fsm.ErrQueueFull}, http.StatusTooManyRequests, reasonQueueFull},
+		{"not registered", callrequest.DialReply{Err: fsm.ErrNotRegistered}, http.StatusServiceUnavailable, reasonNotRegistered},
+		{"baresip disconnected", callrequest.DialReply{Err: fsm.ErrNotConnected}, http.StatusServiceUnavailable, reasonDisconnected},
+		{"unknown account", callrequest.DialReply{Err: fsm.ErrUnknownAccount}, http.StatusBadRequest, reasonInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dispatcher := callrequest.NewDispatcher(logger.NewCustomLogger("test"), &config.AddonOptions{})
+			server := NewServer(logger.NewCustomLogger("test"), nil, dispatcher, nil)
+			go func() {
+				req := <-dispatcher.GetInputChannel()
+				req.ReplyCh <- tt.reply
+			}()
+
+			rec := httptest.NewRecorder()
+			body := `{"called_number": "sip:a@example.com", "message_tts": "hello"}`
+			server.serveDial(rec, httptest.NewRequest(http.MethodPost, dialEndpoint, strings.NewReader(body)))
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("got HTTP %d, want %d", rec.Code, tt.wantStatus)
+			}
+			var resp struct {
+				Status string `json:"status"`
+				Reason string `json:"reason"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("invalid JSON body %q: %s", rec.Body.String(), err)
+			}
+			if resp.Status+resp.Reason != tt.wantReason {
+				t.Errorf("got status %q and reason %q, want %q", resp.Status, resp.Reason, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestServeDialInvalidPayload(t *testing.T) {
+	dispatcher := callrequest.NewDispatcher(logger.NewCustomLogger("test"), &config.AddonOptions{})
+	server := NewServer(logger.NewCustomLogger("test"), nil, dispatcher, nil)
+	rec := httptest.NewRecorder()
+	server.serveDial(rec, httptest.NewRequest(http.MethodPost, dialEndpoint, strings.NewReader(`{"called_number": "not a SIP URI"}`)))
+
+	var resp DialErrorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid JSON body %q: %s", rec.Body.String(), err)
+	}
+	if rec.Code != http.StatusBadRequest || resp.Reason != reasonInvalid || resp.Error == "" {
+		t.Errorf("got HTTP %d with %+v, want HTTP 400 with reason %q", rec.Code, resp, reasonInvalid)
+	}
+}
+
+func TestDialErrorStatus(t *testing.T) {
+	tests := []struct {
+		err        error
+		wantStatus int
+		wantReason string
+	}{
+		{fsm.ErrQueueFull, http.StatusTooManyRequests, reasonQueueFull},
+		{callrequest.ErrFSMBusy, http.StatusTooManyRequests, reasonBusy},
+		{fsm.ErrNotRegistered, http.StatusServiceUnavailable, reasonNotRegistered},
+		{fsm.ErrNotConnected, http.StatusServiceUnavailable, reasonDisconnected},
+		{fsm.ErrUnknownDTMFMenu, http.StatusBadRequest, reasonInvalid},
+		{fsm.ErrInvalidEscalation, http.StatusBadRequest, reasonInvalid},
+		{fsm.ErrUnknownAccount, http.StatusBadRequest, reasonInvalid},
+		{fmt.Errorf("request [r1]: %w", fsm.ErrQueueFull), http.StatusTooManyRequests, reasonQueueFull},
+		{errors.New("unexpected"), http.StatusInternalServerError, reasonInternalError},
+	}
+	for _, tt := range tests {
+		status, reason := dialErrorStatus(tt.err)
+		if status != tt.wantStatus || reason != tt.wantReason {
+			t.Errorf("dialErrorStatus(%v) = %d, %q; want %d, %q", tt.err, status, reason, tt.wantStatus, tt.wantReason)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// All the metrics exposed by the addon.
+// Metrics are updated by the components that own the related data; values owned by
+// components that are not thread-safe (the FSM and the baresip connection) are instead
+// read from a [Snapshot] right before being exposed.
+var (
+	CallAttempts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "voip_client_call_attempts_total",
+		Help: "Number of outgoing calls dialed, by SIP account.",
+	}, []string{"account"})
+	CallsCompleted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "voip_client_calls_completed_total",
+		Help: "Number of outgoing call requests completed, by outcome and SIP response code.",
+	}, []string{"outcome", "sip_code"})
+	IncomingCalls = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "voip_client_incoming_calls_total",
+		Help: "Number of incoming calls, by action taken.",
+	}, []string{"action"})
+
+	TTSCacheHits = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "voip_client_tts_cache_hits_total",
+		Help: "Number of TTS conversions served from the audio file cache.",
+	})
+	TTSCacheMisses = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "voip_client_tts_cache_misses_total",
+		Help: "Number of TTS conversions that required a request to Home Assistant.",
+	})
+	TTSCacheSize = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "voip_client_tts_cache_size_bytes",
+		Help: "Total size of the audio files in the cache.",
+	})
+	TTSCacheEvictions = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "voip_client_tts_cache_evictions_total",
+		Help: "Number of audio files removed from the cache because too old or to make room for new files.",
+	})
+	TTSFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "voip_client_tts_failures_total",
+		Help: "Number of TTS conversions that failed.",
+	})
+	TTSLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "voip_client_tts_duration_seconds",
+		Help:    "Time spent to obtain the audio file of a TTS conversion from Home Assistant.",
+		Buckets: []float64{0.1, 0.25, 0.5, 1, 2, 5, 10, 30},
+	})
+
+	SIPRegistered = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "voip_client_sip_registered",
+		Help: "Whether the SIP account is currently registered (1) or not (0).",
+	}, []string{"account"})
+	SIPRegistrationFlaps = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "voip_client_sip_registration_flaps_total",
+		Help: "Number of times a registered SIP account lost its registration.",
+	}, []string{"account"})
+	SIPRegistrationAttempts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "voip_client_sip_registration_attempts_total",
+		Help: "Number of registrations started by the addon, including the retries.",
+	}, []string{"account"})
+
+	FSMState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "voip_client_fsm_state",
+		Help: "Current state of the VOIP client state machine: 1 for the current state, 0 for the others.",
+	}, []string{"state"})
+)
+
+// Descriptions of the metrics read from a [Snapshot]
+var (
+	activeCallsDesc = prometheus.NewDesc("voip_client_active_calls",
+		"Number of calls currently in progress.", nil, nil)
+	callQueueLengthDesc = prometheus.NewDesc("voip_client_call_queue_length",
+		"Number of call requests waiting in the queue.", nil, nil)
+	sipRegistrationAgeDesc = prometheus.NewDesc("voip_client_sip_registration_age_seconds",
+		"Time elapsed since the last successful registration of the SIP account, 0 if not registered.", []string{"account"}, nil)
+
+	baresipCommandsDesc = prometheus.NewDesc("voip_client_baresip_commands_total",
+		"Number of commands sent to baresip, by result.", []string{"result"}, nil)
+	baresipPingsDesc = prometheus.NewDesc("voip_client_baresip_pings_total",
+		"Number of pings sent to baresip, by result.", []string{"result"}, nil)
+	baresipDecodeFailuresDesc = prometheus.NewDesc("voip_client_baresip_decode_failures_total",
+		"Number of messages received from baresip that could not be decoded.", nil, nil)
+	baresipEventsDesc = prometheus.NewDesc("voip_client_baresip_events_total",
+		"Number of event messages received from baresip.", nil, nil)
+	baresipResponsesDesc = prometheus.NewDesc("voip_client_baresip_responses_total",
+		"Number of command responses received from baresip.", nil, nil)
+)
@@ -0,0 +1,66 @@
+// Package metrics defines the Prometheus metrics exposed by the addon and the HTTP handler
+// exposing them in the Prometheus text format.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Snapshot contains the values of the metrics owned by the FSM goroutine and the baresip connection
+type Snapshot struct {
+	ActiveCalls     int
+	CallQueueLength int
+	// SIPRegistrationAge is indexed by the AOR of the SIP account
+	SIPRegistrationAge map[string]float64
+
+	BaresipCommandsOK     float64
+	BaresipCommandsFailed float64
+	BaresipPingsOK        float64
+	BaresipPingsFailed    float64
+	BaresipDecodeFailures float64
+	BaresipEvents         float64
+	BaresipResponses      float64
+}
+
+// snapshotCollector exposes the values of a [Snapshot] taken at every scrape;
+// if the snapshot cannot be taken, its metrics are left out of the scrape
+type snapshotCollector struct {
+	snapshot func() (Snapshot, error)
+}
+
+func (c snapshotCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{activeCallsDesc, callQueueLengthDesc, sipRegistrationAgeDesc,
+		baresipCommandsDesc, baresipPingsDesc, baresipDecodeFailuresDesc, baresipEventsDesc, baresipResponsesDesc} {
+		ch <- desc
+	}
+}
+
+func (c snapshotCollector) Collect(ch chan<- prometheus.Metric) {
+	s, err := c.snapshot()
+	if err != nil {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(activeCallsDesc, prometheus.GaugeValue, float64(s.ActiveCalls))
+	ch <- prometheus.MustNewConstMetric(callQueueLengthDesc, prometheus.GaugeValue, float64(s.CallQueueLength))
+	for account, age := range s.SIPRegistrationAge {
+		ch <- prometheus.MustNewConstMetric(sipRegistrationAgeDesc, prometheus.GaugeValue, age, account)
+	}
+	ch <- prometheus.MustNewConstMetric(baresipCommandsDesc, prometheus.CounterValue, s.BaresipCommandsOK, "success")
+	ch <- prometheus.MustNewConstMetric(baresipCommandsDesc, prometheus.CounterValue, s.BaresipCommandsFailed, "failure")
+	ch <- prometheus.MustNewConstMetric(baresipPingsDesc, prometheus.CounterValue, s.BaresipPingsOK, "success")
+	ch <- prometheus.MustNewConstMetric(baresipPingsDesc, prometheus.CounterValue, s.BaresipPingsFailed, "failure")
+	ch <- prometheus.MustNewConstMetric(baresipDecodeFailuresDesc, prometheus.CounterValue, s.BaresipDecodeFailures)
+	ch <- prometheus.MustNewConstMetric(baresipEventsDesc, prometheus.CounterValue, s.BaresipEvents)
+	ch <- prometheus.MustNewConstMetric(baresipResponsesDesc, prometheus.CounterValue, s.BaresipResponses)
+}
+
+// Handler returns the HTTP handler exposing all metrics; the given function is invoked at every
+// scrape to read the values owned by components that are not thread-safe
+func Handler(snapshot func() (Snapshot, error)) http.Handler {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(snapshotCollector{snapshot: snapshot})
+	return promhttp.HandlerFor(prometheus.Gatherers{prometheus.DefaultGatherer, registry}, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,181 @@
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+const brokerTimeout = 2 * time.Second
+
+// MQTT control packet types, see section 2.2.1 of the MQTT 3.1.1 specs
+const (
+	packetConnect   byte = 1
+	packetConnack   byte = 2
+	packetPublish   byte = 3
+	packetSubscribe byte = 8
+	packetSuback    byte = 9
+	packetPingreq   byte = 12
+	packetPingresp  byte = 13
+)
+
+var errMalformedPacket = errors.New("malformed MQTT packet")
+
+// fakeBroker is a minimal MQTT broker stand-in, which lets the test inspect every packet
+// sent by the client and decide what to answer
+type fakeBroker struct {
+	ln    net.Listener
+	conns chan net.Conn
+}
+
+func newFakeBroker(t *testing.T) *fakeBroker {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &fakeBroker{ln: ln, conns: make(chan net.Conn, 4)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			b.conns <- conn
+		}
+	}()
+	t.Cleanup(func() { _ = ln.Close() })
+	return b
+}
+
+func (b *fakeBroker) addr() string {
+	return b.ln.Addr().String()
+}
+
+// brokerConn is a connection accepted by the [fakeBroker]
+type brokerConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// accept waits for a client connection, reads its CONNECT packet and answers with a
+// successful CONNACK; the body of the CONNECT packet is returned
+func (b *fakeBroker) accept(t *testing.T) (*brokerConn, []byte) {
+	t.Helper()
+	var conn net.Conn
+	select {
+	case conn = <-b.conns:
+	case <-time.After(brokerTimeout):
+		t.Fatal("the client did not connect")
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	bc := &brokerConn{conn: conn, reader: bufio.NewReader(conn)}
+	packetType, _, body := bc.read(t)
+	if packetType != packetConnect {
+		t.Fatalf("first packet has type %d, want CONNECT", packetType)
+	}
+	bc.write(t, packetConnack, 0, []byte{0, 0})
+	return bc, body
+}
+
+func (bc *brokerConn) read(t *testing.T) (byte, byte, []byte) {
+	t.Helper()
+	_ = bc.conn.SetReadDeadline(time.Now().Add(brokerTimeout))
+	packetType, flags, body, err := readPacket(bc.reader)
+	if err != nil {
+		t.Fatalf("error reading packet from the client: %s", err)
+	}
+	return packetType, flags, body
+}
+
+// readUntil reads packets until one of the given type is found, acknowledging the
+// subscriptions and the pings received in the meanwhile
+func (bc *brokerConn) readUntil(t *testing.T, wantType byte) (byte, []byte) {
+	t.Helper()
+	for {
+		packetType, flags, body := bc.read(t)
+		if packetType == wantType {
+			return flags, body
+		}
+		switch packetType {
+		case packetSubscribe:
+			// packet identifier, then the granted QoS
+			bc.write(t, packetSuback, 0, append(body[:2:2], 0))
+		case packetPingreq:
+			bc.write(t, packetPingresp, 0, nil)
+		}
+	}
+}
+
+func (bc *brokerConn) write(t *testing.T, packetType, flags byte, body []byte) {
+	t.Helper()
+	if _, err := bc.conn.Write(encodePacket(packetType, flags, body)); err != nil {
+		t.Fatalf("error writing packet to the client: %s", err)
+	}
+}
+
+/* -------------------------------------------------------------------------- */
+/*                               PACKET ENCODING                              */
+/* -------------------------------------------------------------------------- */
+
+func encodePacket(packetType, flags byte, body []byte) []byte {
+	packet := []byte{packetType<<4 | flags}
+	// remaining length, encoded 7 bits at a time
+	length := len(body)
+	for {
+		b := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if length == 0 {
+			break
+		}
+	}
+	return append(packet, body...)
+}
+
+func readPacket(r *bufio.Reader) (byte, byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	length := 0
+	for i := 0; ; i++ {
+		if i == 4 {
+			return 0, 0, nil, errMalformedPacket
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		length |= int(b&0x7f) << (7 * i)
+		if b&0x80 == 0 {
+			break
+		}
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, 0, nil, err
+	}
+	return header >> 4, header & 0x0f, body, nil
+}
+
+func readString(b []byte) (string, []byte, error) {
+	if len(b) < 2 {
+		return "", nil, errMalformedPacket
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+n {
+		return "", nil, errMalformedPacket
+	}
+	return string(b[2 : 2+n]), b[2+n:], nil
+}
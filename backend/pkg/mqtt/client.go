@@ -0,0 +1,153 @@
+// Package mqtt exposes the addon as a device to Home Assistant through MQTT discovery,
+// using the Eclipse Paho MQTT client.
+package mqtt
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"voip-client-backend/pkg/logger"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+)
+
+const clientLogPrefix = "mqtt-client"
+
+const (
+	mqttDialTimeout       = 10 * time.Second
+	mqttKeepAlive         = 60 * time.Second
+	mqttMinRetryInterval  = 5 * time.Second
+	mqttMaxRetryInterval  = 5 * time.Minute
+	mqttDisconnectQuiesce = 250 // milliseconds
+)
+
+// Will is the message published by the broker when the client disconnects ungracefully
+type Will struct {
+	Topic   string
+	Payload string
+	Retain  bool
+}
+
+// BrokerConfig contains the parameters to connect to the MQTT broker
+type BrokerConfig struct {
+	Address  string // host:port
+	Username string
+	Password string // #nosec G117 -- runtime-provided credentials
+	ClientID string
+}
+
+/*
+Client wraps the Paho MQTT client: it publishes and receives messages with QoS 0 only,
+which is all that is needed to integrate with Home Assistant.
+The client reconnects automatically, with an exponential backoff, and restores its subscriptions
+after each reconnection; the onConnect callback is invoked after each successful connection.
+Publish can be used from any goroutine.
+*/
+type Client struct {
+	// config
+	broker BrokerConfig
+
+	// link to other objects
+	logger    *logger.CustomLogger
+	client    paho.Client
+	onConnect func()
+	onMessage func(topic string, payload []byte, retained bool)
+
+	// state
+	lock          sync.Mutex
+	subscriptions []string
+}
+
+func NewClient(logger *logger.CustomLogger, broker BrokerConfig, will *Will, onConnect func(), onMessage func(topic string, payload []byte, retained bool)) *Client {
+	c := &Client{
+		broker:    broker,
+		logger:    logger,
+		onConnect: onConnect,
+		onMessage: onMessage,
+	}
+
+	opts := paho.NewClientOptions().
+		AddBroker("tcp://" + broker.Address).
+		SetClientID(broker.ClientID).
+		SetUsername(broker.Username).
+		SetPassword(broker.Password).
+		SetCleanSession(true).
+		SetKeepAlive(mqttKeepAlive).
+		SetConnectTimeout(mqttDialTimeout).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(mqttMinRetryInterval).
+		SetAutoReconnect(true).
+		SetMaxReconnectInterval(mqttMaxRetryInterval).
+		SetOnConnectHandler(func(paho.Client) { c.handleConnect() }).
+		SetConnectionLostHandler(func(_ paho.Client, err error) {
+			c.logger.WarnPkgf(clientLogPrefix, "Connection to MQTT broker [%s] lost: %s. Reconnecting.", c.broker.Address, err)
+		})
+	if will != nil {
+		opts.SetWill(will.Topic, will.Payload, 0, will.Retain)
+	}
+	c.client = paho.NewClient(opts)
+	return c
+}
+
+// Subscribe registers a topic filter; subscriptions are (re)sent to the broker on every connection
+func (c *Client) Subscribe(topic string) error {
+	c.lock.Lock()
+	c.subscriptions = append(c.subscriptions, topic)
+	c.lock.Unlock()
+	if !c.client.IsConnectionOpen() {
+		return nil
+	}
+	return c.waitToken(c.client.Subscribe(topic, 0, c.handleMessage))
+}
+
+// Publish sends a message with QoS 0
+func (c *Client) Publish(topic string, payload []byte, retain bool) error {
+	if !c.client.IsConnectionOpen() {
+		return ErrNotConnected
+	}
+	return c.waitToken(c.client.Publish(topic, 0, retain, payload))
+}
+
+// Run connects to the broker and keeps the connection up until the context is cancelled
+func (c *Client) Run(ctx context.Context) {
+	// with ConnectRetry set, the connection attempts go on in the background till the first success
+	c.client.Connect()
+	<-ctx.Done()
+	c.client.Disconnect(mqttDisconnectQuiesce)
+}
+
+// handleConnect restores the subscriptions after a (re)connection and notifies the owner
+func (c *Client) handleConnect() {
+	c.logger.InfoPkgf(clientLogPrefix, "Connected to MQTT broker [%s]", c.broker.Address)
+
+	c.lock.Lock()
+	var tokens []paho.Token
+	for _, topic := range c.subscriptions {
+		tokens = append(tokens, c.client.Subscribe(topic, 0, c.handleMessage))
+	}
+	c.lock.Unlock()
+
+	if c.onConnect != nil {
+		c.onConnect()
+	}
+	for _, token := range tokens {
+		if err := c.waitToken(token); err != nil {
+			c.logger.WarnPkgf(clientLogPrefix, "Failed to subscribe on MQTT broker [%s]: %s", c.broker.Address, err)
+		}
+	}
+}
+
+func (c *Client) handleMessage(_ paho.Client, msg paho.Message) {
+	if c.onMessage != nil {
+		c.onMessage(msg.Topic(), msg.Payload(), msg.Retained())
+	}
+}
+
+// waitToken waits for the completion of the given operation
+func (c *Client) waitToken(token paho.Token) error {
+	if !token.WaitTimeout(mqttDialTimeout) {
+		return ErrTimeout
+	}
+	return token.Error()
+}
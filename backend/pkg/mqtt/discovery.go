@@ -0,0 +1,387 @@
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"sync"
+
+	"voip-client-backend/pkg/callrequest"
+	"voip-client-backend/pkg/config"
+	"voip-client-backend/pkg/fsm"
+	"voip-client-backend/pkg/logger"
+
+	"github.com/dustin/go-broadcast"
+)
+
+const publisherLogPrefix = "mqtt-discovery"
+
+const (
+	mqttClientID     = "voip-client"
+	payloadOnline    = "online"
+	payloadOffline   = "offline"
+	payloadPress     = "PRESS"
+	registeredOn     = "ON"
+	registeredOff    = "OFF"
+	lastCallerNobody = "none"
+	// the state of the last call result sensor when a call request from MQTT is rejected
+	lastCallRejected = "request-rejected"
+)
+
+// haDevice groups all entities under a single device in Home Assistant
+type haDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model"`
+}
+
+// haEntityConfig is the discovery payload of a single entity,
+// see https://www.home-assistant.io/integrations/mqtt/#mqtt-discovery
+type haEntityConfig struct {
+	Name                string   `json:"name"`
+	UniqueID            string   `json:"unique_id"`
+	ObjectID            string   `json:"object_id"`
+	Icon                string   `json:"icon,omitempty"`
+	DeviceClass         string   `json:"device_class,omitempty"`
+	StateTopic          string   `json:"state_topic,omitempty"`
+	JSONAttributesTopic string   `json:"json_attributes_topic,omitempty"`
+	CommandTopic        string   `json:"command_topic,omitempty"`
+	PayloadOn           string   `json:"payload_on,omitempty"`
+	PayloadOff          string   `json:"payload_off,omitempty"`
+	PayloadPress        string   `json:"payload_press,omitempty"`
+	AvailabilityTopic   string   `json:"availability_topic"`
+	Device              haDevice `json:"device"`
+}
+
+// haEntity is an entity exposed through MQTT discovery
+type haEntity struct {
+	component string // e.g. "sensor", "binary_sensor"
+	config    haEntityConfig
+}
+
+/*
+Publisher exposes the addon as a device in Home Assistant, using MQTT discovery.
+It listens to the notifications published by the [fsm.VoipClientFSM] on its broadcaster and keeps
+the state topics of the following entities updated:
+  - a binary_sensor telling whether a SIP account is registered;
+  - a sensor with the state of the FSM;
+  - a sensor with the outcome of the last call request (and the full result as attributes);
+  - a sensor with the last caller (and the details of the incoming call as attributes).
+
+When a contact to call is configured, a button entity (calling the contact with a fixed message)
+and a notify entity (calling the contact with the notification message) are exposed too:
+the call requests they produce are submitted through the [callrequest.Dispatcher], like the ones
+coming from the other input adapters, and their rejections are reported by the last call sensor.
+*/
+type Publisher struct {
+	// config
+	discoveryPrefix string
+	topicPrefix     string
+	dialContact     fsm.CallContact
+	buttonMessage   string
+
+	// link to other objects
+	logger        *logger.CustomLogger
+	client        *Client
+	fsmStateSubCh broadcast.Broadcaster
+	dispatcher    *callrequest.Dispatcher
+
+	// last states, indexed by topic; they are published again on every reconnection
+	lock   sync.Mutex
+	states map[string][]byte
+	// topics whose state changed and still needs to be published
+	dirty map[string]bool
+	// signals the publishing goroutine that some states changed
+	publishCh chan struct{}
+}
+
+func NewPublisher(logger *logger.CustomLogger, fsmStatePubSub broadcast.Broadcaster, dispatcher *callrequest.Dispatcher, cfg *config.AddonOptions, broker BrokerConfig) *Publisher {
+	p := &Publisher{
+		discoveryPrefix: cfg.GetMQTTDiscoveryPrefix(),
+		topicPrefix:     cfg.GetMQTTTopicPrefix(),
+		buttonMessage:   cfg.GetMQTTButtonMessage(),
+		logger:          logger,
+		fsmStateSubCh:   fsmStatePubSub,
+		dispatcher:      dispatcher,
+		states:          make(map[string][]byte),
+		dirty:           make(map[string]bool),
+		publishCh:       make(chan struct{}, 1),
+	}
+
+	if cfg.MQTT.DialContact != "" {
+		for _, contact := range cfg.Contacts {
+			if contact.Name == cfg.MQTT.DialContact {
+				p.dialContact = fsm.CallContact{Name: contact.Name, URI: contact.URI}
+			}
+		}
+		if p.dialContact.URI == "" {
+			logger.WarnPkgf(publisherLogPrefix, "Unknown contact [%s] in 'mqtt.dial_contact': the button and notify entities won't be available", cfg.MQTT.DialContact)
+		}
+	}
+
+	broker.ClientID = mqttClientID
+	p.client = NewClient(logger, broker, &Will{
+		Topic:   p.topic("availability"),
+		Payload: payloadOffline,
+		Retain:  true,
+	}, p.onConnect, p.onMessage)
+
+	// initial states, before any notification from the FSM
+	p.setState(p.topic("state"), []byte(fsm.Uninitialized.String()))
+	p.setState(p.topic("registered"), []byte(registeredOff))
+	p.setState(p.topic("last_caller/state"), []byte(lastCallerNobody))
+	return p
+}
+
+// Run connects to the MQTT broker and publishes the FSM notifications, until the context is cancelled.
+// The FSM notifications only update the states to publish: network I/O happens in another goroutine,
+// so that a slow broker never blocks the broadcaster (and thus the FSM).
+func (p *Publisher) Run(ctx context.Context) {
+	if p.dialContact.URI != "" {
+		_ = p.client.Subscribe(p.topic("dial/press"))
+		_ = p.client.Subscribe(p.topic("dial/notify"))
+	}
+	go p.client.Run(ctx)
+	go p.publishLoop(ctx)
+
+	// use a buffered channel: the broadcaster blocks while delivering to a slow subscriber
+	ch := make(chan interface{}, 16)
+	p.fsmStateSubCh.Register(ch)
+	defer p.fsmStateSubCh.Unregister(ch)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case msg := <-ch:
+			if change, ok := msg.(fsm.StateChange); ok {
+				p.onStateChange(change)
+			}
+		}
+	}
+}
+
+func (p *Publisher) topic(suffix string) string {
+	return p.topicPrefix + "/" + suffix
+}
+
+func (p *Publisher) onStateChange(change fsm.StateChange) {
+	if change.Result != nil {
+		attributes, _ := json.Marshal(change.Result)
+		p.setState(p.topic("last_call/attributes"), attributes)
+		p.setState(p.topic("last_call/state"), []byte(change.Result.Outcome))
+		return
+	}
+	if change.IncomingCall != nil {
+		attributes, _ := json.Marshal(change.IncomingCall)
+		p.setState(p.topic("last_caller/attributes"), attributes)
+		p.setState(p.topic("last_caller/state"), []byte(change.IncomingCall.PeerURI))
+		return
+	}
+	if change.RequestID != "" {
+		// state change of a single call, not relevant here
+		return
+	}
+
+	p.setState(p.topic("state"), []byte(change.State.String()))
+	registered := registeredOff
+	if change.State == fsm.WaitingInputs || change.State == fsm.CallsInProgress {
+		registered = registeredOn
+	}
+	p.setState(p.topic("registered"), []byte(registered))
+}
+
+// setState records the new state and wakes up the publishing goroutine
+func (p *Publisher) setState(topic string, payload []byte) {
+	p.lock.Lock()
+	p.states[topic] = payload
+	p.dirty[topic] = true
+	p.lock.Unlock()
+
+	select {
+	case p.publishCh <- struct{}{}:
+	default:
+		// the publishing goroutine has already been signalled
+	}
+}
+
+// publishLoop publishes as retained messages the states changed since the last iteration
+func (p *Publisher) publishLoop(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.publishCh:
+		}
+
+		p.lock.Lock()
+		changes := make(map[string][]byte, len(p.dirty))
+		for topic := range p.dirty {
+			changes[topic] = p.states[topic]
+		}
+		clear(p.dirty)
+		p.lock.Unlock()
+
+		for topic, payload := range changes {
+			err := p.client.Publish(topic, payload, true)
+			if err != nil && err != ErrNotConnected {
+				p.logger.WarnPkgf(publisherLogPrefix, "Failed to publish on topic [%s]: %s", topic, err)
+			}
+		}
+	}
+}
+
+// onConnect publishes the discovery configs and all the known states
+func (p *Publisher) onConnect() {
+	for _, entity := range p.entities() {
+		payload, _ := json.Marshal(entity.config)
+		topic := fmt.Sprintf("%s/%s/%s/%s/config", p.discoveryPrefix, entity.component, mqttClientID, entity.config.ObjectID)
+		if err := p.client.Publish(topic, payload, true); err != nil {
+			p.logger.WarnPkgf(publisherLogPrefix, "Failed to publish discovery config on topic [%s]: %s", topic, err)
+		}
+	}
+
+	p.lock.Lock()
+	states := maps.Clone(p.states)
+	p.lock.Unlock()
+	for topic, payload := range states {
+		if err := p.client.Publish(topic, payload, true); err != nil {
+			p.logger.WarnPkgf(publisherLogPrefix, "Failed to publish on topic [%s]: %s", topic, err)
+		}
+	}
+	_ = p.client.Publish(p.topic("availability"), []byte(payloadOnline), true)
+	p.logger.InfoPkgf(publisherLogPrefix, "Published discovery configs and states under [%s]", p.topicPrefix)
+}
+
+// onMessage handles the commands coming from the button and notify entities
+func (p *Publisher) onMessage(topic string, payload []byte, retained bool) {
+	if retained {
+		// a stale command left on the broker: do not call anybody because of it
+		p.logger.InfoPkgf(publisherLogPrefix, "Ignoring retained message on topic [%s]", topic)
+		return
+	}
+
+	req := callrequest.DialPayload{
+		CalledContact: p.dialContact.Name,
+	}
+	switch topic {
+	case p.topic("dial/press"):
+		req.MessageTTS = p.buttonMessage
+	case p.topic("dial/notify"):
+		req.MessageTTS = string(payload)
+	default:
+		return
+	}
+	if req.MessageTTS == "" {
+		p.logger.WarnPkgf(publisherLogPrefix, "Ignoring empty message on topic [%s]", topic)
+		return
+	}
+
+	p.logger.InfoPkgf(publisherLogPrefix, "Received call request for contact [%s] on topic [%s]", p.dialContact.Name, topic)
+	// the FSM may take a while to accept the request: do not block the MQTT client meanwhile
+	go p.dial(topic, req)
+}
+
+// dial validates and submits a call request coming from the button and notify entities; since
+// nobody waits for the outcome of the submission, a rejection is published as last call result
+func (p *Publisher) dial(topic string, payload callrequest.DialPayload) {
+	req, err := p.dispatcher.BuildCallRequest(payload)
+	if err == nil {
+		reply := p.dispatcher.SubmitCallRequest(req)
+		if reply.Err == nil {
+			p.logger.InfoPkgf(publisherLogPrefix, "Call request from topic [%s] accepted: call request ID [%s], queue position %d",
+				topic, reply.Receipt.RequestID, reply.Receipt.QueuePosition)
+			return
+		}
+		err = reply.Err
+	}
+
+	p.logger.WarnPkgf(publisherLogPrefix, "Call request from topic [%s] rejected: %s", topic, err)
+	attributes, _ := json.Marshal(map[string]string{
+		"called_contact": payload.CalledContact,
+		"error":          err.Error(),
+	})
+	p.setState(p.topic("last_call/attributes"), attributes)
+	p.setState(p.topic("last_call/state"), []byte(lastCallRejected))
+}
+
+// entities returns all the entities to expose
+func (p *Publisher) entities() []haEntity {
+	device := haDevice{
+		Identifiers:  []string{mqttClientID},
+		Name:         "VOIP Client",
+		Manufacturer: "f18m",
+		Model:        "Home Assistant VOIP Client addon",
+	}
+	availability := p.topic("availability")
+
+	entities := []haEntity{
+		{"binary_sensor", haEntityConfig{
+			Name:              "SIP registration",
+			UniqueID:          "voip_client_registered",
+			ObjectID:          "voip_client_registered",
+			DeviceClass:       "connectivity",
+			StateTopic:        p.topic("registered"),
+			PayloadOn:         registeredOn,
+			PayloadOff:        registeredOff,
+			AvailabilityTopic: availability,
+			Device:            device,
+		}},
+		{"sensor", haEntityConfig{
+			Name:              "State",
+			UniqueID:          "voip_client_state",
+			ObjectID:          "voip_client_state",
+			Icon:              "mdi:state-machine",
+			StateTopic:        p.topic("state"),
+			AvailabilityTopic: availability,
+			Device:            device,
+		}},
+		{"sensor", haEntityConfig{
+			Name:                "Last call result",
+			UniqueID:            "voip_client_last_call_result",
+			ObjectID:            "voip_client_last_call_result",
+			Icon:                "mdi:phone-outgoing",
+			StateTopic:          p.topic("last_call/state"),
+			JSONAttributesTopic: p.topic("last_call/attributes"),
+			AvailabilityTopic:   availability,
+			Device:              device,
+		}},
+		{"sensor", haEntityConfig{
+			Name:                "Last caller",
+			UniqueID:            "voip_client_last_caller",
+			ObjectID:            "voip_client_last_caller_mqtt",
+			Icon:                "mdi:phone-incoming",
+			StateTopic:          p.topic("last_caller/state"),
+			JSONAttributesTopic: p.topic("last_caller/attributes"),
+			AvailabilityTopic:   availability,
+			Device:              device,
+		}},
+	}
+
+	if p.dialContact.URI != "" {
+		entities = append(entities,
+			haEntity{"button", haEntityConfig{
+				Name:              "Call " + p.dialContact.Name,
+				UniqueID:          "voip_client_dial_button",
+				ObjectID:          "voip_client_dial",
+				Icon:              "mdi:phone-dial",
+				CommandTopic:      p.topic("dial/press"),
+				PayloadPress:      payloadPress,
+				AvailabilityTopic: availability,
+				Device:            device,
+			}},
+			haEntity{"notify", haEntityConfig{
+				Name:              "Call " + p.dialContact.Name,
+				UniqueID:          "voip_client_dial_notify",
+				ObjectID:          "voip_client_dial",
+				CommandTopic:      p.topic("dial/notify"),
+				AvailabilityTopic: availability,
+				Device:            device,
+			}},
+		)
+	}
+	return entities
+}
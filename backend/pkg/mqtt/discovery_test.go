@@ -0,0 +1,205 @@
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"voip-client-backend/pkg/callrequest"
+	"voip-client-backend/pkg/config"
+	"voip-client-backend/pkg/fsm"
+	"voip-client-backend/pkg/logger"
+
+	"github.com/dustin/go-broadcast"
+)
+
+// readPublishes collects the retained PUBLISH packets sent by the client, indexed by topic,
+// until all the wanted topics have been published
+func readPublishes(t *testing.T, bc *brokerConn, wantTopics ...string) map[string]string {
+	t.Helper()
+	published := make(map[string]string)
+	for {
+		missing := false
+		for _, topic := range wantTopics {
+			if _, ok := published[topic]; !ok {
+				missing = true
+			}
+		}
+		if !missing {
+			return published
+		}
+
+		flags, body := bc.readUntil(t, packetPublish)
+		topic, payload, err := readString(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if flags&0x01 == 0 {
+			t.Errorf("message on topic [%s] is not retained", topic)
+		}
+		published[topic] = string(payload)
+	}
+}
+
+func newTestPublisher(t *testing.T, dialContact string) (*Publisher, broadcast.Broadcaster, *brokerConn) {
+	t.Helper()
+	broker := newFakeBroker(t)
+
+	cfg := &config.AddonOptions{
+		Contacts: []config.AddonContact{{Name: "John Doe", URI: "<sip:johndoe@example.com>"}},
+	}
+	cfg.MQTT.DialContact = dialContact
+
+	broadcaster := broadcast.NewBroadcaster(100)
+	t.Cleanup(func() { _ = broadcaster.Close() })
+
+	dispatcher := callrequest.NewDispatcher(logger.NewCustomLogger("test"), cfg)
+	p := NewPublisher(logger.NewCustomLogger("test"), broadcaster, dispatcher, cfg, BrokerConfig{Address: broker.addr()})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		p.Run(ctx)
+		close(done)
+	}()
+	// stop the publisher before closing the broadcaster
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	bc, _ := broker.accept(t)
+	return p, broadcaster, bc
+}
+
+func TestPublisherDiscovery(t *testing.T) {
+	_, _, bc := newTestPublisher(t, "John Doe")
+
+	tests := []struct {
+		topic      string
+		uniqueID   string
+		stateTopic string
+	}{
+		{"homeassistant/binary_sensor/voip-client/voip_client_registered/config", "voip_client_registered", "voip_client/registered"},
+		{"homeassistant/sensor/voip-client/voip_client_state/config", "voip_client_state", "voip_client/state"},
+		{"homeassistant/sensor/voip-client/voip_client_last_call_result/config", "voip_client_last_call_result", "voip_client/last_call/state"},
+		{"homeassistant/sensor/voip-client/voip_client_last_caller_mqtt/config", "voip_client_last_caller", "voip_client/last_caller/state"},
+		{"homeassistant/button/voip-client/voip_client_dial/config", "voip_client_dial_button", ""},
+		{"homeassistant/notify/voip-client/voip_client_dial/config", "voip_client_dial_notify", ""},
+	}
+	var topics []string
+	for _, tt := range tests {
+		topics = append(topics, tt.topic)
+	}
+	published := readPublishes(t, bc, append(topics, "voip_client/availability", "voip_client/state", "voip_client/registered")...)
+
+	for _, tt := range tests {
+		var cfg haEntityConfig
+		if err := json.Unmarshal([]byte(published[tt.topic]), &cfg); err != nil {
+			t.Errorf("invalid discovery payload on [%s]: %s", tt.topic, err)
+			continue
+		}
+		if cfg.UniqueID != tt.uniqueID || cfg.StateTopic != tt.stateTopic {
+			t.Errorf("discovery payload on [%s] has unique_id %q and state_topic %q", tt.topic, cfg.UniqueID, cfg.StateTopic)
+		}
+		if cfg.AvailabilityTopic != "voip_client/availability" || len(cfg.Device.Identifiers) != 1 || cfg.Device.Identifiers[0] != mqttClientID {
+			t.Errorf("discovery payload on [%s] has wrong availability or device: %+v", tt.topic, cfg)
+		}
+	}
+	if published["voip_client/availability"] != payloadOnline {
+		t.Errorf("availability is %q", published["voip_client/availability"])
+	}
+	if published["voip_client/state"] != fsm.Uninitialized.String() || published["voip_client/registered"] != registeredOff {
+		t.Errorf("unexpected initial states: %v", published)
+	}
+}
+
+func TestPublisherWithoutDialContact(t *testing.T) {
+	p, _, _ := newTestPublisher(t, "")
+	for _, entity := range p.entities() {
+		if entity.component == "button" || entity.component == "notify" {
+			t.Errorf("entity %s exposed without a dial contact", entity.component)
+		}
+	}
+}
+
+func TestPublisherStates(t *testing.T) {
+	_, broadcaster, bc := newTestPublisher(t, "")
+	readPublishes(t, bc, "voip_client/availability")
+
+	broadcaster.Submit(fsm.StateChange{State: fsm.WaitingInputs})
+	published := readPublishes(t, bc, "voip_client/state", "voip_client/registered")
+	if published["voip_client/state"] != fsm.WaitingInputs.String() || published["voip_client/registered"] != registeredOn {
+		t.Errorf("unexpected states: %v", published)
+	}
+
+	broadcaster.Submit(fsm.StateChange{
+		State:     fsm.WaitingInputs,
+		RequestID: "req1",
+		Result:    &fsm.CallResult{RequestID: "req1", Outcome: fsm.OutcomeBusy},
+	})
+	published = readPublishes(t, bc, "voip_client/last_call/state", "voip_client/last_call/attributes")
+	if published["voip_client/last_call/state"] != string(fsm.OutcomeBusy) {
+		t.Errorf("last call state is %q", published["voip_client/last_call/state"])
+	}
+	var result fsm.CallResult
+	if err := json.Unmarshal([]byte(published["voip_client/last_call/attributes"]), &result); err != nil || result.RequestID != "req1" {
+		t.Errorf("unexpected last call attributes: %q", published["voip_client/last_call/attributes"])
+	}
+
+	broadcaster.Submit(fsm.StateChange{
+		State:        fsm.WaitingInputs,
+		IncomingCall: &fsm.IncomingCall{CallID: "c1", PeerURI: "sip:caller@example.com", Action: fsm.IncomingCallReject},
+	})
+	published = readPublishes(t, bc, "voip_client/last_caller/state", "voip_client/last_caller/attributes")
+	if published["voip_client/last_caller/state"] != "sip:caller@example.com" {
+		t.Errorf("last caller is %q", published["voip_client/last_caller/state"])
+	}
+	var caller fsm.IncomingCall
+	if err := json.Unmarshal([]byte(published["voip_client/last_caller/attributes"]), &caller); err != nil || caller.CallID != "c1" || caller.Action != fsm.IncomingCallReject {
+		t.Errorf("unexpected last caller attributes: %q", published["voip_client/last_caller/attributes"])
+	}
+}
+
+func TestPublisherDial(t *testing.T) {
+	tests := []struct {
+		name      string
+		topic     string
+		payload   string
+		replyErr  error
+		wantState string
+	}{
+		{"button accepted", "voip_client/dial/press", payloadPress, nil, ""},
+		{"notification rejected", "voip_client/dial/notify", "intruder detected", fsm.ErrQueueFull, lastCallRejected},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, _, bc := newTestPublisher(t, "John Doe")
+			readPublishes(t, bc, "voip_client/availability")
+
+			p.onMessage(tt.topic, []byte(tt.payload), false)
+			var req callrequest.DialRequest
+			select {
+			case req = <-p.dispatcher.GetInputChannel():
+			case <-time.After(brokerTimeout):
+				t.Fatal("call request not submitted")
+			}
+			if req.Request.CalledNumber != "<sip:johndoe@example.com>" || req.Request.CalledContact != "John Doe" || req.Request.MessageTTS == "" {
+				t.Errorf("unexpected call request: %+v", req.Request)
+			}
+			req.ReplyCh <- callrequest.DialReply{Err: tt.replyErr}
+
+			if tt.wantState == "" {
+				return
+			}
+			published := readPublishes(t, bc, "voip_client/last_call/state", "voip_client/last_call/attributes")
+			if published["voip_client/last_call/state"] != tt.wantState {
+				t.Errorf("last call state is %q, want %q", published["voip_client/last_call/state"], tt.wantState)
+			}
+			var attributes map[string]string
+			if err := json.Unmarshal([]byte(published["voip_client/last_call/attributes"]), &attributes); err != nil || attributes["error"] != tt.replyErr.Error() {
+				t.Errorf("unexpected last call attributes: %q", published["voip_client/last_call/attributes"])
+			}
+		})
+	}
+}
@@ -0,0 +1,8 @@
+package mqtt
+
+import "errors"
+
+var (
+	ErrNotConnected = errors.New("not connected to the MQTT broker")
+	ErrTimeout      = errors.New("no answer from the MQTT broker")
+)
@@ -0,0 +1,134 @@
+// Package stdin reads commands from the addon standard input, which HomeAssistant writes using
+// the "hassio.addon_stdin" action; this keeps the automations written for the dss_voip addon working.
+package stdin
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"strings"
+
+	"voip-client-backend/pkg/callrequest"
+	"voip-client-backend/pkg/logger"
+)
+
+const logPrefix = "stdin"
+
+// maxLineSize is the maximum size of a single JSON command
+const maxLineSize = 64 * 1024
+
+const (
+	commandDial   = "dial"
+	commandHangup = "hangup"
+	commandStatus = "status"
+)
+
+// Command is a single JSON command read from stdin.
+// The dial command accepts the same fields of the HTTP dial endpoint.
+type Command struct {
+	// Command is one of "dial" (the default), "hangup" or "status"
+	Command string `json:"command"`
+	callrequest.DialPayload
+	// CallSipURI is the name used by the dss_voip addon for the called number
+	CallSipURI string `json:"call_sip_uri"`
+	// CallID and RequestID select the calls to hang up; if both are empty, all calls are hung up
+	CallID    string `json:"call_id"`
+	RequestID string `json:"request_id"`
+}
+
+// Reader parses the commands read from stdin and sends them to the FSM goroutine,
+// using the same dispatcher of the HTTP server
+type Reader struct {
+	logger     *logger.CustomLogger
+	input      io.Reader
+	dispatcher *callrequest.Dispatcher
+}
+
+func NewReader(logger *logger.CustomLogger, input io.Reader, dispatcher *callrequest.Dispatcher) *Reader {
+	return &Reader{
+		logger:     logger,
+		input:      input,
+		dispatcher: dispatcher,
+	}
+}
+
+// Run reads commands, one JSON object per line, until the input is closed
+func (r *Reader) Run() {
+	scanner := bufio.NewScanner(r.input)
+	scanner.Buffer(make([]byte, 0, 4096), maxLineSize)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		r.handleLine(line)
+	}
+	if err := scanner.Err(); err != nil {
+		r.logger.WarnPkgf(logPrefix, "Error reading from stdin: %s", err)
+		return
+	}
+	r.logger.InfoPkgf(logPrefix, "Stdin closed, no more commands will be read from it")
+}
+
+func (r *Reader) handleLine(line string) {
+	var cmd Command
+	if err := json.Unmarshal([]byte(line), &cmd); err != nil {
+		r.logger.WarnPkgf(logPrefix, "Ignoring invalid JSON command: %s", err)
+		return
+	}
+
+	switch strings.ToLower(cmd.Command) {
+	case "", commandDial:
+		r.dial(cmd)
+	case commandHangup:
+		r.hangup(cmd)
+	case commandStatus:
+		r.status()
+	default:
+		r.logger.WarnPkgf(logPrefix, "Ignoring unknown command [%s]", cmd.Command)
+	}
+}
+
+func (r *Reader) dial(cmd Command) {
+	payload := cmd.DialPayload
+	if payload.CalledNumber == "" {
+		payload.CalledNumber = cmd.CallSipURI
+	}
+
+	newCallRequest, err := r.dispatcher.BuildCallRequest(payload)
+	if err != nil {
+		r.logger.WarnPkgf(logPrefix, "Ignoring invalid dial command: %s", err)
+		return
+	}
+
+	reply := r.dispatcher.SubmitCallRequest(newCallRequest)
+	if reply.Err != nil {
+		r.logger.WarnPkgf(logPrefix, "Dial command failed: %s", reply.Err)
+		return
+	}
+	r.logger.InfoPkgf(logPrefix, "Dial command accepted: call request ID [%s], queue position %d",
+		reply.Receipt.RequestID, reply.Receipt.QueuePosition)
+}
+
+func (r *Reader) hangup(cmd Command) {
+	reply := r.dispatcher.Hangup(cmd.CallID, cmd.RequestID)
+	if reply.Err != nil {
+		r.logger.WarnPkgf(logPrefix, "Hangup command failed: %s", reply.Err)
+		return
+	}
+	r.logger.InfoPkgf(logPrefix, "Hangup command accepted: %d calls and call requests cancelled", reply.NumCancelled)
+}
+
+func (r *Reader) status() {
+	reply := r.dispatcher.GetStatus()
+	if reply.Err != nil {
+		r.logger.WarnPkgf(logPrefix, "Status command failed: %s", reply.Err)
+		return
+	}
+	body, err := json.Marshal(reply.FSM)
+	if err != nil {
+		r.logger.WarnPkgf(logPrefix, "Error serializing the status: %s", err)
+		return
+	}
+	r.logger.InfoPkgf(logPrefix, "Status: %s", body)
+}
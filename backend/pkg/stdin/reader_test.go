@@ -0,0 +1,71 @@
+package stdin
+
+import (
+	"strings"
+	"testing"
+
+	"voip-client-backend/pkg/callrequest"
+	"voip-client-backend/pkg/config"
+	"voip-client-backend/pkg/fsm"
+	"voip-client-backend/pkg/logger"
+)
+
+func TestReaderCommands(t *testing.T) {
+	cfg := &config.AddonOptions{
+		Contacts: []config.AddonContact{{Name: "John Doe", URI: "sip:john@example.com"}},
+	}
+	dispatcher := callrequest.NewDispatcher(logger.NewCustomLogger("test"), cfg)
+
+	input := strings.Join([]string{
+		`{"call_sip_uri": "sip:123@example.com", "message_tts": "dss_voip style"}`,
+		`not json`,
+		`{"command": "dial", "called_contact": "John Doe", "message_tts": "hello", "max_duration": "30s"}`,
+		`{"command": "dial", "called_contact": "Unknown", "message_tts": "ignored"}`,
+		``,
+		`{"command": "hangup", "request_id": "abc"}`,
+		`{"command": "status"}`,
+		`{"command": "reboot"}`,
+	}, "\n")
+
+	var dials []fsm.NewCallRequest
+	var hangups []callrequest.HangupRequest
+	numStatus := 0
+
+	done := make(chan struct{})
+	go func() {
+		NewReader(logger.NewCustomLogger("test"), strings.NewReader(input), dispatcher).Run()
+		close(done)
+	}()
+
+	for running := true; running; {
+		select {
+		case req := <-dispatcher.GetInputChannel():
+			dials = append(dials, req.Request)
+			req.ReplyCh <- callrequest.DialReply{Receipt: fsm.CallRequestReceipt{RequestID: "id"}}
+		case req := <-dispatcher.GetHangupChannel():
+			hangups = append(hangups, req)
+			req.ReplyCh <- callrequest.HangupReply{NumCancelled: 1}
+		case req := <-dispatcher.GetStatusChannel():
+			numStatus++
+			req.ReplyCh <- callrequest.StatusReply{}
+		case <-done:
+			running = false
+		}
+	}
+
+	if len(dials) != 2 {
+		t.Fatalf("got %d dial requests, want 2: %+v", len(dials), dials)
+	}
+	if dials[0].CalledNumber != "sip:123@example.com" || dials[0].MessageTTS != "dss_voip style" {
+		t.Errorf("call_sip_uri not used as called number: %+v", dials[0])
+	}
+	if dials[1].CalledNumber != "sip:john@example.com" || dials[1].CalledContact != "John Doe" || dials[1].MaxDuration.Seconds() != 30 {
+		t.Errorf("contact not resolved: %+v", dials[1])
+	}
+	if len(hangups) != 1 || hangups[0].RequestID != "abc" || hangups[0].CallID != "" {
+		t.Errorf("got hangup requests %+v", hangups)
+	}
+	if numStatus != 1 {
+		t.Errorf("got %d status requests, want 1", numStatus)
+	}
+}
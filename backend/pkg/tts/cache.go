@@ -0,0 +1,331 @@
+package tts
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"voip-client-backend/pkg/logger"
+	"voip-client-backend/pkg/metrics"
+)
+
+// cacheIndexFile is the sidecar file, inside the cache directory, holding the metadata of the cached files
+const cacheIndexFile = "index.json"
+
+// CacheEntry describes an audio file stored in the [Cache]
+type CacheEntry struct {
+	File string `json:"file"`
+	// Message is the text converted by the TTS engine, with the options used for the conversion
+	Message string        `json:"message,omitempty"`
+	Engine  EngineOptions `json:"engine,omitzero"`
+	// Source is the path or the URL of a pre-recorded audio file
+	Source    string    `json:"source,omitempty"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"created_at"`
+	LastUsed  time.Time `json:"last_used"`
+	// Pinned files are never evicted
+	Pinned bool `json:"pinned,omitempty"`
+}
+
+// Cache keeps track of the audio files stored in the cache directory, evicting the files older
+// than the max age and, when the total size exceeds the max size, the least recently used ones.
+// Files acquired by the calls in progress, see [Cache.Acquire], are never evicted.
+// The metadata of the cached files is stored in a sidecar index file in the same directory, which
+// is written when files are added or removed; the last use times are written lazily, see [Cache.Flush].
+// Cache is safe for concurrent use.
+type Cache struct {
+	logger  *logger.CustomLogger
+	dir     string
+	maxSize int64
+	maxAge  time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*CacheEntry // indexed by file name
+	refs    map[string]int         // number of calls using each file, indexed by file name
+	dirty   bool                   // the index has changes not written yet
+}
+
+// NewCache returns a cache for the audio files stored in the given directory; zero values for
+// maxSize (in bytes) and maxAge disable the related limit
+func NewCache(logger *logger.CustomLogger, dir string, maxSize int64, maxAge time.Duration) *Cache {
+	return &Cache{
+		logger:  logger,
+		dir:     dir,
+		maxSize: maxSize,
+		maxAge:  maxAge,
+		entries: make(map[string]*CacheEntry),
+		refs:    make(map[string]int),
+	}
+}
+
+// Load reads the index of the cache and synchronizes it with the files actually present in
+// the cache directory; files created by older versions of the addon are added to the index
+func (c *Cache) Load() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	data, err := os.ReadFile(filepath.Join(c.dir, cacheIndexFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if len(data) > 0 {
+		var entries []*CacheEntry
+		if err := json.Unmarshal(data, &entries); err != nil {
+			c.logger.WarnPkgf(logPrefix, "Ignoring the corrupted cache index: %s", err)
+		}
+		for _, e := range entries {
+			c.entries[e.File] = e
+		}
+	}
+
+	files, err := os.ReadDir(c.dir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	present := make(map[string]bool)
+	for _, f := range files {
+		name := f.Name()
+		switch {
+		case strings.HasSuffix(name, ".tmp"):
+			// leftover of an interrupted download or conversion
+			_ = os.Remove(filepath.Join(c.dir, name))
+		case strings.HasSuffix(name, ".wav") && f.Type().IsRegular():
+			present[name] = true
+			if c.entries[name] == nil {
+				info, err := f.Info()
+				if err != nil {
+					continue
+				}
+				c.entries[name] = &CacheEntry{File: name, Size: info.Size(), CreatedAt: info.ModTime(), LastUsed: info.ModTime()}
+			}
+		}
+	}
+	for name := range c.entries {
+		if !present[name] {
+			delete(c.entries, name)
+		}
+	}
+
+	c.evict("")
+	c.logger.InfoPkgf(logPrefix, "Loaded the audio file cache: %d files, %d bytes", len(c.entries), c.totalSize())
+	return c.save()
+}
+
+// Get returns true if the given file is in the cache and has not expired; the file is then
+// marked as recently used. The index is not written, to keep lookups cheap.
+func (c *Cache) Get(path string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	name := filepath.Base(path)
+	e := c.entries[name]
+	if e == nil {
+		return false
+	}
+	if c.expired(e) {
+		c.remove(name)
+		c.dirty = true
+		return false
+	}
+	if _, err := os.Stat(path); err != nil {
+		// removed by somebody else
+		delete(c.entries, name)
+		c.dirty = true
+		return false
+	}
+
+	e.LastUsed = time.Now()
+	c.dirty = true
+	return true
+}
+
+// Put adds to the cache the given file, which must already be in the cache directory, and
+// evicts other files if needed
+func (c *Cache) Put(path string, entry CacheEntry) {
+	info, err := os.Stat(path)
+	if err != nil {
+		c.logger.WarnPkgf(logPrefix, "Cannot add [%s] to the cache: %s", path, err)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry.File = filepath.Base(path)
+	entry.Size = info.Size()
+	entry.CreatedAt = time.Now()
+	entry.LastUsed = entry.CreatedAt
+	c.entries[entry.File] = &entry
+
+	c.evict(entry.File)
+	if err := c.save(); err != nil {
+		c.logger.WarnPkgf(logPrefix, "Error saving the cache index: %s", err)
+	}
+}
+
+// Pin marks the given file, which must already be in the cache, as never to be evicted
+func (c *Cache) Pin(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e := c.entries[filepath.Base(path)]; e != nil && !e.Pinned {
+		e.Pinned = true
+		_ = c.save()
+	}
+}
+
+// Acquire marks the given file as used by a call, so that it does not get evicted till it's
+// released by [Cache.Release]; it returns false if the file is not in the cache anymore.
+// Files outside the cache directory are never evicted, so acquiring them always succeeds.
+func (c *Cache) Acquire(path string) bool {
+	if filepath.Dir(path) != filepath.Clean(c.dir) {
+		return true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	name := filepath.Base(path)
+	if c.entries[name] == nil {
+		return false
+	}
+	c.refs[name]++
+	return true
+}
+
+// Release marks the given file, acquired by [Cache.Acquire], as no longer used by a call
+func (c *Cache) Release(path string) {
+	if filepath.Dir(path) != filepath.Clean(c.dir) {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	name := filepath.Base(path)
+	if c.refs[name] <= 1 {
+		delete(c.refs, name)
+	} else {
+		c.refs[name]--
+	}
+}
+
+// Flush writes the index of the cache, if it has changes not written yet
+func (c *Cache) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.dirty {
+		return nil
+	}
+	return c.save()
+}
+
+// Remove deletes the given file from the cache
+func (c *Cache) Remove(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.remove(filepath.Base(path))
+	_ = c.save()
+}
+
+// hashedFilepath returns a path inside the cache directory whose name is unique for the given key
+func (c *Cache) hashedFilepath(prefix string, key string) string {
+	// Hash with sha256 the key to create a unique filename:
+	hasher := sha256.New()
+	hasher.Write([]byte(key))
+	hash := hex.EncodeToString(hasher.Sum(nil))
+	return filepath.Join(c.dir, prefix+hash+".wav")
+}
+
+// expired returns true if the given file is older than the max age; pinned files and files in use
+// never expire
+func (c *Cache) expired(e *CacheEntry) bool {
+	return c.maxAge > 0 && !e.Pinned && c.refs[e.File] == 0 && time.Since(e.CreatedAt) > c.maxAge
+}
+
+// evict removes the expired files and then the least recently used ones, until the cache
+// size is within the limit; the file named keep, the pinned files and the files in use are never removed
+func (c *Cache) evict(keep string) {
+	for name, e := range c.entries {
+		if name != keep && c.expired(e) {
+			c.logger.InfoPkgf(logPrefix, "Evicting expired audio file [%s] created at %s", name, e.CreatedAt.Format(time.RFC3339))
+			c.remove(name)
+			metrics.TTSCacheEvictions.Inc()
+		}
+	}
+
+	if c.maxSize > 0 {
+		lru := make([]*CacheEntry, 0, len(c.entries))
+		for _, e := range c.entries {
+			lru = append(lru, e)
+		}
+		slices.SortFunc(lru, func(a, b *CacheEntry) int { return a.LastUsed.Compare(b.LastUsed) })
+
+		size := c.totalSize()
+		for _, e := range lru {
+			if size <= c.maxSize {
+				break
+			}
+			if e.File == keep || e.Pinned || c.refs[e.File] > 0 {
+				continue
+			}
+			c.logger.InfoPkgf(logPrefix, "Evicting least recently used audio file [%s] to keep the cache within %d bytes", e.File, c.maxSize)
+			size -= e.Size
+			c.remove(e.File)
+			metrics.TTSCacheEvictions.Inc()
+		}
+	}
+}
+
+func (c *Cache) remove(name string) {
+	if err := os.Remove(filepath.Join(c.dir, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		c.logger.WarnPkgf(logPrefix, "Error removing cached audio file [%s]: %s", name, err)
+	}
+	delete(c.entries, name)
+}
+
+func (c *Cache) totalSize() int64 {
+	var size int64
+	for _, e := range c.entries {
+		size += e.Size
+	}
+	return size
+}
+
+// save writes the index of the cache; the index is first written to a temporary file, so that
+// a crash never leaves a truncated index
+func (c *Cache) save() error {
+	metrics.TTSCacheSize.Set(float64(c.totalSize()))
+
+	entries := make([]*CacheEntry, 0, len(c.entries))
+	for _, e := range c.entries {
+		entries = append(entries, e)
+	}
+	slices.SortFunc(entries, func(a, b *CacheEntry) int { return strings.Compare(a.File, b.File) })
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(c.dir, 0750); err != nil {
+		return err
+	}
+	path := filepath.Join(c.dir, cacheIndexFile)
+	if err := os.WriteFile(path+".tmp", data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	c.dirty = false
+	return nil
+}
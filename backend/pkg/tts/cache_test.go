@@ -0,0 +1,180 @@
+package tts
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"voip-client-backend/pkg/logger"
+)
+
+func writeCacheFile(t *testing.T, dir, name string, size int) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, make([]byte, size), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func TestCacheLRUEviction(t *testing.T) {
+	dir := t.TempDir()
+	c := NewCache(logger.NewCustomLogger("test"), dir, 250, 0)
+
+	a := writeCacheFile(t, dir, "tts_a.wav", 100)
+	c.Put(a, CacheEntry{Message: "a"})
+	b := writeCacheFile(t, dir, "tts_b.wav", 100)
+	c.Put(b, CacheEntry{Message: "b"})
+	if !c.Get(a) {
+		t.Fatal("a must be in the cache")
+	}
+
+	// a has been used more recently than b, so b gets evicted
+	d := writeCacheFile(t, dir, "tts_d.wav", 100)
+	c.Put(d, CacheEntry{Message: "d"})
+	if c.Get(b) || fileExists(b) {
+		t.Error("the least recently used file was not evicted")
+	}
+	if !c.Get(a) || !c.Get(d) {
+		t.Error("the most recently used files were evicted")
+	}
+
+	// a file larger than the whole cache is kept, at least till the next one arrives
+	big := writeCacheFile(t, dir, "tts_big.wav", 1000)
+	c.Put(big, CacheEntry{Message: "big"})
+	if !c.Get(big) || c.Get(a) || c.Get(d) {
+		t.Error("the new file must be kept, evicting all the others")
+	}
+}
+
+func TestCacheMaxAge(t *testing.T) {
+	dir := t.TempDir()
+	c := NewCache(logger.NewCustomLogger("test"), dir, 0, time.Hour)
+
+	path := writeCacheFile(t, dir, "tts_old.wav", 100)
+	c.Put(path, CacheEntry{Message: "old"})
+	if !c.Get(path) {
+		t.Fatal("a new file must be in the cache")
+	}
+
+	c.entries["tts_old.wav"].CreatedAt = time.Now().Add(-2 * time.Hour)
+	if c.Get(path) || fileExists(path) {
+		t.Error("the expired file was not evicted")
+	}
+}
+
+func TestCachePinned(t *testing.T) {
+	dir := t.TempDir()
+	c := NewCache(logger.NewCustomLogger("test"), dir, 150, time.Hour)
+
+	pinned := writeCacheFile(t, dir, "hold_tone.wav", 100)
+	c.Put(pinned, CacheEntry{Source: "hold tone", Pinned: true})
+	c.entries["hold_tone.wav"].CreatedAt = time.Now().Add(-2 * time.Hour)
+	other := writeCacheFile(t, dir, "tts_other.wav", 100)
+	c.Put(other, CacheEntry{Message: "other"})
+	if !c.Get(pinned) || !c.Get(other) {
+		t.Fatal("the pinned file must be kept, even if expired and least recently used")
+	}
+
+	next := writeCacheFile(t, dir, "tts_next.wav", 100)
+	c.Put(next, CacheEntry{Message: "next"})
+	if !c.Get(pinned) || c.Get(other) {
+		t.Error("the unpinned file must be evicted instead of the pinned one")
+	}
+}
+
+func TestCacheInUse(t *testing.T) {
+	dir := t.TempDir()
+	c := NewCache(logger.NewCustomLogger("test"), dir, 150, time.Hour)
+
+	used := writeCacheFile(t, dir, "tts_used.wav", 100)
+	c.Put(used, CacheEntry{Message: "used"})
+	if !c.Acquire(used) {
+		t.Fatal("cannot acquire a file in the cache")
+	}
+	c.entries["tts_used.wav"].CreatedAt = time.Now().Add(-2 * time.Hour)
+
+	// the file used by a call is neither expired nor the one evicted to make room
+	other := writeCacheFile(t, dir, "tts_other.wav", 100)
+	c.Put(other, CacheEntry{Message: "other"})
+	next := writeCacheFile(t, dir, "tts_next.wav", 100)
+	c.Put(next, CacheEntry{Message: "next"})
+	if !c.Get(used) || !fileExists(used) || c.Get(other) {
+		t.Fatal("the file in use must be kept, evicting the unused one instead")
+	}
+
+	// once released, it can be evicted again
+	c.Release(used)
+	if c.Get(used) || fileExists(used) {
+		t.Error("the released file was not evicted after its expiry")
+	}
+	if c.Acquire(used) {
+		t.Error("a file evicted from the cache was acquired")
+	}
+	if !c.Acquire("/usr/share/baresip/test-message.wav") {
+		t.Error("a file outside the cache directory cannot be acquired")
+	}
+}
+
+func TestCacheIndexWrittenLazily(t *testing.T) {
+	dir := t.TempDir()
+	c := NewCache(logger.NewCustomLogger("test"), dir, 0, 0)
+	path := writeCacheFile(t, dir, "tts_a.wav", 100)
+	c.Put(path, CacheEntry{Message: "a"})
+	indexPath := filepath.Join(dir, cacheIndexFile)
+	before, err := os.ReadFile(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a cache hit only updates the index in memory...
+	time.Sleep(10 * time.Millisecond)
+	if !c.Get(path) {
+		t.Fatal("the file must be in the cache")
+	}
+	if after, _ := os.ReadFile(indexPath); string(after) != string(before) {
+		t.Error("the index was written on a cache hit")
+	}
+
+	// ...till it gets flushed
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if after, _ := os.ReadFile(indexPath); string(after) == string(before) {
+		t.Error("the last use time was not written by Flush")
+	}
+}
+
+func TestCacheLoad(t *testing.T) {
+	dir := t.TempDir()
+	c := NewCache(logger.NewCustomLogger("test"), dir, 0, 0)
+	indexed := writeCacheFile(t, dir, "tts_indexed.wav", 100)
+	c.Put(indexed, CacheEntry{Message: "hello", Engine: EngineOptions{Platform: "tts.piper"}})
+	deleted := writeCacheFile(t, dir, "tts_deleted.wav", 100)
+	c.Put(deleted, CacheEntry{Message: "deleted"})
+
+	// files created by older versions, leftovers and files removed by the user
+	legacy := writeCacheFile(t, dir, "tts_legacy.wav", 100)
+	leftover := writeCacheFile(t, dir, "tts_partial.wav.tmp", 100)
+	_ = os.Remove(deleted)
+
+	c = NewCache(logger.NewCustomLogger("test"), dir, 0, 0)
+	if err := c.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.entries) != 2 || !c.Get(indexed) || !c.Get(legacy) {
+		t.Errorf("got cache entries %v, want the indexed and the legacy files", c.entries)
+	}
+	if e := c.entries["tts_indexed.wav"]; e.Message != "hello" || e.Engine.Platform != "tts.piper" {
+		t.Errorf("the metadata of the indexed file were lost: %+v", e)
+	}
+	if fileExists(leftover) {
+		t.Error("the leftover temporary file was not removed")
+	}
+}
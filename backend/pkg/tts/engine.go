@@ -0,0 +1,63 @@
+package tts
+
+import (
+	"encoding/json"
+	"maps"
+
+	"voip-client-backend/pkg/config"
+)
+
+// EngineOptions selects the TTS engine, the language and the voice used to synthesize a message;
+// empty fields use the defaults of the addon configuration or of the TTS engine itself
+type EngineOptions struct {
+	// Platform is the TTS engine, e.g. "google_translate" or "tts.piper"
+	Platform string `json:"tts_platform,omitempty"`
+	Language string `json:"language,omitempty"`
+	Voice    string `json:"voice,omitempty"`
+	// Options are forwarded as they are to the TTS engine
+	Options map[string]any `json:"options,omitempty"`
+}
+
+// IsZero returns true if no option is set, i.e. all defaults apply
+func (e EngineOptions) IsZero() bool {
+	return e.Platform == "" && e.Language == "" && e.Voice == "" && len(e.Options) == 0
+}
+
+// WithDefaults returns a copy of e where the empty fields are taken from defaults; the engine
+// options of both are merged, with the ones in e taking precedence
+func (e EngineOptions) WithDefaults(defaults EngineOptions) EngineOptions {
+	merged := e
+	if merged.Platform == "" {
+		merged.Platform = defaults.Platform
+	}
+	if merged.Language == "" {
+		merged.Language = defaults.Language
+	}
+	if merged.Voice == "" {
+		merged.Voice = defaults.Voice
+	}
+	if len(defaults.Options) > 0 {
+		merged.Options = maps.Clone(defaults.Options)
+		maps.Copy(merged.Options, e.Options)
+	}
+	return merged
+}
+
+// cacheKey returns a string identifying the options, to be used as part of the cache key
+func (e EngineOptions) cacheKey() string {
+	// map keys are sorted by the JSON encoder, so the result is stable
+	key, _ := json.Marshal(e)
+	return string(key)
+}
+
+// ContactEngineOptions returns the TTS options configured for the given contact; options that
+// cannot be parsed are ignored, see [config.AddonContact.GetTTSOptions]
+func ContactEngineOptions(c config.AddonContact) EngineOptions {
+	options, _ := c.GetTTSOptions()
+	return EngineOptions{
+		Platform: c.TTSPlatform,
+		Language: c.Language,
+		Voice:    c.Voice,
+		Options:  options,
+	}
+}
@@ -0,0 +1,56 @@
+package tts
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEngineOptionsWithDefaults(t *testing.T) {
+	contact := EngineOptions{Platform: "tts.piper", Language: "it-IT", Voice: "paola", Options: map[string]any{"speed": 1.2, "gender": "female"}}
+	request := EngineOptions{Language: "en-US", Options: map[string]any{"speed": 0.9}}
+
+	got := request.WithDefaults(contact)
+	want := EngineOptions{Platform: "tts.piper", Language: "en-US", Voice: "paola", Options: map[string]any{"speed": 0.9, "gender": "female"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if contact.Options["speed"] != 1.2 {
+		t.Error("the defaults must not be modified")
+	}
+	if !(EngineOptions{}).WithDefaults(EngineOptions{}).IsZero() {
+		t.Error("merging empty options must give empty options")
+	}
+}
+
+func TestOutputFilepath(t *testing.T) {
+	s := &TTSService{platform: "google_translate", cache: NewCache(nil, "/cache", 0, 0)}
+	message := "the alarm has been triggered"
+	defaultPath := s.getOutputFilepath(message, EngineOptions{})
+	if defaultPath != s.getOutputFilepath(message, EngineOptions{Platform: "google_translate"}) {
+		t.Errorf("the default TTS engine must give the same cache key when selected explicitly")
+	}
+	other := &TTSService{platform: "tts.piper", cache: s.cache}
+	if defaultPath == other.getOutputFilepath(message, EngineOptions{}) {
+		t.Errorf("changing the default TTS engine must change the cache key")
+	}
+
+	paths := map[string]bool{defaultPath: true}
+	for _, engine := range []EngineOptions{
+		{Platform: "tts.cloud"},
+		{Language: "it-IT"},
+		{Voice: "paola"},
+		{Options: map[string]any{"speed": 1.2}},
+	} {
+		path := s.getOutputFilepath(message, engine)
+		if paths[path] {
+			t.Errorf("options %+v collide with other options in the cache", engine)
+		}
+		paths[path] = true
+	}
+
+	a := s.getOutputFilepath(message, EngineOptions{Options: map[string]any{"a": 1, "b": 2, "c": 3}})
+	b := s.getOutputFilepath(message, EngineOptions{Options: map[string]any{"c": 3, "b": 2, "a": 1}})
+	if a != b {
+		t.Error("the cache key must not depend on the order of the options")
+	}
+}
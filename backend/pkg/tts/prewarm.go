@@ -0,0 +1,63 @@
+package tts
+
+import "time"
+
+// the messages to pre-warm at startup are retried, since Home Assistant may still be starting
+const (
+	prewarmAttempts   = 4
+	prewarmRetryDelay = 30 * time.Second
+)
+
+// PrewarmResult reports the outcome of the synthesis of a message by [TTSService.Prewarm]
+type PrewarmResult struct {
+	Message string `json:"message"`
+	// Cached is true if the audio file was already in the cache
+	Cached bool   `json:"cached"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Prewarm converts the given messages into speech and stores them in the cache, so that the
+// calls using them do not have to wait for the TTS engine
+func (t *TTSService) Prewarm(messages []string, engine EngineOptions) []PrewarmResult {
+	results := make([]PrewarmResult, 0, len(messages))
+	for _, message := range messages {
+		result := PrewarmResult{
+			Message: message,
+			Cached:  t.lookupCache(t.getOutputFilepath(message, engine)),
+		}
+		if !result.Cached {
+			if _, err := t.getTTSAudioFile(message, engine); err != nil {
+				result.Error = err.Error()
+			}
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// PrewarmAtStartup runs [TTSService.Prewarm] on the messages listed in the addon configuration,
+// retrying a few times the ones that fail
+func (t *TTSService) PrewarmAtStartup(messages []string) {
+	delay := prewarmRetryDelay
+	for attempt := 1; ; attempt++ {
+		var failed []string
+		for _, result := range t.Prewarm(messages, EngineOptions{}) {
+			if result.Error != "" {
+				failed = append(failed, result.Message)
+			}
+		}
+		if len(failed) == 0 {
+			t.logger.InfoPkgf(logPrefix, "All the %d messages to pre-warm are in the cache", len(messages))
+			return
+		}
+		if attempt == prewarmAttempts {
+			t.logger.WarnPkgf(logPrefix, "Giving up pre-warming %d messages after %d attempts", len(failed), attempt)
+			return
+		}
+
+		t.logger.InfoPkgf(logPrefix, "Pre-warming of %d messages failed, retrying in %s", len(failed), delay)
+		time.Sleep(delay)
+		delay *= 2
+		messages = failed
+	}
+}
@@ -3,54 +3,99 @@ package tts
 import (
 	"bytes"
 	"context"
-	"crypto/sha256"
-	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
+	"maps"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
+	"voip-client-backend/pkg/audio"
 	"voip-client-backend/pkg/logger"
+	"voip-client-backend/pkg/metrics"
 )
 
 const ttsUrl = "http://hassio/homeassistant/api/tts_get_url"
-const ttsDlPath = "/share/voip-client"
 const ttsHttpApiTimeout = 10 * time.Second
 const logPrefix = "tts"
 
+// mediaDirs are the directories where the audio files to play can be found; they are mapped into
+// the addon container by the "map" section of config.yaml
+var mediaDirs = []string{"/share", "/media"}
+
 type TTSService struct {
 	logger   *logger.CustomLogger
 	platform string
+	cache    *Cache
 }
 
 // see https://www.home-assistant.io/integrations/tts/#rest-api
 // and https://www.home-assistant.io/integrations/google_translate/
-type haTTSOptions struct {
-	PreferredFormat         string `json:"preferred_format"`
-	PreferredSampleRate     string `json:"preferred_sample_rate"`
-	PreferredSampleChannels string `json:"preferred_sample_channels"`
-	PreferredSampleBytes    string `json:"preferred_sample_bytes"`
-}
 type haTTSRequestPayload struct {
-	Message  string       `json:"message"`
-	Platform string       `json:"platform"`
-	Options  haTTSOptions `json:"options"`
+	Message  string         `json:"message"`
+	Platform string         `json:"platform"`
+	Language string         `json:"language,omitempty"`
+	Options  map[string]any `json:"options"`
 }
 type haTTSResponsePayload struct {
 	URL  string `json:"url"`
 	Path string `json:"path"`
 }
 
-func NewTTSService(logger *logger.CustomLogger, platform string) *TTSService {
+// AudioRequest describes the audio to play during a call; exactly one of its fields must be set
+type AudioRequest struct {
+	// Message is the text to convert into speech
+	Message string
+	// File is the path of a pre-recorded audio file, under /share or /media
+	File string
+	// URL is the HTTP(S) address of a pre-recorded audio file
+	URL string
+	// Engine selects the TTS engine and voice used for Message
+	Engine EngineOptions
+}
+
+// ValidateAudioFile checks that the given path is an absolute path under one of the directories
+// mapped into the addon container
+func ValidateAudioFile(path string) error {
+	if !filepath.IsAbs(path) {
+		return fmt.Errorf("audio file path must be absolute: %s", path)
+	}
+	cleanPath := filepath.Clean(path)
+	for _, dir := range mediaDirs {
+		if strings.HasPrefix(cleanPath, dir+"/") {
+			return nil
+		}
+	}
+	return fmt.Errorf("audio file must be under %s: %s", strings.Join(mediaDirs, " or "), path)
+}
+
+// ValidateAudioURL checks that the given URL is an HTTP(S) URL
+func ValidateAudioURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid audio URL: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("audio URL must be an http:// or https:// URL: %s", rawURL)
+	}
+	return nil
+}
+
+func NewTTSService(logger *logger.CustomLogger, platform string, cache *Cache) *TTSService {
 	return &TTSService{
 		logger:   logger,
 		platform: platform,
+		cache:    cache,
 	}
 }
 
-func (t *TTSService) getTTSURL(message string) (*haTTSResponsePayload, error) {
+func (t *TTSService) getTTSURL(message string, engine EngineOptions) (*haTTSResponsePayload, error) {
 
 	hassioToken := os.Getenv("HASSIO_TOKEN")
 	if hassioToken == "" {
@@ -60,18 +105,28 @@ func (t *TTSService) getTTSURL(message string) (*haTTSResponsePayload, error) {
 	payload := haTTSRequestPayload{
 		Message:  message,
 		Platform: t.platform,
+		Language: engine.Language,
 
 		// The TTS options are dictated by Baresip which supports (via the "aufile" module)
 		// only the following specifications: monochannel, 8kHz, 16bit WAV
-		// If we had to do the conversion ourselves, using ffmpeg CLI utility it would be:
-		//  ffmpeg -i input.wav -ac 1 -ar 8000 -acodec pcm_s16le baresip-audio.wav
-		Options: haTTSOptions{
-			PreferredFormat:         "wav",
-			PreferredSampleRate:     "8000",
-			PreferredSampleChannels: "1", // monochannel
-			PreferredSampleBytes:    "2", // 16bit audio sampling
+		// Many TTS engines ignore these preferences: in such case the audio file gets
+		// converted after the download, see convertAudioFile()
+		Options: map[string]any{
+			"preferred_format":          "wav",
+			"preferred_sample_rate":     "8000",
+			"preferred_sample_channels": "1", // monochannel
+			"preferred_sample_bytes":    "2", // 16bit audio sampling
 		},
 	}
+	if engine.Platform != "" {
+		payload.Platform = engine.Platform
+	}
+	if engine.Voice != "" {
+		payload.Options["voice"] = engine.Voice
+	}
+	// the options of the request can override the preferences above, since the audio file
+	// gets converted anyway
+	maps.Copy(payload.Options, engine.Options)
 	payloadBytes, err := json.Marshal(payload)
 	if err != nil {
 		return nil, fmt.Errorf("error marshalling payload: %w", err)
@@ -121,15 +176,24 @@ func (t *TTSService) getTTSURL(message string) (*haTTSResponsePayload, error) {
 	return &responsePayload, nil
 }
 
-func (t *TTSService) getOutputFilepath(message string) string {
-	// Hash with sha256 the message to create a unique filename:
-	hasher := sha256.New()
-	hasher.Write([]byte(message))
-	hash := hex.EncodeToString(hasher.Sum(nil))
-	return filepath.Join(ttsDlPath, "tts_"+hash+".wav")
+// withDefaultPlatform returns the given options with the default TTS engine of the addon
+// configuration, unless another one is selected
+func (t *TTSService) withDefaultPlatform(engine EngineOptions) EngineOptions {
+	if engine.Platform == "" {
+		engine.Platform = t.platform
+	}
+	return engine
+}
+
+func (t *TTSService) getOutputFilepath(message string, engine EngineOptions) string {
+	// the same message spoken by different engines or voices must not collide, and neither must
+	// the files synthesized before a change of the default TTS engine
+	return t.cache.hashedFilepath("tts_", message+"|"+t.withDefaultPlatform(engine).cacheKey())
 }
 
-func (t *TTSService) downloadAudioFile(url string, outPath string) error {
+// downloadAudioFile downloads the given URL into a temporary file inside the cache directory and
+// returns its path; the caller must move it into place using installAudioFile
+func (t *TTSService) downloadAudioFile(url string) (string, error) {
 	// Create a custom HTTP client with timeouts
 	client := &http.Client{
 		Timeout: ttsHttpApiTimeout,
@@ -142,39 +206,106 @@ func (t *TTSService) downloadAudioFile(url string, outPath string) error {
 
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	// Get the data
 	// Suppress G704: SSRF via taint analysis (gosec)
-	// Reason: the download URL is generated by Home Assistant TTS service, which is a trusted source
-	// in this context, and the risk of SSRF is mitigated by the fact that the URL
-	// is not influenced by external user input and is only used to download audio
-	// files for TTS purposes.
-	// Additionally, the HTTP client has a timeout set to prevent hanging requests.
+	// Reason: the download URL is either generated by Home Assistant TTS service, which is a trusted source
+	// in this context, or it's the "audio_url" provided by Home Assistant automations, which are
+	// trusted as well, since they can already drive this addon anyway.
+	// The URL is only used to download audio files, and the HTTP client has a timeout set to
+	// prevent hanging requests.
 	resp, err := client.Do(req) //nolint:gosec
 	if err != nil {
-		return err
+		return "", err
 	}
 	defer func() { _ = resp.Body.Close() }()
 
-	// Create the file
-	out, err := os.Create(outPath) //nolint:gosec
-	if err != nil {
-		return err
+	// an error page must never end up in the cache
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected HTTP status %s", resp.Status)
+	}
+	if contentType := resp.Header.Get("Content-Type"); !isAudioContentType(contentType) {
+		return "", fmt.Errorf("unexpected content type %s", contentType)
 	}
-	defer func() { _ = out.Close() }()
 
-	// Write the body to file
+	// Write the body to a temporary file
+	out, err := os.CreateTemp(t.cache.dir, "download_*.tmp")
+	if err != nil {
+		return "", err
+	}
 	_, err = io.Copy(out, resp.Body)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
-		return err
+		_ = os.Remove(out.Name())
+		return "", err
 	}
 
-	return nil
+	return out.Name(), nil
 }
 
+// isAudioContentType returns false for the content types of the error pages returned by web servers;
+// servers often use generic types for audio files, so anything else is accepted
+func isAudioContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		// missing or invalid: the file content will tell
+		return true
+	}
+	return !strings.HasPrefix(mediaType, "text/") && mediaType != "application/json"
+}
+
+// installAudioFile converts, if needed, the audio file at tmpPath and moves it to outPath, only if
+// the result is a valid WAV file; tmpPath is always removed
+func (t *TTSService) installAudioFile(tmpPath, outPath string) error {
+	defer func() { _ = os.Remove(tmpPath) }()
+
+	if err := t.convertAudioFile(tmpPath); err != nil {
+		return fmt.Errorf("error converting audio file: %w", err)
+	}
+	if err := audio.Validate(tmpPath); err != nil {
+		return fmt.Errorf("invalid audio file: %w", err)
+	}
+	return os.Rename(tmpPath, outPath)
+}
+
+// lookupCache returns true if the given file is in the cache and is valid; corrupted files are
+// removed from the cache, so that they get produced again
+func (t *TTSService) lookupCache(path string) bool {
+	if !t.cache.Get(path) {
+		return false
+	}
+	if err := audio.Validate(path); err != nil {
+		t.logger.WarnPkgf(logPrefix, "Removing corrupted audio file [%s] from the cache: %s", path, err)
+		t.cache.Remove(path)
+		return false
+	}
+	return true
+}
+
+// AcquireFile marks the given audio file, returned by one of the Get methods, as used by a call, so
+// that it does not get evicted from the cache till [TTSService.ReleaseFile] is invoked; it returns
+// false if the file has been evicted in the meantime
+func (t *TTSService) AcquireFile(path string) bool {
+	return t.cache.Acquire(path)
+}
+
+// ReleaseFile marks the given audio file as no longer used by a call
+func (t *TTSService) ReleaseFile(path string) {
+	t.cache.Release(path)
+}
+
+// GetAudioFile returns the path of a WAV file, inside the cache directory, with the given message
+// spoken by the default TTS engine
 func (t *TTSService) GetAudioFile(message string) (string, error) {
+	return t.getTTSAudioFile(message, EngineOptions{})
+}
+
+// getTTSAudioFile converts the given message into speech, using the given TTS options
+func (t *TTSService) getTTSAudioFile(message string, engine EngineOptions) (string, error) {
 
 	// Support local testing outside HomeAssistant environment
 	localTesting := os.Getenv("LOCAL_TESTING") != ""
@@ -184,31 +315,229 @@ func (t *TTSService) GetAudioFile(message string) (string, error) {
 	}
 
 	// Prepare the output file path
-	outPath := t.getOutputFilepath(message)
-	if _, err := os.Stat(outPath); err == nil {
+	outPath := t.getOutputFilepath(message, engine)
+	if t.lookupCache(outPath) {
 		// the result of TTS engine has been cached...
 		t.logger.InfoPkgf(logPrefix, "Audio file for message [%s] already exists at [%s], skipping TTS service call", message, outPath)
+		metrics.TTSCacheHits.Inc()
 		return outPath, nil
 	}
+	metrics.TTSCacheMisses.Inc()
 
 	// Prepare output directory
-	if err := os.MkdirAll(ttsDlPath, 0750); err != nil {
-		return "", fmt.Errorf("error creating directory %s: %w", ttsDlPath, err)
+	if err := os.MkdirAll(t.cache.dir, 0750); err != nil {
+		return "", fmt.Errorf("error creating directory %s: %w", t.cache.dir, err)
 	}
 
 	// Get the TTS URL
-	responsePayload, err := t.getTTSURL(message)
+	startTime := time.Now()
+	responsePayload, err := t.getTTSURL(message, engine)
 	if err != nil {
+		metrics.TTSFailures.Inc()
 		return "", fmt.Errorf("error getting TTS URL: %w", err)
 	}
 
 	// Download the audio file
-	err = t.downloadAudioFile(responsePayload.URL, outPath)
+	tmpPath, err := t.downloadAudioFile(responsePayload.URL)
 	if err != nil {
+		metrics.TTSFailures.Inc()
 		return "", fmt.Errorf("error downloading audio file: %w", err)
 	}
+	err = t.installAudioFile(tmpPath, outPath)
+	if err != nil {
+		metrics.TTSFailures.Inc()
+		return "", err
+	}
+	metrics.TTSLatency.Observe(time.Since(startTime).Seconds())
 
+	t.cache.Put(outPath, CacheEntry{Message: message, Engine: t.withDefaultPlatform(engine)})
 	t.logger.InfoPkgf(logPrefix, "Successfully retrieved audio file and stored at [%s]", outPath)
 
 	return outPath, nil // return the path to the downloaded file
 }
+
+// holdTone is played while the audio of a call is not ready yet: a short beep every 2 seconds
+var holdTone = []audio.Tone{
+	{Frequency: 425, Duration: 300 * time.Millisecond},
+	{Duration: 1700 * time.Millisecond},
+}
+
+// alarmTone is played when the audio of a call cannot be prepared and no fallback audio file
+// is configured: a two-tone siren
+var alarmTone = slices.Repeat([]audio.Tone{
+	{Frequency: 960, Duration: 250 * time.Millisecond},
+	{Frequency: 770, Duration: 250 * time.Millisecond},
+}, 8)
+
+// GetSilenceFile returns the path of a WAV file, inside the cache directory, containing the given
+// duration of silence; the file is generated, so this works also in local testing mode
+func (t *TTSService) GetSilenceFile(d time.Duration) (string, error) {
+	return t.getToneFile(fmt.Sprintf("silence_%dms.wav", d.Milliseconds()), []audio.Tone{{Duration: d}},
+		CacheEntry{Source: "silence " + d.String()})
+}
+
+// GetHoldToneFile returns the path of a WAV file, inside the cache directory, containing the tone
+// played while the audio of a call is not ready yet; the file is never evicted from the cache
+func (t *TTSService) GetHoldToneFile() (string, error) {
+	return t.getToneFile("hold_tone.wav", holdTone, CacheEntry{Source: "hold tone", Pinned: true})
+}
+
+// GetFallbackFile returns the path of a WAV file, inside the cache directory, to play when the audio
+// of a call cannot be prepared: a copy of the given pre-recorded audio file or, if empty, a built-in
+// alarm tone; the file is never evicted from the cache
+func (t *TTSService) GetFallbackFile(path string) (string, error) {
+	if path == "" {
+		return t.getToneFile("alarm_tone.wav", alarmTone, CacheEntry{Source: "alarm tone", Pinned: true})
+	}
+
+	outPath, err := t.getLocalAudioFile(path)
+	if err != nil {
+		return "", err
+	}
+	t.cache.Pin(outPath)
+	return outPath, nil
+}
+
+// getToneFile returns the path of the WAV file with the given name, inside the cache directory,
+// containing the given tones; the file is added to the cache with the given metadata
+func (t *TTSService) getToneFile(name string, tones []audio.Tone, entry CacheEntry) (string, error) {
+	outPath := filepath.Join(t.cache.dir, name)
+	if t.lookupCache(outPath) {
+		return outPath, nil
+	}
+	if err := os.MkdirAll(t.cache.dir, 0750); err != nil {
+		return "", fmt.Errorf("error creating directory %s: %w", t.cache.dir, err)
+	}
+
+	// write to a temporary file first, so that a partial file never gets served from the cache;
+	// the temporary file is unique since several TTS workers may build the same file at once
+	tmp, err := os.CreateTemp(t.cache.dir, name+"_*.tmp")
+	if err != nil {
+		return "", err
+	}
+	tmpPath := tmp.Name()
+	_ = tmp.Close()
+	err = audio.WriteTones(tmpPath, tones)
+	if err == nil {
+		err = os.Rename(tmpPath, outPath)
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return "", fmt.Errorf("error writing %s file: %w", entry.Source, err)
+	}
+
+	t.cache.Put(outPath, entry)
+	t.logger.InfoPkgf(logPrefix, "Successfully created the %s file at [%s]", entry.Source, outPath)
+	return outPath, nil
+}
+
+// GetAudio returns the path of a WAV file, inside the cache directory, with the requested audio
+func (t *TTSService) GetAudio(req AudioRequest) (string, error) {
+	if os.Getenv("LOCAL_TESTING") != "" {
+		// getTTSAudioFile() already supports local testing outside HomeAssistant environment
+		return t.getTTSAudioFile(req.Message, req.Engine)
+	}
+
+	switch {
+	case req.File != "":
+		return t.getLocalAudioFile(req.File)
+	case req.URL != "":
+		return t.getRemoteAudioFile(req.URL)
+	default:
+		return t.getTTSAudioFile(req.Message, req.Engine)
+	}
+}
+
+// getLocalAudioFile copies the given pre-recorded audio file into the cache directory
+func (t *TTSService) getLocalAudioFile(path string) (string, error) {
+	if err := ValidateAudioFile(path); err != nil {
+		return "", err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("error accessing audio file: %w", err)
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("audio file %s is not a regular file", path)
+	}
+
+	// if the file gets modified, a new copy is made
+	outPath := t.cache.hashedFilepath("file_", path+"|"+strconv.FormatInt(info.Size(), 10)+"|"+info.ModTime().String())
+	if t.lookupCache(outPath) {
+		t.logger.InfoPkgf(logPrefix, "Audio file [%s] already copied at [%s]", path, outPath)
+		return outPath, nil
+	}
+	if err := os.MkdirAll(t.cache.dir, 0750); err != nil {
+		return "", fmt.Errorf("error creating directory %s: %w", t.cache.dir, err)
+	}
+
+	in, err := os.Open(filepath.Clean(path))
+	if err != nil {
+		return "", fmt.Errorf("error opening audio file: %w", err)
+	}
+	defer func() { _ = in.Close() }()
+	out, err := os.CreateTemp(t.cache.dir, "copy_*.tmp")
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(out.Name())
+		return "", fmt.Errorf("error copying audio file: %w", err)
+	}
+	if err := t.installAudioFile(out.Name(), outPath); err != nil {
+		return "", err
+	}
+
+	t.cache.Put(outPath, CacheEntry{Source: path})
+	t.logger.InfoPkgf(logPrefix, "Successfully copied audio file [%s] at [%s]", path, outPath)
+	return outPath, nil
+}
+
+// getRemoteAudioFile downloads the pre-recorded audio file at the given URL into the cache directory
+func (t *TTSService) getRemoteAudioFile(audioURL string) (string, error) {
+	if err := ValidateAudioURL(audioURL); err != nil {
+		return "", err
+	}
+
+	outPath := t.cache.hashedFilepath("url_", audioURL)
+	if t.lookupCache(outPath) {
+		t.logger.InfoPkgf(logPrefix, "Audio file at [%s] already downloaded at [%s]", audioURL, outPath)
+		return outPath, nil
+	}
+	if err := os.MkdirAll(t.cache.dir, 0750); err != nil {
+		return "", fmt.Errorf("error creating directory %s: %w", t.cache.dir, err)
+	}
+
+	tmpPath, err := t.downloadAudioFile(audioURL)
+	if err != nil {
+		return "", fmt.Errorf("error downloading audio file: %w", err)
+	}
+	if err := t.installAudioFile(tmpPath, outPath); err != nil {
+		return "", err
+	}
+
+	t.cache.Put(outPath, CacheEntry{Source: audioURL})
+	t.logger.InfoPkgf(logPrefix, "Successfully downloaded audio file [%s] at [%s]", audioURL, outPath)
+	return outPath, nil
+}
+
+// convertAudioFile converts in place the given audio file, if baresip cannot play it as it is
+func (t *TTSService) convertAudioFile(path string) error {
+	needed, err := audio.NeedsConversion(path)
+	if err != nil || !needed {
+		return err
+	}
+
+	t.logger.InfoPkgf(logPrefix, "Converting audio file [%s] to mono, %dHz, 16bit WAV", path, audio.TargetSampleRate)
+	tmpPath := path + ".tmp"
+	err = audio.Convert(path, tmpPath)
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	_ = os.Remove(tmpPath)
+	return err
+}
@@ -0,0 +1,212 @@
+package tts
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"voip-client-backend/pkg/audio"
+	"voip-client-backend/pkg/logger"
+)
+
+func TestValidateAudioFile(t *testing.T) {
+	tests := []struct {
+		path    string
+		wantErr bool
+	}{
+		{"/share/sounds/siren.wav", false},
+		{"/media/chime.mp3", false},
+		{"/share/../etc/passwd", true},
+		{"/share", true},
+		{"/sharebox/siren.wav", true},
+		{"sounds/siren.wav", true},
+		{"/data/options.json", true},
+	}
+	for _, tt := range tests {
+		if err := ValidateAudioFile(tt.path); (err != nil) != tt.wantErr {
+			t.Errorf("ValidateAudioFile(%q) returned %v, want error: %v", tt.path, err, tt.wantErr)
+		}
+	}
+}
+
+func TestValidateAudioURL(t *testing.T) {
+	tests := []struct {
+		url     string
+		wantErr bool
+	}{
+		{"http://media.local/siren.wav", false},
+		{"https://example.com/sounds/chime.wav?x=1", false},
+		{"ftp://example.com/siren.wav", true},
+		{"file:///share/siren.wav", true},
+		{"http://", true},
+		{"://bad", true},
+	}
+	for _, tt := range tests {
+		if err := ValidateAudioURL(tt.url); (err != nil) != tt.wantErr {
+			t.Errorf("ValidateAudioURL(%q) returned %v, want error: %v", tt.url, err, tt.wantErr)
+		}
+	}
+}
+
+// newTestAudioServer returns a server answering every request with the given status, content
+// type and body, counting the requests received
+func newTestAudioServer(t *testing.T, status int, contentType string, body []byte) (*httptest.Server, *int) {
+	t.Helper()
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		requests++
+		w.Header().Set("Content-Type", contentType)
+		w.WriteHeader(status)
+		_, _ = w.Write(body)
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func silenceWAV(t *testing.T) []byte {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "silence.wav")
+	if err := audio.WriteSilence(path, 100*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestGetRemoteAudioFile(t *testing.T) {
+	t.Setenv("LOCAL_TESTING", "")
+	wav := silenceWAV(t)
+
+	tests := []struct {
+		name        string
+		status      int
+		contentType string
+		body        []byte
+		wantErr     bool
+	}{
+		{"valid WAV", http.StatusOK, "audio/wav", wav, false},
+		{"generic content type", http.StatusOK, "application/octet-stream", wav, false},
+		{"not found", http.StatusNotFound, "audio/wav", wav, true},
+		{"error page", http.StatusOK, "text/html; charset=utf-8", []byte("<html>error</html>"), true},
+		{"truncated WAV", http.StatusOK, "audio/wav", wav[:len(wav)/2], true},
+		{"not audio", http.StatusOK, "audio/wav", []byte("definitely not a WAV file, but long enough to be parsed"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s := NewTTSService(logger.NewCustomLogger("test"), "test", NewCache(logger.NewCustomLogger("test"), dir, 0, 0))
+			server, _ := newTestAudioServer(t, tt.status, tt.contentType, tt.body)
+
+			path, err := s.getRemoteAudioFile(server.URL + "/audio.wav")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("getRemoteAudioFile() returned %v, want error: %v", err, tt.wantErr)
+			}
+			files, _ := filepath.Glob(filepath.Join(dir, "*.wav"))
+			tmpFiles, _ := filepath.Glob(filepath.Join(dir, "*.tmp"))
+			if len(tmpFiles) != 0 {
+				t.Errorf("temporary files left in the cache directory: %v", tmpFiles)
+			}
+			if tt.wantErr {
+				if len(files) != 0 {
+					t.Errorf("files left in the cache after a failed download: %v", files)
+				}
+				return
+			}
+			if err := audio.Validate(path); err != nil {
+				t.Errorf("downloaded file is not valid: %s", err)
+			}
+		})
+	}
+}
+
+func TestCorruptedCacheEntryIsDownloadedAgain(t *testing.T) {
+	t.Setenv("LOCAL_TESTING", "")
+	dir := t.TempDir()
+	s := NewTTSService(logger.NewCustomLogger("test"), "test", NewCache(logger.NewCustomLogger("test"), dir, 0, 0))
+	server, requests := newTestAudioServer(t, http.StatusOK, "audio/wav", silenceWAV(t))
+	url := server.URL + "/audio.wav"
+
+	path, err := s.getRemoteAudioFile(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.getRemoteAudioFile(url); err != nil || *requests != 1 {
+		t.Fatalf("second request: err %v, %d downloads, want a cache hit", err, *requests)
+	}
+
+	// corrupt the cached file
+	if err := os.WriteFile(path, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.getRemoteAudioFile(url); err != nil {
+		t.Fatal(err)
+	}
+	if *requests != 2 {
+		t.Errorf("got %d downloads, want the corrupted file to be downloaded again", *requests)
+	}
+	if err := audio.Validate(path); err != nil {
+		t.Errorf("cached file is still corrupted: %s", err)
+	}
+}
+
+func TestGetSilenceFileConcurrently(t *testing.T) {
+	t.Setenv("LOCAL_TESTING", "")
+	dir := t.TempDir()
+	s := NewTTSService(logger.NewCustomLogger("test"), "test", NewCache(logger.NewCustomLogger("test"), dir, 0, 0))
+
+	// several TTS workers may build the same file at once
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for range 8 {
+		wg.Go(func() {
+			path, err := s.GetSilenceFile(time.Second)
+			if err == nil {
+				err = audio.Validate(path)
+			}
+			errs <- err
+		})
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("GetSilenceFile() returned %v", err)
+		}
+	}
+	tmpFiles, _ := filepath.Glob(filepath.Join(dir, "*.tmp"))
+	if len(tmpFiles) != 0 {
+		t.Errorf("temporary files left in the cache directory: %v", tmpFiles)
+	}
+}
+
+func TestToneFilesInLocalTesting(t *testing.T) {
+	t.Setenv("LOCAL_TESTING", "1")
+	s := NewTTSService(logger.NewCustomLogger("test"), "test", NewCache(logger.NewCustomLogger("test"), t.TempDir(), 0, 0))
+
+	tests := []struct {
+		name string
+		get  func() (string, error)
+	}{
+		{"silence", func() (string, error) { return s.GetSilenceFile(2 * time.Second) }},
+		{"hold tone", s.GetHoldToneFile},
+		{"alarm tone", func() (string, error) { return s.GetFallbackFile("") }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, err := tt.get()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := audio.Validate(path); err != nil {
+				t.Errorf("%s file [%s] is not valid: %s", tt.name, path, err)
+			}
+		})
+	}
+}